@@ -0,0 +1,369 @@
+// Package client is a typed Go client for the Torwell84 backend API.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultAddr is the TCP address the backend listens on by default.
+const DefaultAddr = "127.0.0.1:9472"
+
+// Error is returned for non-2xx responses and carries the code of the
+// backend error envelope. RequestID finds the request in the logs.
+type Error struct {
+	Status    int
+	Code      string
+	Message   string
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("http %d", e.Status)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Client talks to one backend instance.
+type Client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// New returns a client for the API at baseURL (for example
+// "http://127.0.0.1:9472") authenticating with token.
+func New(baseURL, token string) *Client {
+	return &Client{base: strings.TrimRight(baseURL, "/"), token: token, http: &http.Client{}}
+}
+
+// NewUnix returns a client for the API socket at path.
+func NewUnix(path string) *Client {
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}
+	return &Client{base: "http://torwell84", http: &http.Client{Transport: tr}}
+}
+
+// ConfigDir returns the backend configuration directory, honouring
+// TORWELL84_CONFIG like the backend does.
+func ConfigDir() string {
+	if d := os.Getenv("TORWELL84_CONFIG"); d != "" {
+		return d
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(dir, "torwell84")
+}
+
+// Discover connects to the local backend. It prefers the API socket in the
+// config directory and otherwise uses addr (DefaultAddr when empty) with the
+// token from api.token.
+func Discover(addr string) (*Client, error) {
+	dir := ConfigDir()
+	if addr == "" {
+		sock := filepath.Join(dir, "api.sock")
+		if fi, err := os.Stat(sock); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			return NewUnix(sock), nil
+		}
+		addr = DefaultAddr
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "api.token"))
+	if err != nil {
+		return nil, fmt.Errorf("read api token: %w", err)
+	}
+	return New("http://"+addr, strings.TrimSpace(string(b))), nil
+}
+
+// do performs a request against path below /api/v1 and decodes a JSON
+// response into out when it is not nil.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	ctype := ""
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, ctype = bytes.NewReader(b), "application/json"
+	}
+	return c.send(ctx, method, path, body, ctype, out)
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body io.Reader, ctype string, out interface{}) error {
+	resp, err := c.request(ctx, method, path, body, ctype)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// open starts a GET whose body the caller reads and closes.
+func (c *Client) open(ctx context.Context, path string) (*http.Response, error) {
+	return c.request(ctx, http.MethodGet, path, nil, "")
+}
+
+// request sends a request and turns non-2xx responses into an *Error.
+func (c *Client) request(ctx context.Context, method, path string, body io.Reader, ctype string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+"/api/v1"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := &Error{Status: resp.StatusCode, RequestID: resp.Header.Get("X-Request-ID")}
+		var env struct {
+			Error struct{ Code, Message string }
+		}
+		if json.NewDecoder(resp.Body).Decode(&env) == nil {
+			e.Code, e.Message = env.Error.Code, env.Error.Message
+		}
+		return nil, e
+	}
+	return resp, nil
+}
+
+// Status returns the connection state, workers and settings.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var st Status
+	return &st, c.do(ctx, http.MethodGet, "/status", nil, &st)
+}
+
+// Connect starts a session.
+func (c *Client) Connect(ctx context.Context, req ConnectRequest) error {
+	return c.do(ctx, http.MethodPost, "/connect", req, nil)
+}
+
+// Disconnect ends the session.
+func (c *Client) Disconnect(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/disconnect", nil, nil)
+}
+
+// NewCircuit rotates to a fresh circuit.
+func (c *Client) NewCircuit(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/new-circuit", nil, nil)
+}
+
+// NewIdentity requests a new identity.
+func (c *Client) NewIdentity(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/new-identity", nil, nil)
+}
+
+// Workers lists the configured workers.
+func (c *Client) Workers(ctx context.Context) ([]Worker, error) {
+	var ws []Worker
+	return ws, c.do(ctx, http.MethodGet, "/workers", nil, &ws)
+}
+
+// AddWorker health checks and adds a worker.
+func (c *Client) AddWorker(ctx context.Context, req AddWorkerRequest) error {
+	return c.do(ctx, http.MethodPost, "/workers", req, nil)
+}
+
+// UpdateWorker changes group, priority or quota of a worker.
+func (c *Client) UpdateWorker(ctx context.Context, u WorkerUpdate) error {
+	return c.do(ctx, http.MethodPut, "/workers", u, nil)
+}
+
+// RemoveWorker removes a worker.
+func (c *Client) RemoveWorker(ctx context.Context, url string) error {
+	return c.do(ctx, http.MethodDelete, "/workers", struct{ URL string }{url}, nil)
+}
+
+// TestWorker health checks a worker without adding it.
+func (c *Client) TestWorker(ctx context.Context, req AddWorkerRequest) (*HealthInfo, error) {
+	var h HealthInfo
+	return &h, c.do(ctx, http.MethodPost, "/workers/test", req, &h)
+}
+
+// RepinWorker pins the key a worker currently presents.
+func (c *Client) RepinWorker(ctx context.Context, url string) error {
+	return c.do(ctx, http.MethodPost, "/workers/repin", struct{ URL string }{url}, nil)
+}
+
+// Config returns the current settings.
+func (c *Client) Config(ctx context.Context) (*Config, error) {
+	var cfg Config
+	return &cfg, c.do(ctx, http.MethodGet, "/config", nil, &cfg)
+}
+
+// SetConfig updates the settings.
+func (c *Client) SetConfig(ctx context.Context, cfg Config) error {
+	return c.do(ctx, http.MethodPost, "/config", cfg, nil)
+}
+
+// Logs returns a page of the in-memory log of kind "connection" or
+// "general". The query may filter by level, component, since, until and q,
+// and page with cursor, limit and order.
+func (c *Client) Logs(ctx context.Context, kind string, query url.Values) (*LogPage, error) {
+	path := "/logs/" + kind
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var p LogPage
+	return &p, c.do(ctx, http.MethodGet, path, nil, &p)
+}
+
+// TailLogs streams new records of a log to fn until ctx is done, fn
+// returns an error or the backend ends the stream. A non-empty cursor
+// replays the records after it first.
+func (c *Client) TailLogs(ctx context.Context, kind, cursor string, query url.Values, fn func(LogRecord) error) error {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	path := "/logs/" + kind + "/stream"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	resp, err := c.open(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		data, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var r LogRecord
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return sc.Err()
+}
+
+// ClearLogs empties a log in memory and, with disk set, its files.
+func (c *Client) ClearLogs(ctx context.Context, kind string, disk bool) error {
+	path := "/logs/" + kind
+	if disk {
+		path += "?disk=true"
+	}
+	return c.do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+// DiagnosticsBundle copies the redacted diagnostics zip to w.
+func (c *Client) DiagnosticsBundle(ctx context.Context, w io.Writer) error {
+	resp, err := c.open(ctx, "/diagnostics/bundle")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// LogFiles lists the current and rotated log files on disk.
+func (c *Client) LogFiles(ctx context.Context) ([]LogFile, error) {
+	var files []LogFile
+	return files, c.do(ctx, http.MethodGet, "/logs/files", nil, &files)
+}
+
+// LogStats reports the disk queues of the logs.
+func (c *Client) LogStats(ctx context.Context) (*LogStatsReport, error) {
+	var st LogStatsReport
+	return &st, c.do(ctx, http.MethodGet, "/logs/stats", nil, &st)
+}
+
+// Bandwidth returns the bandwidth statistics at resolution 1s, 1m or 1h;
+// empty means 1s.
+func (c *Client) Bandwidth(ctx context.Context, resolution string) (*BandwidthStats, error) {
+	path := "/stats/bandwidth"
+	if resolution != "" {
+		path += "?resolution=" + url.QueryEscape(resolution)
+	}
+	var st BandwidthStats
+	return &st, c.do(ctx, http.MethodGet, path, nil, &st)
+}
+
+// LogSinks lists the log sinks.
+func (c *Client) LogSinks(ctx context.Context) ([]SinkInfo, error) {
+	var sinks []SinkInfo
+	return sinks, c.do(ctx, http.MethodGet, "/logs/sinks", nil, &sinks)
+}
+
+// SinkRecords returns the records kept by the memory sink name.
+func (c *Client) SinkRecords(ctx context.Context, name string) ([]SinkRecord, error) {
+	var recs []SinkRecord
+	return recs, c.do(ctx, http.MethodGet, "/logs/sinks/"+url.PathEscape(name), nil, &recs)
+}
+
+// LogFile copies a log file to w, decompressing rotated .gz files.
+func (c *Client) LogFile(ctx context.Context, name string, w io.Writer) error {
+	resp, err := c.open(ctx, "/logs/files/"+url.PathEscape(name))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var r io.Reader = resp.Body
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// UploadTorrc sends a torrc for verification and storage.
+func (c *Client) UploadTorrc(ctx context.Context, name string, r io.Reader) error {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, r); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	return c.send(ctx, http.MethodPost, "/torrc", &buf, mw.FormDataContentType(), nil)
+}
@@ -0,0 +1,258 @@
+package client
+
+import "time"
+
+// Status mirrors GET /api/v1/status.
+type Status struct {
+	// State is one of disconnected, connecting, bootstrapping, connected,
+	// reconnecting, disconnecting and error.
+	State      string    `json:"state"`
+	Since      time.Time `json:"since"`
+	DurationMs int64     `json:"durationMs"`
+	LastError  string    `json:"lastError,omitempty"`
+	Progress   Progress  `json:"progress"`
+	Connected  bool      `json:"connected"`
+	Workers    []Worker  `json:"workers"`
+	Config     Config    `json:"config"`
+	Circuit    *Circuit  `json:"circuit,omitempty"`
+	Chain      Chain     `json:"chain"`
+}
+
+// Progress of the current connect attempt.
+type Progress struct {
+	Attempt int    `json:"attempt"`
+	Percent int    `json:"percent"`
+	Phase   string `json:"phase,omitempty"`
+	Summary string `json:"summary,omitempty"`
+}
+
+// Circuit is the circuit bound to the current session.
+type Circuit struct {
+	ID     int
+	Worker string `json:",omitempty"`
+}
+
+// Chain is the connection path shown by the UI. Unknown hops are nil.
+type Chain struct {
+	You    *ChainClient `json:"you"`
+	Entry  *Relay       `json:"entry"`
+	Middle *Relay       `json:"middle"`
+	Exit   *Relay       `json:"exit"`
+	Worker *ChainWorker `json:"worker"`
+}
+
+// ChainClient holds the user's addresses.
+type ChainClient struct {
+	LocalIP  string `json:"localIp,omitempty"`
+	PublicIP string `json:"publicIp,omitempty"`
+}
+
+// Relay is a tor relay on the circuit.
+type Relay struct {
+	Nickname    string `json:"nickname,omitempty"`
+	Fingerprint string `json:"fingerprint"`
+	Country     string `json:"country,omitempty"`
+	Address     string `json:"address,omitempty"`
+}
+
+// ChainWorker is the Worker at the end of the chain.
+type ChainWorker struct {
+	URL  string `json:"url"`
+	Colo string `json:"colo,omitempty"`
+}
+
+// Config holds the user adjustable settings.
+type Config struct {
+	OBFS4   bool `json:"obfs4"`
+	PreWarm bool `json:"prewarm"`
+	// LogPrivacy is off, standard or paranoid; empty keeps the current
+	// level on SetConfig.
+	LogPrivacy string `json:"logPrivacy,omitempty"`
+	// Logs limits the log files; nil keeps the current limits on
+	// SetConfig.
+	Logs *LogConfig `json:"logs,omitempty"`
+	// LogSinks replaces the sinks on SetConfig; nil keeps them.
+	LogSinks []SinkConfig `json:"logSinks,omitempty"`
+	// Tracing sets the span export; nil keeps it on SetConfig.
+	Tracing *TracingConfig `json:"tracing,omitempty"`
+}
+
+// TracingConfig sets the OTLP/HTTP collector receiving spans; an empty
+// Endpoint disables the export.
+type TracingConfig struct {
+	Endpoint string `json:"endpoint"`
+}
+
+// LogConfig sets the rotation and retention of the log files. Zero
+// limits are unlimited.
+type LogConfig struct {
+	MaxSizeMB     int  `json:"maxSizeMb"`
+	MaxFiles      int  `json:"maxFiles"`
+	MaxAgeDays    int  `json:"maxAgeDays"`
+	Compress      bool `json:"compress"`
+	RotateOnStart bool `json:"rotateOnStart"`
+}
+
+// Worker is a configured Cloudflare Worker as reported by the backend.
+type Worker struct {
+	URL        string
+	Active     bool
+	TLS        *TLSPolicy   `json:",omitempty"`
+	Error      string       `json:",omitempty"`
+	HealthPath string       `json:",omitempty"`
+	Expect     []string     `json:",omitempty"`
+	Health     *HealthInfo  `json:",omitempty"`
+	Group      string       `json:",omitempty"`
+	Priority   int          `json:",omitempty"`
+	Quota      int64        `json:",omitempty"`
+	SoftLimit  float64      `json:",omitempty"`
+	Usage      *WorkerUsage `json:",omitempty"`
+}
+
+// TLSPolicy describes how the backend secures a worker connection.
+type TLSPolicy struct {
+	MinVersion string   `json:",omitempty"`
+	Ciphers    string   `json:",omitempty"`
+	Pins       []string `json:",omitempty"`
+	CAFile     string   `json:",omitempty"`
+	NoTOFU     bool     `json:",omitempty"`
+}
+
+// HealthInfo is the healthz document of a worker.
+type HealthInfo struct {
+	Protocol int      `json:"protocol"`
+	Colo     string   `json:"colo,omitempty"`
+	Features []string `json:"features"`
+	Limits   struct {
+		MaxBodyBytes   int64 `json:"maxBodyBytes,omitempty"`
+		RequestsPerDay int64 `json:"requestsPerDay,omitempty"`
+		TimeoutMs      int64 `json:"timeoutMs,omitempty"`
+	} `json:"limits"`
+}
+
+// WorkerUsage counts the traffic of a worker on one UTC day.
+type WorkerUsage struct {
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// ConnectRequest selects countries and optionally limits the worker pool
+// to an explicit list or a group.
+type ConnectRequest struct {
+	Entry  string   `json:"entry,omitempty"`
+	Middle string   `json:"middle,omitempty"`
+	Exit   string   `json:"exit,omitempty"`
+	CFList []string `json:"cflist,omitempty"`
+	Group  string   `json:"group,omitempty"`
+}
+
+// AddWorkerRequest adds a worker.
+type AddWorkerRequest struct {
+	URL        string
+	TLS        *TLSPolicy `json:",omitempty"`
+	HealthPath string     `json:",omitempty"`
+	Expect     []string   `json:",omitempty"`
+	Group      string     `json:",omitempty"`
+	Priority   int        `json:",omitempty"`
+	Token      string     `json:",omitempty"`
+	Quota      int64      `json:",omitempty"`
+	SoftLimit  float64    `json:",omitempty"`
+}
+
+// WorkerUpdate changes a configured worker. Nil fields are left untouched.
+type WorkerUpdate struct {
+	URL       string
+	Group     *string  `json:",omitempty"`
+	Priority  *int     `json:",omitempty"`
+	Quota     *int64   `json:",omitempty"`
+	SoftLimit *float64 `json:",omitempty"`
+}
+
+// LogRecord is a structured log entry.
+type LogRecord struct {
+	Seq       uint64                 `json:"seq"`
+	Time      time.Time              `json:"time"`
+	Level     string                 `json:"level"`
+	Component string                 `json:"component"`
+	Message   string                 `json:"message"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// LogPage is a page of log records. Next is the cursor of the following
+// page, empty on the last one.
+type LogPage struct {
+	Records []LogRecord `json:"records"`
+	Next    string      `json:"next,omitempty"`
+}
+
+// SinkConfig configures a log sink of type file, stderr, syslog or
+// memory. Only the fields of its type apply.
+type SinkConfig struct {
+	Name     string   `json:"name,omitempty"`
+	Type     string   `json:"type"`
+	Level    string   `json:"level,omitempty"`
+	Logs     []string `json:"logs,omitempty"`
+	Dir      string   `json:"dir,omitempty"`
+	Network  string   `json:"network,omitempty"`
+	Address  string   `json:"address,omitempty"`
+	Facility string   `json:"facility,omitempty"`
+	Size     int      `json:"size,omitempty"`
+}
+
+// SinkInfo is a sink with the records written to it and its last error.
+type SinkInfo struct {
+	SinkConfig
+	Written uint64 `json:"written"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SinkRecord is a record kept by a memory sink.
+type SinkRecord struct {
+	Log string `json:"log"`
+	LogRecord
+}
+
+// LogStats reports the disk queue of a log. Dropped entries were not
+// written to disk but stay in memory.
+type LogStats struct {
+	Queued  int    `json:"queued"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// LogStatsReport holds the queues of both logs.
+type LogStatsReport struct {
+	Connection LogStats `json:"connection"`
+	General    LogStats `json:"general"`
+}
+
+// LogFile is a log file in the backend's logs directory.
+type LogFile struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// BandwidthSample is the average rate of one slot in bytes per second.
+type BandwidthSample struct {
+	Time    time.Time `json:"time"`
+	Read    uint64    `json:"read"`
+	Written uint64    `json:"written"`
+}
+
+// BandwidthSeries holds byte totals and the completed samples, oldest
+// first.
+type BandwidthSeries struct {
+	ReadBytes    uint64            `json:"readBytes"`
+	WrittenBytes uint64            `json:"writtenBytes"`
+	Samples      []BandwidthSample `json:"samples"`
+}
+
+// BandwidthStats is the traffic of tor, by tor circuit ID and of the
+// local proxy by Worker URL.
+type BandwidthStats struct {
+	Resolution string                     `json:"resolution"`
+	Tor        BandwidthSeries            `json:"tor"`
+	Circuits   map[string]BandwidthSeries `json:"circuits"`
+	Workers    map[string]BandwidthSeries `json:"workers"`
+}
@@ -0,0 +1,624 @@
+// Command torwell84ctl controls a running Torwell84 backend.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"torwell84/backend/client"
+)
+
+const usage = `usage: torwell84ctl [-json] [-addr host:port] [-token t] <command>
+
+commands:
+  status
+  connect [-entry CC] [-middle CC] [-exit CC] [-group name | -cflist url,...]
+  disconnect
+  new-circuit
+  new-identity
+  workers ls
+  workers add [-token t] [-group name] [-priority n] [-quota n] <url>
+  workers rm <url>
+  workers test <url>
+  config get
+  config set [obfs4=bool] [prewarm=bool] [logprivacy=off|standard|paranoid]
+             [logmaxsize=MB] [logmaxfiles=n] [logmaxage=days] [logcompress=bool] [logrotateonstart=bool]
+             [traceendpoint=url]
+  logs tail [-n lines] [-f] [-level l] [-component c,...] [-q text] [connection|general]
+  logs files
+  logs cat <file>
+  logs stats
+  logs sinks
+  logs sink <memory sink>
+  logs clear [-disk] [connection|general]
+  diagnostics [-o file.zip]
+  bandwidth [-resolution 1s|1m|1h]
+  torrc upload <file>
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// cli holds the global flags and the connected client.
+type cli struct {
+	c      *client.Client
+	json   bool
+	stdout io.Writer
+}
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("torwell84ctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	asJSON := fs.Bool("json", false, "print JSON")
+	addr := fs.String("addr", "", "backend address (default: api socket, then "+client.DefaultAddr+")")
+	token := fs.String("token", "", "api token (default: read from api.token)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	var c *client.Client
+	if *token != "" {
+		a := *addr
+		if a == "" {
+			a = client.DefaultAddr
+		}
+		c = client.New("http://"+a, *token)
+	} else {
+		var err error
+		if c, err = client.Discover(*addr); err != nil {
+			fmt.Fprintf(stderr, "torwell84ctl: %v\n", err)
+			return 1
+		}
+	}
+	app := &cli{c: c, json: *asJSON, stdout: stdout}
+	if err := app.dispatch(ctx, fs.Args()); err != nil {
+		var ue usageError
+		if errors.As(err, &ue) {
+			fmt.Fprintf(stderr, "torwell84ctl: %v\n\n%s", err, usage)
+			return 2
+		}
+		fmt.Fprintf(stderr, "torwell84ctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+func (a *cli) dispatch(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "status":
+		return a.status(ctx)
+	case "connect":
+		return a.connect(ctx, args[1:])
+	case "disconnect":
+		return a.done(a.c.Disconnect(ctx), "disconnected")
+	case "new-circuit":
+		return a.done(a.c.NewCircuit(ctx), "new circuit")
+	case "new-identity":
+		return a.done(a.c.NewIdentity(ctx), "new identity")
+	case "workers":
+		return a.workers(ctx, args[1:])
+	case "config":
+		return a.config(ctx, args[1:])
+	case "logs":
+		return a.logs(ctx, args[1:])
+	case "torrc":
+		return a.torrc(ctx, args[1:])
+	case "diagnostics":
+		return a.diagnostics(ctx, args[1:])
+	case "bandwidth":
+		return a.bandwidth(ctx, args[1:])
+	}
+	return usageError("unknown command " + args[0])
+}
+
+// done reports the outcome of a command without response data.
+func (a *cli) done(err error, msg string) error {
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.print(map[string]bool{"ok": true})
+	}
+	fmt.Fprintln(a.stdout, msg)
+	return nil
+}
+
+func (a *cli) print(v interface{}) error {
+	enc := json.NewEncoder(a.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (a *cli) status(ctx context.Context) error {
+	st, err := a.c.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.print(st)
+	}
+	held := time.Duration(st.DurationMs) * time.Millisecond
+	fmt.Fprintf(a.stdout, "state:   %s for %s\n", st.State, held.Round(time.Second))
+	if p := st.Progress; p.Phase != "" && p.Percent < 100 {
+		fmt.Fprintf(a.stdout, "phase:   %s %d%% %s\n", p.Phase, p.Percent, p.Summary)
+	}
+	if st.LastError != "" {
+		fmt.Fprintf(a.stdout, "error:   %s\n", st.LastError)
+	}
+	if st.Circuit != nil {
+		worker := st.Circuit.Worker
+		if worker == "" {
+			worker = "direct exit"
+		}
+		fmt.Fprintf(a.stdout, "circuit: %d via %s\n", st.Circuit.ID, worker)
+		fmt.Fprintf(a.stdout, "chain:   %s\n", chainString(st.Chain))
+	}
+	active := 0
+	for _, w := range st.Workers {
+		if w.Active {
+			active++
+		}
+	}
+	fmt.Fprintf(a.stdout, "workers: %d/%d active\n", active, len(st.Workers))
+	fmt.Fprintf(a.stdout, "obfs4:   %v\nprewarm: %v\n", st.Config.OBFS4, st.Config.PreWarm)
+	return nil
+}
+
+// chainString renders the chain as "you > entry > middle > exit > worker",
+// with "?" for unknown hops.
+func chainString(ch client.Chain) string {
+	hops := []string{"?", "?", "?", "?", "?"}
+	if ch.You != nil {
+		hops[0] = ch.You.LocalIP
+		if ch.You.PublicIP != "" {
+			hops[0] += " (" + ch.You.PublicIP + ")"
+		}
+	}
+	for i, r := range []*client.Relay{ch.Entry, ch.Middle, ch.Exit} {
+		if r != nil {
+			hops[i+1] = r.Nickname
+			if hops[i+1] == "" {
+				hops[i+1] = r.Fingerprint
+			}
+			if r.Country != "" {
+				hops[i+1] += " [" + r.Country + "]"
+			}
+		}
+	}
+	if ch.Worker != nil {
+		hops[4] = ch.Worker.URL
+		if ch.Worker.Colo != "" {
+			hops[4] += " [" + ch.Worker.Colo + "]"
+		}
+	}
+	return strings.Join(hops, " > ")
+}
+
+func (a *cli) connect(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("connect", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var req client.ConnectRequest
+	fs.StringVar(&req.Entry, "entry", "", "entry country")
+	fs.StringVar(&req.Middle, "middle", "", "middle country")
+	fs.StringVar(&req.Exit, "exit", "", "exit country")
+	fs.StringVar(&req.Group, "group", "", "worker group")
+	cflist := fs.String("cflist", "", "comma separated worker urls")
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	if *cflist != "" {
+		req.CFList = strings.Split(*cflist, ",")
+	}
+	return a.done(a.c.Connect(ctx, req), "connected")
+}
+
+func (a *cli) workers(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("workers needs a subcommand")
+	}
+	switch args[0] {
+	case "ls":
+		ws, err := a.c.Workers(ctx)
+		if err != nil {
+			return err
+		}
+		if a.json {
+			return a.print(ws)
+		}
+		tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "URL\tACTIVE\tGROUP\tCOLO\tREQUESTS\tERROR")
+		for _, w := range ws {
+			colo, reqs := "", int64(0)
+			if w.Health != nil {
+				colo = w.Health.Colo
+			}
+			if w.Usage != nil {
+				reqs = w.Usage.Requests
+			}
+			fmt.Fprintf(tw, "%s\t%v\t%s\t%s\t%d\t%s\n", w.URL, w.Active, w.Group, colo, reqs, w.Error)
+		}
+		return tw.Flush()
+	case "add":
+		fs := flag.NewFlagSet("workers add", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		var req client.AddWorkerRequest
+		fs.StringVar(&req.Token, "token", "", "worker token")
+		fs.StringVar(&req.Group, "group", "", "worker group")
+		fs.IntVar(&req.Priority, "priority", 0, "priority within the group")
+		fs.Int64Var(&req.Quota, "quota", 0, "daily request quota")
+		if err := fs.Parse(args[1:]); err != nil {
+			return usageError(err.Error())
+		}
+		if fs.NArg() != 1 {
+			return usageError("workers add needs a url")
+		}
+		req.URL = fs.Arg(0)
+		return a.done(a.c.AddWorker(ctx, req), "added "+req.URL)
+	case "rm":
+		if len(args) != 2 {
+			return usageError("workers rm needs a url")
+		}
+		return a.done(a.c.RemoveWorker(ctx, args[1]), "removed "+args[1])
+	case "test":
+		if len(args) != 2 {
+			return usageError("workers test needs a url")
+		}
+		h, err := a.c.TestWorker(ctx, client.AddWorkerRequest{URL: args[1]})
+		if err != nil {
+			return err
+		}
+		if a.json {
+			return a.print(h)
+		}
+		fmt.Fprintf(a.stdout, "healthy: protocol v%d colo %q features %s\n", h.Protocol, h.Colo, strings.Join(h.Features, ","))
+		return nil
+	}
+	return usageError("unknown workers command " + args[0])
+}
+
+func (a *cli) config(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("config needs get or set")
+	}
+	cfg, err := a.c.Config(ctx)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "get":
+		if a.json {
+			return a.print(cfg)
+		}
+		fmt.Fprintf(a.stdout, "obfs4=%v\nprewarm=%v\nlogprivacy=%s\n", cfg.OBFS4, cfg.PreWarm, cfg.LogPrivacy)
+		if l := cfg.Logs; l != nil {
+			fmt.Fprintf(a.stdout, "logmaxsize=%d\nlogmaxfiles=%d\nlogmaxage=%d\nlogcompress=%v\nlogrotateonstart=%v\n",
+				l.MaxSizeMB, l.MaxFiles, l.MaxAgeDays, l.Compress, l.RotateOnStart)
+		}
+		if t := cfg.Tracing; t != nil {
+			fmt.Fprintf(a.stdout, "traceendpoint=%s\n", t.Endpoint)
+		}
+		return nil
+	case "set":
+		if len(args) < 2 {
+			return usageError("config set needs key=value")
+		}
+		for _, kv := range args[1:] {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return usageError("expected key=value, got " + kv)
+			}
+			if cfg.Logs == nil {
+				cfg.Logs = &client.LogConfig{}
+			}
+			switch k {
+			case "logprivacy":
+				cfg.LogPrivacy = v
+				continue
+			case "traceendpoint":
+				cfg.Tracing = &client.TracingConfig{Endpoint: v}
+				continue
+			case "logmaxsize", "logmaxfiles", "logmaxage":
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return usageError(k + " expects a number")
+				}
+				switch k {
+				case "logmaxsize":
+					cfg.Logs.MaxSizeMB = n
+				case "logmaxfiles":
+					cfg.Logs.MaxFiles = n
+				default:
+					cfg.Logs.MaxAgeDays = n
+				}
+				continue
+			}
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return usageError(k + " expects true or false")
+			}
+			switch k {
+			case "obfs4":
+				cfg.OBFS4 = b
+			case "prewarm":
+				cfg.PreWarm = b
+			case "logcompress":
+				cfg.Logs.Compress = b
+			case "logrotateonstart":
+				cfg.Logs.RotateOnStart = b
+			default:
+				return usageError("unknown setting " + k)
+			}
+		}
+		return a.done(a.c.SetConfig(ctx, *cfg), "saved")
+	}
+	return usageError("unknown config command " + args[0])
+}
+
+func (a *cli) logs(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("logs needs tail, files, cat, stats, sinks, sink or clear")
+	}
+	switch args[0] {
+	case "tail":
+		return a.logsTail(ctx, args[1:])
+	case "files":
+		files, err := a.c.LogFiles(ctx)
+		if err != nil {
+			return err
+		}
+		if a.json {
+			return a.print(files)
+		}
+		tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSIZE\tMODIFIED")
+		for _, f := range files {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", f.Name, f.Size, f.ModTime.Local().Format(time.RFC3339))
+		}
+		return tw.Flush()
+	case "stats":
+		st, err := a.c.LogStats(ctx)
+		if err != nil {
+			return err
+		}
+		if a.json {
+			return a.print(st)
+		}
+		fmt.Fprintf(a.stdout, "connection: %d queued, %d dropped\ngeneral:    %d queued, %d dropped\n",
+			st.Connection.Queued, st.Connection.Dropped, st.General.Queued, st.General.Dropped)
+		return nil
+	case "sinks":
+		sinks, err := a.c.LogSinks(ctx)
+		if err != nil {
+			return err
+		}
+		if a.json {
+			return a.print(sinks)
+		}
+		tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tTYPE\tLEVEL\tLOGS\tWRITTEN\tERROR")
+		for _, s := range sinks {
+			name, logs := s.Name, strings.Join(s.Logs, ",")
+			if name == "" {
+				name = s.Type
+			}
+			if logs == "" {
+				logs = "all"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", name, s.Type, s.Level, logs, s.Written, s.Error)
+		}
+		return tw.Flush()
+	case "sink":
+		if len(args) != 2 {
+			return usageError("logs sink needs a memory sink name")
+		}
+		recs, err := a.c.SinkRecords(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		if a.json {
+			return a.print(recs)
+		}
+		for _, r := range recs {
+			fmt.Fprintf(a.stdout, "%-10s %s\n", r.Log, formatRecord(r.LogRecord))
+		}
+		return nil
+	case "cat":
+		if len(args) != 2 {
+			return usageError("logs cat needs a file name")
+		}
+		return a.c.LogFile(ctx, args[1], a.stdout)
+	case "clear":
+		fs := flag.NewFlagSet("logs clear", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		disk := fs.Bool("disk", false, "also remove the log files")
+		if err := fs.Parse(args[1:]); err != nil {
+			return usageError(err.Error())
+		}
+		kinds := fs.Args()
+		if len(kinds) == 0 {
+			kinds = []string{"connection", "general"}
+		}
+		for _, k := range kinds {
+			if err := a.c.ClearLogs(ctx, k, *disk); err != nil {
+				return err
+			}
+		}
+		return a.done(nil, "cleared "+strings.Join(kinds, " and ")+" logs")
+	}
+	return usageError("unknown logs command " + args[0])
+}
+
+func (a *cli) logsTail(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("logs tail", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	n := fs.Int("n", 20, "number of lines")
+	follow := fs.Bool("f", false, "follow new entries")
+	level := fs.String("level", "", "minimum level: debug, info, warn or error")
+	component := fs.String("component", "", "comma separated components")
+	search := fs.String("q", "", "only records containing this text")
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	if *n < 1 || *n > 1000 {
+		return usageError("-n must be between 1 and 1000")
+	}
+	kind := "general"
+	if fs.NArg() > 0 {
+		kind = fs.Arg(0)
+	}
+	query := url.Values{}
+	if *level != "" {
+		query.Set("level", *level)
+	}
+	if *component != "" {
+		query.Set("component", *component)
+	}
+	if *search != "" {
+		query.Set("q", *search)
+	}
+	page := url.Values{"order": {"desc"}, "limit": {strconv.Itoa(*n)}}
+	for k, v := range query {
+		page[k] = v
+	}
+	p, err := a.c.Logs(ctx, kind, page)
+	if err != nil {
+		return err
+	}
+	// the newest page comes newest first
+	for i := len(p.Records) - 1; i >= 0; i-- {
+		a.printRecord(p.Records[i])
+	}
+	if !*follow {
+		return nil
+	}
+	cursor := ""
+	if len(p.Records) > 0 {
+		cursor = strconv.FormatUint(p.Records[0].Seq, 10)
+	}
+	return a.c.TailLogs(ctx, kind, cursor, query, func(r client.LogRecord) error {
+		a.printRecord(r)
+		return nil
+	})
+}
+
+func (a *cli) printRecord(r client.LogRecord) {
+	if a.json {
+		a.print(r)
+		return
+	}
+	fmt.Fprintln(a.stdout, formatRecord(r))
+}
+
+// formatRecord renders a log record as a text line with sorted fields.
+func formatRecord(r client.LogRecord) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %-8s %s", r.Time.Local().Format(time.RFC3339), strings.ToUpper(r.Level), r.Component, r.Message)
+	keys := make([]string, 0, len(r.Fields))
+	for k := range r.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, r.Fields[k])
+	}
+	return b.String()
+}
+
+func (a *cli) diagnostics(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("diagnostics", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	out := fs.String("o", "torwell84-diagnostics.zip", "output file")
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	f, err := os.OpenFile(*out, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := a.c.DiagnosticsBundle(ctx, f); err != nil {
+		f.Close()
+		os.Remove(*out)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return a.done(nil, "wrote "+*out)
+}
+
+// bandwidth prints the byte totals and the last rate of tor, its circuits
+// and the Workers.
+func (a *cli) bandwidth(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("bandwidth", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	res := fs.String("resolution", "1s", "sample resolution: 1s, 1m or 1h")
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	st, err := a.c.Bandwidth(ctx, *res)
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.print(st)
+	}
+	tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "SOURCE\tREAD\tWRITTEN\tREAD/S\tWRITTEN/S\n")
+	row := func(name string, s client.BandwidthSeries) {
+		var last client.BandwidthSample
+		if n := len(s.Samples); n > 0 {
+			last = s.Samples[n-1]
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", name, s.ReadBytes, s.WrittenBytes, last.Read, last.Written)
+	}
+	row("tor", st.Tor)
+	for _, group := range []struct {
+		prefix string
+		series map[string]client.BandwidthSeries
+	}{{"circuit ", st.Circuits}, {"", st.Workers}} {
+		keys := make([]string, 0, len(group.series))
+		for k := range group.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			row(group.prefix+k, group.series[k])
+		}
+	}
+	return tw.Flush()
+}
+
+func (a *cli) torrc(ctx context.Context, args []string) error {
+	if len(args) != 2 || args[0] != "upload" {
+		return usageError("torrc upload needs a file")
+	}
+	f, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return a.done(a.c.UploadTorrc(ctx, args[1], f), "torrc verified and saved")
+}
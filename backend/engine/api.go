@@ -0,0 +1,670 @@
+package engine
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiPrefix is the base path of the versioned API.
+const apiPrefix = "/api/v1"
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// route is a single endpoint of the versioned API. Path is relative to
+// apiPrefix; the same path without the prefix is kept as a deprecated alias.
+type route struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+}
+
+// stablePaths are unversioned paths kept without deprecation, such as the
+// conventional Prometheus scrape path.
+var stablePaths = map[string]bool{"/metrics": true}
+
+// apiRoutes lists every endpoint. The OpenAPI document is checked against
+// this table in tests.
+func (e *Engine) apiRoutes() []route {
+	return []route{
+		{http.MethodGet, "/status", e.handleStatus},
+		{http.MethodPost, "/connect", e.handleConnect},
+		{http.MethodPost, "/disconnect", e.handleDisconnect},
+		{http.MethodPost, "/new-circuit", e.handleNewCircuit},
+		{http.MethodPost, "/new-identity", e.handleNewIdentity},
+		{http.MethodGet, "/workers", e.handleListWorkers},
+		{http.MethodPost, "/workers", e.handleAddWorker},
+		{http.MethodPut, "/workers", e.handleUpdateWorker},
+		{http.MethodDelete, "/workers", e.handleRemoveWorker},
+		{http.MethodPost, "/workers/repin", e.handleRepinWorker},
+		{http.MethodPost, "/workers/test", e.handleTestWorker},
+		{http.MethodGet, "/config", e.handleGetConfig},
+		{http.MethodPost, "/config", e.handleSetConfig},
+		{http.MethodGet, "/logs/connection", e.handleConnectionLogs},
+		{http.MethodDelete, "/logs/connection", e.handleClearConnectionLogs},
+		{http.MethodGet, "/logs/general", e.handleGeneralLogs},
+		{http.MethodDelete, "/logs/general", e.handleClearGeneralLogs},
+		{http.MethodGet, "/logs/connection/stream", e.handleConnectionLogStream},
+		{http.MethodGet, "/logs/general/stream", e.handleGeneralLogStream},
+		{http.MethodGet, "/logs/stats", e.handleLogStats},
+		{http.MethodGet, "/logs/sinks", e.handleLogSinks},
+		{http.MethodGet, "/logs/sinks/{name}", e.handleLogSink},
+		{http.MethodGet, "/logs/files", e.handleLogFiles},
+		{http.MethodGet, "/logs/files/{name}", e.handleLogFile},
+		{http.MethodPost, "/torrc", e.handleTorrc},
+		{http.MethodGet, "/diagnostics/bundle", e.handleDiagnosticsBundle},
+		{http.MethodGet, "/metrics", e.handleMetrics},
+		{http.MethodGet, "/stats/bandwidth", e.handleBandwidth},
+		{http.MethodGet, "/stats/bandwidth/stream", e.handleBandwidthStream},
+		{http.MethodGet, "/openapi.json", e.handleOpenAPI},
+	}
+}
+
+// Error codes returned in the error envelope.
+const (
+	codeBadRequest       = "bad_request"
+	codeInvalidJSON      = "invalid_json"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeUnknownWorker    = "unknown_worker"
+	codeUnknownGroup     = "unknown_group"
+	codeWorkerRejected   = "worker_rejected"
+	codeInvalidTorrc     = "invalid_torrc"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeInternal         = "internal"
+	codeTorUnavailable   = "tor_unavailable"
+	codeInvalidState     = "invalid_state"
+)
+
+// apiError is the body of every error response:
+// {"error":{"code":"...","message":"..."}}.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error apiError `json:"error"`
+	}{apiError{Code: code, Message: msg}})
+}
+
+// writeRequestError writes err in the error envelope. Errors other than
+// RequestError are internal.
+func writeRequestError(w http.ResponseWriter, err error) {
+	var re *RequestError
+	if errors.As(err, &re) {
+		writeError(w, re.Status, re.Code, re.Message)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// decodeJSON decodes the request body into v. An empty body is accepted
+// when optional is set.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}, optional bool) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil || (optional && errors.Is(err, io.EOF)) {
+		return true
+	}
+	writeError(w, http.StatusBadRequest, codeInvalidJSON, "invalid json body: "+err.Error())
+	return false
+}
+
+func (e *Engine) newServer() http.Handler {
+	mux := http.NewServeMux()
+	allowed := map[string][]string{}
+	for _, rt := range e.apiRoutes() {
+		mux.HandleFunc(rt.method+" "+apiPrefix+rt.path, rt.handler)
+		if stablePaths[rt.path] {
+			mux.HandleFunc(rt.method+" "+rt.path, rt.handler)
+		} else {
+			mux.HandleFunc(rt.method+" "+rt.path, deprecated(rt.handler, apiPrefix+rt.path))
+		}
+		allowed[rt.path] = append(allowed[rt.path], rt.method)
+	}
+	for path, methods := range allowed {
+		sort.Strings(methods)
+		notAllowed := methodNotAllowed(strings.Join(methods, ", "))
+		mux.HandleFunc(apiPrefix+path, notAllowed)
+		mux.HandleFunc(path, notAllowed)
+	}
+	mux.HandleFunc(apiPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, codeNotFound, "no such endpoint")
+	})
+	return withRequestID(mux)
+}
+
+// deprecated serves a legacy unversioned path and points to its successor.
+func deprecated(h http.HandlerFunc, successor string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		h(w, r)
+	}
+}
+
+func methodNotAllowed(allow string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, r.Method+" not allowed; use "+allow)
+	}
+}
+
+func (e *Engine) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, e.Status())
+}
+
+func (e *Engine) handleConnect(w http.ResponseWriter, r *http.Request) {
+	var req ConnectRequest
+	if !decodeJSON(w, r, &req, true) {
+		return
+	}
+	if err := e.Connect(r.Context(), req); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *Engine) handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	// a tor that failed to exit cleanly is logged, the session is over
+	var re *RequestError
+	if err := e.Disconnect(r.Context()); errors.As(err, &re) {
+		writeRequestError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *Engine) handleNewCircuit(w http.ResponseWriter, r *http.Request) {
+	e.NewCircuit()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *Engine) handleNewIdentity(w http.ResponseWriter, r *http.Request) {
+	e.genLog.info(compAPI, "new identity requested")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *Engine) handleListWorkers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, e.workers.List())
+}
+
+func (e *Engine) handleAddWorker(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL        string
+		TLS        *TLSPolicy
+		HealthPath string
+		Expect     []string
+		Group      string
+		Priority   int
+		Token      string
+		Quota      int64
+		SoftLimit  float64
+	}
+	if !decodeJSON(w, r, &req, false) {
+		return
+	}
+	nw := Worker{URL: req.URL, TLS: req.TLS, HealthPath: req.HealthPath, Expect: req.Expect, Group: req.Group, Priority: req.Priority, Token: req.Token}
+	nw.Quota, nw.SoftLimit = req.Quota, req.SoftLimit
+	if err := e.workers.AddWorker(nw); err != nil {
+		writeError(w, http.StatusBadRequest, codeWorkerRejected, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (e *Engine) handleUpdateWorker(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL string
+		WorkerUpdate
+	}
+	if !decodeJSON(w, r, &req, false) {
+		return
+	}
+	if err := e.workers.Update(req.URL, req.WorkerUpdate); err != nil {
+		writeError(w, http.StatusNotFound, codeUnknownWorker, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *Engine) handleRemoveWorker(w http.ResponseWriter, r *http.Request) {
+	var req struct{ URL string }
+	if !decodeJSON(w, r, &req, false) {
+		return
+	}
+	e.workers.Remove(req.URL)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *Engine) handleRepinWorker(w http.ResponseWriter, r *http.Request) {
+	var req struct{ URL string }
+	if !decodeJSON(w, r, &req, false) {
+		return
+	}
+	if err := e.workers.Repin(req.URL); err != nil {
+		writeError(w, http.StatusBadRequest, codeWorkerRejected, err.Error())
+		return
+	}
+	e.genLog.info(compWorker, "re-pinned worker", "worker", req.URL)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *Engine) handleTestWorker(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL        string
+		TLS        *TLSPolicy
+		HealthPath string
+		Expect     []string
+		Token      string
+	}
+	if !decodeJSON(w, r, &req, false) {
+		return
+	}
+	h, err := e.workers.Test(Worker{URL: req.URL, TLS: req.TLS, HealthPath: req.HealthPath, Expect: req.Expect, Token: req.Token})
+	if err != nil {
+		writeError(w, http.StatusBadGateway, codeWorkerRejected, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, h)
+}
+
+func (e *Engine) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, e.getConfig())
+}
+
+func (e *Engine) handleSetConfig(w http.ResponseWriter, r *http.Request) {
+	// settings missing from the body keep their current values; the sinks
+	// are replaced as a whole
+	c := e.getConfig()
+	c.LogSinks = nil
+	if !decodeJSON(w, r, &c, false) {
+		return
+	}
+	if c.LogPrivacy != "" && !c.LogPrivacy.Valid() {
+		writeRequestError(w, errInvalidPrivacy(c.LogPrivacy))
+		return
+	}
+	if err := c.Logs.validate(); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if err := validateSinks(c.LogSinks); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if err := c.Tracing.validate(); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	e.updateConfig(c)
+	if err := e.saveConfig(); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "save error")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *Engine) handleConnectionLogs(w http.ResponseWriter, r *http.Request) {
+	serveLogs(w, r, &e.connLog)
+}
+
+func (e *Engine) handleGeneralLogs(w http.ResponseWriter, r *http.Request) {
+	serveLogs(w, r, &e.genLog)
+}
+
+func (e *Engine) handleClearConnectionLogs(w http.ResponseWriter, r *http.Request) {
+	clearLogs(w, r, &e.connLog)
+}
+
+func (e *Engine) handleClearGeneralLogs(w http.ResponseWriter, r *http.Request) {
+	clearLogs(w, r, &e.genLog)
+}
+
+// clearLogs empties b, and its files on disk when disk=true.
+func clearLogs(w http.ResponseWriter, r *http.Request, b *logBuffer) {
+	disk, err := parseBool(r.URL.Query().Get("disk"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "disk must be true or false")
+		return
+	}
+	if err := b.clear(disk); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseBool parses an optional boolean query parameter.
+func parseBool(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+func (e *Engine) handleConnectionLogStream(w http.ResponseWriter, r *http.Request) {
+	e.streamLogs(w, r, &e.connLog)
+}
+
+func (e *Engine) handleGeneralLogStream(w http.ResponseWriter, r *http.Request) {
+	e.streamLogs(w, r, &e.genLog)
+}
+
+// Page sizes of /logs.
+const (
+	defaultLogLimit = 100
+	maxLogLimit     = 1000
+)
+
+// serveLogs returns a page of the records of b matching the query.
+func serveLogs(w http.ResponseWriter, r *http.Request, b *logBuffer) {
+	q := r.URL.Query()
+	f, err := parseLogFilter(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	cursor, err := parseCursor(q.Get("cursor"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	limit := defaultLogLimit
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxLogLimit {
+			writeError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxLogLimit))
+			return
+		}
+	}
+	var desc bool
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		writeError(w, http.StatusBadRequest, codeBadRequest, "order must be asc or desc")
+		return
+	}
+	writeJSON(w, http.StatusOK, b.page(f, cursor, desc, limit))
+}
+
+// streamLogs sends the records of b matching the query as server-sent
+// events until the client goes away or the engine shuts down. It starts
+// after the cursor or Last-Event-ID, or with the next record.
+func (e *Engine) streamLogs(w http.ResponseWriter, r *http.Request, b *logBuffer) {
+	q := r.URL.Query()
+	f, err := parseLogFilter(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	start := q.Get("cursor")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		start = id
+	}
+	cursor, err := parseCursor(start)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, codeInternal, "streaming unsupported")
+		return
+	}
+	changed := b.wait()
+	if start == "" {
+		b.mu.Lock()
+		cursor = b.seq
+		b.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+	for {
+		all := b.page(logFilter{}, cursor, false, 0).Records
+		for _, rec := range all {
+			cursor = rec.Seq
+			if !f.match(rec) {
+				continue
+			}
+			data, _ := json.Marshal(rec)
+			fmt.Fprintf(w, "id: %d\nevent: log\ndata: %s\n\n", rec.Seq, data)
+		}
+		flusher.Flush()
+		select {
+		case <-changed:
+			changed = b.wait()
+		case <-ping.C:
+			io.WriteString(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		case <-e.streams.Done():
+			return
+		}
+	}
+}
+
+func parseCursor(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	c, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+// parseLogFilter reads a minimum level, comma separated components, a time
+// range and a search text. since and until are RFC 3339 times or durations
+// before now, such as 15m.
+func parseLogFilter(q url.Values) (logFilter, error) {
+	var f logFilter
+	if v := q.Get("level"); v != "" {
+		lv, err := ParseLevel(v)
+		if err != nil {
+			return f, err
+		}
+		f.level = lv
+	}
+	for _, v := range q["component"] {
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				f.components = append(f.components, c)
+			}
+		}
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &f.since}, {"until", &f.until}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			*p.t = time.Now().Add(-d)
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("%s: expected an RFC 3339 time or a duration", p.name)
+		}
+		*p.t = t
+	}
+	f.text = strings.ToLower(q.Get("q"))
+	return f, nil
+}
+
+// LogFile is a log file on disk, current or rotated.
+type LogFile struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// LogStatsReport is the body of GET /logs/stats.
+type LogStatsReport struct {
+	Connection LogStats `json:"connection"`
+	General    LogStats `json:"general"`
+}
+
+func (e *Engine) handleLogStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, LogStatsReport{Connection: e.connLog.stats(), General: e.genLog.stats()})
+}
+
+func (e *Engine) handleLogSinks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, e.sinks.list())
+}
+
+// handleLogSink returns the records kept by a memory sink.
+func (e *Engine) handleLogSink(w http.ResponseWriter, r *http.Request) {
+	rs, ok := e.sinks.find(r.PathValue("name")).(interface{ Records() []SinkRecord })
+	if !ok {
+		writeError(w, http.StatusNotFound, codeNotFound, "no such memory sink")
+		return
+	}
+	writeJSON(w, http.StatusOK, rs.Records())
+}
+
+// handleLogFiles lists the files in the logs directory, newest first.
+func (e *Engine) handleLogFiles(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(e.logDir())
+	if err != nil && !os.IsNotExist(err) {
+		writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	files := []LogFile{}
+	for _, de := range entries {
+		info, err := de.Info()
+		if err != nil || !info.Mode().IsRegular() || !isLogFile(de.Name()) {
+			continue
+		}
+		files = append(files, LogFile{Name: de.Name(), Size: info.Size(), ModTime: info.ModTime().UTC()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime.After(files[j].ModTime) })
+	writeJSON(w, http.StatusOK, files)
+}
+
+// handleLogFile serves one log file as JSON lines, or gzipped JSON lines
+// for compressed rotated files.
+func (e *Engine) handleLogFile(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !isLogFile(name) {
+		writeError(w, http.StatusNotFound, codeNotFound, "no such log file")
+		return
+	}
+	f, err := os.Open(filepath.Join(e.logDir(), name))
+	if err != nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "no such log file")
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	if strings.HasSuffix(name, ".gz") {
+		w.Header().Set("Content-Type", "application/gzip")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// isLogFile reports whether name is a plain file name written by a log
+// writer.
+func isLogFile(name string) bool {
+	return name == filepath.Base(name) && (strings.HasSuffix(name, ".log") || strings.HasSuffix(name, ".log.gz")) &&
+		(strings.HasPrefix(name, "connection") || strings.HasPrefix(name, "general"))
+}
+
+// handleDiagnosticsBundle sends a zip of redacted logs, config and worker
+// health with tor and system summaries.
+func (e *Engine) handleDiagnosticsBundle(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := e.writeBundle(r.Context(), &buf); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	name := "torwell84-diagnostics-" + time.Now().UTC().Format("20060102-150405") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Write(buf.Bytes())
+}
+
+// handleTorrc verifies and stores an uploaded torrc file.
+func (e *Engine) handleTorrc(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "expected multipart form")
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "missing file")
+		return
+	}
+	defer file.Close()
+
+	tmp, err := os.CreateTemp("", "torrc")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "server error")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, file); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "server error")
+		return
+	}
+	tmp.Close()
+
+	cmd := exec.Command(torBinary(), "-f", tmp.Name(), "--verify-config")
+	if err := cmd.Run(); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidTorrc, "invalid torrc")
+		return
+	}
+
+	dst := filepath.Join(e.dir, "torrc")
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "save error")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (e *Engine) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// apiTokenFile holds the API token inside the config directory. The Tauri shell
+// reads it to authenticate against the backend, and proxy clients use it as
+// the worker proxy credential.
+const apiTokenFile = "api.token"
+
+// trustedOrigins may call the API from a browser context.
+var trustedOrigins = []string{
+	"tauri://localhost",
+	"http://tauri.localhost",
+	"https://tauri.localhost",
+}
+
+// writeAPIToken generates a fresh API token and stores it with 0600
+// permissions in dir.
+func writeAPIToken(dir string) (string, error) {
+	token, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, apiTokenFile)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	// WriteFile keeps the mode of an existing file.
+	if err := os.Chmod(path, 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// apiGuard authenticates API requests and rejects requests a web page could
+// forge: unknown Host headers (DNS rebinding), foreign origins and simple
+// cross-origin requests to state-changing endpoints.
+type apiGuard struct {
+	next    http.Handler
+	token   string
+	hosts   map[string]bool
+	origins map[string]bool
+}
+
+// newAPIGuard protects next, which is served on addr, with token.
+func newAPIGuard(next http.Handler, token, addr string) *apiGuard {
+	g := &apiGuard{next: next, token: token, hosts: map[string]bool{}, origins: map[string]bool{}}
+	_, port, _ := net.SplitHostPort(addr)
+	for _, h := range []string{"127.0.0.1", "localhost", "[::1]"} {
+		g.hosts[h+":"+port] = true
+		g.origins["http://"+h+":"+port] = true
+	}
+	for _, o := range trustedOrigins {
+		g.origins[o] = true
+	}
+	return g
+}
+
+func (g *apiGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !g.hosts[strings.ToLower(r.Host)] {
+		writeError(w, http.StatusForbidden, codeForbidden, "invalid host")
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if !g.origins[origin] {
+			writeError(w, http.StatusForbidden, codeForbidden, "invalid origin")
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		// the UI names the diagnostics bundle after its disposition
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Torwell-Token")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	// Checked before the token: a token header already makes the request
+	// non-simple, so afterwards this could never match.
+	if changesState(r.Method) && isSimpleRequest(r) {
+		writeError(w, http.StatusForbidden, codeForbidden, "simple cross-origin requests are not accepted")
+		return
+	}
+	if !g.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="torwell84"`)
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "missing or invalid api token")
+		return
+	}
+	g.next.ServeHTTP(w, r)
+}
+
+// authorized checks the bearer token or the X-Torwell-Token header.
+func (g *apiGuard) authorized(r *http.Request) bool {
+	got := r.Header.Get("X-Torwell-Token")
+	if got == "" {
+		got = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return g.token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(g.token)) == 1
+}
+
+// proxyAuthorized checks the Proxy-Authorization header of a worker proxy
+// request. Proxy clients send the token as the password of Basic
+// credentials, as in http://torwell:<token>@127.0.0.1:9473; the user name
+// is ignored. Bearer credentials are accepted as well.
+func proxyAuthorized(r *http.Request, token string) bool {
+	var got string
+	auth := r.Header.Get("Proxy-Authorization")
+	switch {
+	case strings.HasPrefix(auth, "Basic "):
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+		if err != nil {
+			return false
+		}
+		_, got, _ = strings.Cut(string(b), ":")
+	case strings.HasPrefix(auth, "Bearer "):
+		got = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func changesState(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// browserHeaders are set by browsers themselves and never make a request
+// non-simple in the CORS sense.
+var browserHeaders = map[string]bool{
+	"Accept-Encoding": true, "Connection": true, "Content-Length": true,
+	"Cookie": true, "Dnt": true, "Host": true, "Origin": true,
+	"Referer": true, "User-Agent": true, "Priority": true,
+	"Upgrade-Insecure-Requests": true,
+}
+
+// isSimpleRequest reports whether a browser would send r cross-origin
+// without a CORS preflight.
+func isSimpleRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost:
+	default:
+		return false
+	}
+	for k := range r.Header {
+		switch {
+		case browserHeaders[k], strings.HasPrefix(k, "Sec-"):
+		case k == "Accept", k == "Accept-Language", k == "Content-Language":
+		case k == "Content-Type":
+			mt, _, _ := mime.ParseMediaType(r.Header.Get(k))
+			switch mt {
+			case "application/x-www-form-urlencoded", "multipart/form-data", "text/plain":
+			default:
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,392 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventBandwidth carries a BandwidthUpdate every second with traffic.
+const EventBandwidth = "bandwidth"
+
+// bwResolutions are the ring buffers kept per series: two minutes by the
+// second, two hours by the minute and two days by the hour.
+var bwResolutions = []struct {
+	name string
+	res  time.Duration
+	n    int
+}{
+	{"1s", time.Second, 120},
+	{"1m", time.Minute, 120},
+	{"1h", time.Hour, 48},
+}
+
+const (
+	// bwMaxSeries bounds the circuit and the Worker series; the longest
+	// idle goes first.
+	bwMaxSeries = 64
+	// bwCircuitIdle is how long an idle circuit keeps its series.
+	bwCircuitIdle = 10 * time.Minute
+)
+
+// BandwidthSample is the average rate of one slot in bytes per second.
+// Read is traffic towards the user, Written traffic away from them.
+type BandwidthSample struct {
+	Time    time.Time `json:"time"`
+	Read    uint64    `json:"read"`
+	Written uint64    `json:"written"`
+}
+
+// BandwidthSeries is the traffic of tor, a circuit or a Worker: byte
+// totals and the samples of the completed slots, oldest first.
+type BandwidthSeries struct {
+	ReadBytes    uint64            `json:"readBytes"`
+	WrittenBytes uint64            `json:"writtenBytes"`
+	Samples      []BandwidthSample `json:"samples"`
+}
+
+// BandwidthStats is the body of GET /stats/bandwidth. Tor is the traffic
+// of the tor client, Circuits its streams by tor circuit ID and Workers
+// the traffic of the local proxy by Worker URL.
+type BandwidthStats struct {
+	Resolution string                     `json:"resolution"`
+	Tor        BandwidthSeries            `json:"tor"`
+	Circuits   map[string]BandwidthSeries `json:"circuits"`
+	Workers    map[string]BandwidthSeries `json:"workers"`
+}
+
+// BandwidthUpdate holds the rates of the last completed second; series
+// without traffic in that second are left out.
+type BandwidthUpdate struct {
+	Time     time.Time                  `json:"time"`
+	Tor      BandwidthSample            `json:"tor"`
+	Circuits map[string]BandwidthSample `json:"circuits,omitempty"`
+	Workers  map[string]BandwidthSample `json:"workers,omitempty"`
+}
+
+// bwSlot counts the bytes of slot number idx, the unix time divided by the
+// resolution.
+type bwSlot struct {
+	idx           int64
+	read, written uint64
+}
+
+// bwRing keeps the last slots of one resolution. Slots are addressed by
+// their number, so gaps without traffic read as zero.
+type bwRing struct {
+	res   time.Duration
+	slots []bwSlot
+}
+
+func (r *bwRing) add(now time.Time, read, written uint64) {
+	idx := now.UnixNano() / int64(r.res)
+	s := &r.slots[idx%int64(len(r.slots))]
+	if s.idx != idx {
+		*s = bwSlot{idx: idx}
+	}
+	s.read += read
+	s.written += written
+}
+
+// slot returns the bytes of slot idx, zero if it was overwritten.
+func (r *bwRing) slot(idx int64) bwSlot {
+	if s := r.slots[idx%int64(len(r.slots))]; s.idx == idx {
+		return s
+	}
+	return bwSlot{idx: idx}
+}
+
+func (r *bwRing) sample(s bwSlot) BandwidthSample {
+	sec := uint64(r.res / time.Second)
+	return BandwidthSample{Time: time.Unix(0, s.idx*int64(r.res)).UTC(), Read: s.read / sec, Written: s.written / sec}
+}
+
+// samples returns the completed slots before now, oldest first.
+func (r *bwRing) samples(now time.Time) []BandwidthSample {
+	cur := now.UnixNano() / int64(r.res)
+	out := make([]BandwidthSample, 0, len(r.slots)-1)
+	for idx := cur - int64(len(r.slots)) + 1; idx < cur; idx++ {
+		out = append(out, r.sample(r.slot(idx)))
+	}
+	return out
+}
+
+// bwSeries keeps the rings of every resolution for one source.
+type bwSeries struct {
+	rings         []bwRing
+	read, written uint64
+	last          time.Time
+}
+
+func newBWSeries() *bwSeries {
+	s := &bwSeries{}
+	for _, r := range bwResolutions {
+		s.rings = append(s.rings, bwRing{res: r.res, slots: make([]bwSlot, r.n)})
+	}
+	return s
+}
+
+func (s *bwSeries) add(now time.Time, read, written uint64) {
+	for i := range s.rings {
+		s.rings[i].add(now, read, written)
+	}
+	s.read += read
+	s.written += written
+	s.last = now
+}
+
+func (s *bwSeries) report(ring int, now time.Time) BandwidthSeries {
+	return BandwidthSeries{ReadBytes: s.read, WrittenBytes: s.written, Samples: s.rings[ring].samples(now)}
+}
+
+// second returns the sample of the second before now and whether it saw
+// traffic.
+func (s *bwSeries) second(now time.Time) (BandwidthSample, bool) {
+	r := &s.rings[0]
+	sl := r.slot(now.Unix() - 1)
+	return r.sample(sl), sl.read > 0 || sl.written > 0
+}
+
+// bandwidth collects the traffic of tor from its BW, STREAM and STREAM_BW
+// events and that of the local proxy per Worker.
+type bandwidth struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	tor      *bwSeries
+	circuits map[string]*bwSeries
+	workers  map[string]*bwSeries
+	// streams maps tor stream IDs to their circuit.
+	streams map[string]string
+	// quiet is set once an update without traffic was published.
+	quiet bool
+}
+
+func newBandwidth() *bandwidth {
+	return &bandwidth{
+		now:      time.Now,
+		tor:      newBWSeries(),
+		circuits: map[string]*bwSeries{},
+		workers:  map[string]*bwSeries{},
+		streams:  map[string]string{},
+		quiet:    true,
+	}
+}
+
+// torEvent records a BW event, "READ WRITTEN", a STREAM event,
+// "ID STATUS CIRCUIT TARGET ...", or a STREAM_BW event,
+// "ID WRITTEN READ TIME".
+func (b *bandwidth) torEvent(ev TorEvent) {
+	f := strings.Fields(ev.Text)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch ev.Type {
+	case "BW":
+		if len(f) >= 2 {
+			b.tor.add(b.now(), parseCount(f[0]), parseCount(f[1]))
+		}
+	case "STREAM":
+		if len(f) < 3 {
+			return
+		}
+		switch {
+		case f[1] == "CLOSED" || f[1] == "FAILED":
+			delete(b.streams, f[0])
+		case f[2] != "0":
+			b.streams[f[0]] = f[2]
+		}
+	case "STREAM_BW":
+		if len(f) < 3 {
+			return
+		}
+		if circ, ok := b.streams[f[0]]; ok {
+			b.series(b.circuits, circ).add(b.now(), parseCount(f[2]), parseCount(f[1]))
+		}
+	}
+}
+
+// proxy records bytes relayed through worker.
+func (b *bandwidth) proxy(worker string, read, written uint64) {
+	if read == 0 && written == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.series(b.workers, worker).add(b.now(), read, written)
+}
+
+// series returns the series of key in m, making room for a new one by
+// dropping the longest idle.
+func (b *bandwidth) series(m map[string]*bwSeries, key string) *bwSeries {
+	if s, ok := m[key]; ok {
+		return s
+	}
+	if len(m) >= bwMaxSeries {
+		var oldest string
+		for k, s := range m {
+			if oldest == "" || s.last.Before(m[oldest].last) {
+				oldest = k
+			}
+		}
+		delete(m, oldest)
+	}
+	s := newBWSeries()
+	m[key] = s
+	return s
+}
+
+// stats reports every series at the resolution named res.
+func (b *bandwidth) stats(res string) (BandwidthStats, bool) {
+	ring := -1
+	for i, r := range bwResolutions {
+		if r.name == res {
+			ring = i
+		}
+	}
+	if ring < 0 {
+		return BandwidthStats{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	st := BandwidthStats{
+		Resolution: res,
+		Tor:        b.tor.report(ring, now),
+		Circuits:   map[string]BandwidthSeries{},
+		Workers:    map[string]BandwidthSeries{},
+	}
+	for k, s := range b.circuits {
+		st.Circuits[k] = s.report(ring, now)
+	}
+	for k, s := range b.workers {
+		st.Workers[k] = s.report(ring, now)
+	}
+	return st, true
+}
+
+// update returns the rates of the last second. It reports false when
+// neither that second nor the previous update saw traffic, so idle
+// engines publish a single zero update.
+func (b *bandwidth) update() (BandwidthUpdate, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	for k, s := range b.circuits {
+		if now.Sub(s.last) > bwCircuitIdle {
+			delete(b.circuits, k)
+		}
+	}
+	u := BandwidthUpdate{Time: time.Unix(now.Unix()-1, 0).UTC()}
+	u.Tor, _ = b.tor.second(now)
+	u.Circuits = seconds(b.circuits, now)
+	u.Workers = seconds(b.workers, now)
+	busy := u.Tor.Read > 0 || u.Tor.Written > 0 || u.Circuits != nil || u.Workers != nil
+	if !busy && b.quiet {
+		return u, false
+	}
+	b.quiet = !busy
+	return u, true
+}
+
+// seconds returns the last second of the series with traffic in it, nil
+// if there are none.
+func seconds(m map[string]*bwSeries, now time.Time) map[string]BandwidthSample {
+	var out map[string]BandwidthSample
+	for k, s := range m {
+		if sm, ok := s.second(now); ok {
+			if out == nil {
+				out = map[string]BandwidthSample{}
+			}
+			out[k] = sm
+		}
+	}
+	return out
+}
+
+// runBandwidth publishes the bandwidth every second until ctx is done.
+func (e *Engine) runBandwidth(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if u, ok := e.bandwidth.update(); ok {
+			e.publish(EventBandwidth, u)
+		}
+	}
+}
+
+func parseCount(s string) uint64 {
+	n, _ := strconv.ParseUint(s, 10, 64)
+	return n
+}
+
+func (e *Engine) handleBandwidth(w http.ResponseWriter, r *http.Request) {
+	res := r.URL.Query().Get("resolution")
+	if res == "" {
+		res = "1s"
+	}
+	st, ok := e.bandwidth.stats(res)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "unknown resolution "+strconv.Quote(res)+"; use 1s, 1m or 1h")
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// handleBandwidthStream sends the bandwidth events as server-sent events.
+func (e *Engine) handleBandwidthStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, codeInternal, "streaming unsupported")
+		return
+	}
+	events, unsubscribe := e.Subscribe()
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type != EventBandwidth {
+				continue
+			}
+			data, _ := json.Marshal(ev.Data)
+			fmt.Fprintf(w, "event: bandwidth\ndata: %s\n\n", data)
+		case <-ping.C:
+			io.WriteString(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		case <-e.streams.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// meteredReader reports the bytes read through it as they pass.
+type meteredReader struct {
+	io.ReadCloser
+	fn func(n int)
+}
+
+func (m meteredReader) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	if n > 0 {
+		m.fn(n)
+	}
+	return n, err
+}
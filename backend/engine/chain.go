@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// pathTimeout bounds a circuit path query on the control port.
+const pathTimeout = 5 * time.Second
+
+// Chain is the path of the connection as drawn by the UI: the user, the
+// three tor hops and the Worker. Unknown hops are null.
+type Chain struct {
+	You    *ChainClient `json:"you"`
+	Entry  *Relay       `json:"entry"`
+	Middle *Relay       `json:"middle"`
+	Exit   *Relay       `json:"exit"`
+	Worker *ChainWorker `json:"worker"`
+}
+
+// ChainClient is the user's end of the chain.
+type ChainClient struct {
+	LocalIP  string `json:"localIp,omitempty"`
+	PublicIP string `json:"publicIp,omitempty"`
+}
+
+// ChainWorker is the Worker bound to the session circuit.
+type ChainWorker struct {
+	URL  string `json:"url"`
+	Colo string `json:"colo,omitempty"`
+}
+
+// WithPublicIPLookup fetches the public IP address from url, which answers
+// with the bare address, whenever the local address changes. The lookup
+// goes out directly, not through tor. It is off by default.
+func WithPublicIPLookup(url string) Option {
+	return func(e *Engine) { e.ipLookup = url }
+}
+
+// chain assembles the chain from the addresses, the last circuit path and
+// the session.
+func (e *Engine) chain() Chain {
+	var ch Chain
+	e.ipMu.Lock()
+	if e.lastIP != "" || e.publicIP != "" {
+		ch.You = &ChainClient{LocalIP: e.lastIP, PublicIP: e.publicIP}
+	}
+	e.ipMu.Unlock()
+
+	c, ok := e.sess.current()
+	if !ok {
+		return ch
+	}
+	e.pathMu.Lock()
+	path := e.path
+	e.pathMu.Unlock()
+	if n := len(path); n > 0 {
+		ch.Entry = &path[0]
+		if n >= 3 {
+			ch.Middle = &path[n-2]
+		}
+		if n >= 2 {
+			ch.Exit = &path[n-1]
+		}
+	}
+	if c.Worker != "" {
+		ch.Worker = &ChainWorker{URL: c.Worker}
+		for _, w := range e.workers.List() {
+			if w.URL == c.Worker && w.Health != nil {
+				ch.Worker.Colo = w.Health.Colo
+			}
+		}
+	}
+	return ch
+}
+
+// refreshPath asks tor for the relays of the current circuit. The path is
+// cleared when tor cannot tell.
+func (e *Engine) refreshPath(ctx context.Context) {
+	var path []Relay
+	if pr, ok := e.tor.(PathReporter); ok {
+		ctx, sp := e.trace.start(ctx, "tor.circuit_path", spanInternal)
+		pctx, cancel := context.WithTimeout(ctx, pathTimeout)
+		p, err := pr.CircuitPath(pctx)
+		cancel()
+		sp.set("relays", len(p))
+		sp.end(err)
+		if err != nil {
+			e.genLog.with(ctx).warn(compTor, "circuit path unavailable", "error", err.Error())
+		}
+		path = p
+	}
+	e.pathMu.Lock()
+	e.path = path
+	e.pathMu.Unlock()
+}
+
+// clearPath forgets the circuit path when the session ends.
+func (e *Engine) clearPath() {
+	e.pathMu.Lock()
+	e.path = nil
+	e.pathMu.Unlock()
+}
+
+// lookupPublicIP refreshes the public address from the lookup service.
+func (e *Engine) lookupPublicIP(ctx context.Context) {
+	if e.ipLookup == "" {
+		return
+	}
+	ip, err := fetchPublicIP(ctx, e.ipLookup)
+	if err != nil {
+		e.genLog.warn(compNetwork, "public ip lookup failed", "error", err.Error())
+	}
+	e.ipMu.Lock()
+	e.publicIP = ip
+	e.ipMu.Unlock()
+}
+
+func fetchPublicIP(ctx context.Context, url string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(b)))
+	if resp.StatusCode != http.StatusOK || ip == nil {
+		return "", fmt.Errorf("unexpected lookup response (%s)", resp.Status)
+	}
+	return ip.String(), nil
+}
@@ -1,6 +1,7 @@
-package main
+package engine
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -8,6 +9,8 @@ import (
 // Circuit represents a single Tor circuit (mock).
 type Circuit struct {
 	ID int
+	// Worker is the worker URL bound to the circuit, empty for a direct exit.
+	Worker string `json:",omitempty"`
 }
 
 // CircuitManager keeps a pool of pre-warmed circuits.
@@ -50,13 +53,23 @@ func (cm *CircuitManager) Next() Circuit {
 	return c
 }
 
-// Start periodically ensures circuits remain pre-warmed.
-func (cm *CircuitManager) Start(interval time.Duration) {
-	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
-		for range ticker.C {
+// pooled returns the number of circuits waiting in the pool.
+func (cm *CircuitManager) pooled() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return len(cm.circuits)
+}
+
+// Run periodically ensures circuits remain pre-warmed until ctx is done.
+func (cm *CircuitManager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 			cm.prewarm()
 		}
-	}()
+	}
 }
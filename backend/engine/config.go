@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Config holds user adjustable settings.
+type Config struct {
+	OBFS4   bool `json:"obfs4"`
+	PreWarm bool `json:"prewarm"`
+	// LogPrivacy is the scrubbing applied to new log records.
+	LogPrivacy PrivacyLevel `json:"logPrivacy"`
+	// Logs limits the log files on disk.
+	Logs LogConfig `json:"logs"`
+	// LogSinks receive the log records.
+	LogSinks []SinkConfig `json:"logSinks"`
+	// Tracing exports spans to a local OpenTelemetry collector.
+	Tracing TracingConfig `json:"tracing"`
+}
+
+// defaultConfig is the config of a fresh install. Settings missing from
+// config.json keep these values.
+func defaultConfig() Config {
+	return Config{OBFS4: true, PreWarm: true, LogPrivacy: PrivacyStandard, Logs: defaultLogConfig(), LogSinks: defaultSinks()}
+}
+
+// loadConfig reads configuration from disk.
+func (e *Engine) loadConfig() error {
+	e.cfgMu.Lock()
+	defer e.cfgMu.Unlock()
+	path := filepath.Join(e.dir, "config.json")
+	e.cfg = defaultConfig()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(b, &e.cfg); err != nil {
+		return err
+	}
+	if e.cfg.LogPrivacy == "" {
+		e.cfg.LogPrivacy = PrivacyStandard
+	}
+	return nil
+}
+
+// saveConfig writes the current config to disk.
+func (e *Engine) saveConfig() error {
+	e.cfgMu.RLock()
+	defer e.cfgMu.RUnlock()
+	b, err := json.MarshalIndent(e.cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(e.dir, "config.json")
+	return os.WriteFile(path, b, 0600)
+}
+
+// getConfig returns a copy of current configuration.
+func (e *Engine) getConfig() Config {
+	e.cfgMu.RLock()
+	defer e.cfgMu.RUnlock()
+	c := e.cfg
+	c.LogSinks = append([]SinkConfig(nil), c.LogSinks...)
+	return c
+}
+
+// updateConfig merges new settings into the current config and applies
+// the log limits and sinks. An empty LogPrivacy keeps the current level
+// and nil LogSinks the current sinks.
+func (e *Engine) updateConfig(c Config) {
+	e.cfgMu.Lock()
+	defer func() {
+		e.cfgMu.Unlock()
+		e.sinks.setLogConfig(c.Logs)
+		e.configureSinks(false)
+	}()
+	if c.OBFS4 != e.cfg.OBFS4 {
+		e.cfg.OBFS4 = c.OBFS4
+	}
+	if c.PreWarm != e.cfg.PreWarm {
+		e.cfg.PreWarm = c.PreWarm
+	}
+	if c.LogPrivacy != "" {
+		e.cfg.LogPrivacy = c.LogPrivacy
+	}
+	e.cfg.Logs = c.Logs
+	e.cfg.Tracing = c.Tracing
+	if c.LogSinks != nil {
+		e.cfg.LogSinks = c.LogSinks
+	}
+}
@@ -0,0 +1,234 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// bootstrapTimeout bounds how long Connect waits for tor to bootstrap.
+const bootstrapTimeout = 3 * time.Minute
+
+// ConnectRequest selects the circuit countries and restricts the workers
+// of the session to CFList or Group.
+type ConnectRequest struct {
+	Entry  string   `json:"entry"`
+	Middle string   `json:"middle"`
+	Exit   string   `json:"exit"`
+	CFList []string `json:"cflist"`
+	Group  string   `json:"group"`
+}
+
+// RequestError is returned for requests the engine refuses. Code is the
+// machine-readable code of the API error envelope.
+type RequestError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// Connect starts tor and binds a circuit and worker from the requested
+// pool to the session. The attempt is traced as a child of the request in
+// ctx, and its log records carry the request ID. Tor runs for the engine,
+// not the request: it is started and bootstrapped under the connection
+// context, which Disconnect and shutdown cancel.
+func (e *Engine) Connect(ctx context.Context, req ConnectRequest) (err error) {
+	ctx, sp := e.trace.start(ctx, "connect", spanServer, "entry", req.Entry, "middle", req.Middle, "exit", req.Exit, "group", req.Group)
+	defer func() { sp.end(err) }()
+	clog, glog := e.connLog.with(ctx), e.genLog.with(ctx)
+	if len(req.CFList) > 0 && req.Group != "" {
+		return &RequestError{http.StatusBadRequest, codeBadRequest, "cflist and group are exclusive"}
+	}
+	pool := Pool{URLs: req.CFList, Group: req.Group}
+	for _, u := range req.CFList {
+		if !e.workers.Has(Pool{URLs: []string{u}}) {
+			return &RequestError{http.StatusBadRequest, codeUnknownWorker, "unknown worker " + u}
+		}
+	}
+	if req.Group != "" && !e.workers.Has(pool) {
+		return &RequestError{http.StatusBadRequest, codeUnknownGroup, "unknown group " + req.Group}
+	}
+	// the attempt owns tor until it is connected; a disconnect in progress
+	// holds it as well
+	if !e.torMu.TryLock() {
+		return &RequestError{http.StatusConflict, codeInvalidState, "a connect or disconnect is in progress"}
+	}
+	defer e.torMu.Unlock()
+	if err := e.setState(StateConnecting); err != nil {
+		return err
+	}
+	conn := e.beginConn()
+	connected := false
+	defer func() {
+		if !connected {
+			e.endConn()
+			e.stopTor()
+		}
+	}()
+	e.publish(EventProgress, e.progress.start())
+	start := time.Now()
+	_, tsp := e.trace.start(ctx, "tor.start", spanInternal)
+	err = e.tor.Start(conn)
+	tsp.end(err)
+	if err != nil {
+		glog.error(compTor, "tor failed to start", "error", err.Error())
+		e.fail(StateConnecting, err)
+		return &RequestError{http.StatusServiceUnavailable, codeTorUnavailable, "tor failed to start"}
+	}
+	// the events end with tor or the connection
+	go e.followTor(conn)
+	e.advance(progressTorStarted, PhaseConnecting, "")
+	if err := e.setState(StateBootstrapping); err != nil {
+		// disconnected meanwhile
+		return err
+	}
+	if b, ok := e.tor.(Bootstrapper); ok {
+		_, bsp := e.trace.start(ctx, "tor.bootstrap", spanInternal)
+		bctx, cancel := context.WithTimeout(conn, bootstrapTimeout)
+		err := b.Bootstrap(bctx, func(st BootstrapStatus) {
+			clog.debug(compTor, st.Summary, "percent", st.Percent, "tag", st.Tag)
+			pct, phase := torProgress(st)
+			e.advance(pct, phase, st.Summary)
+		})
+		cancel()
+		bsp.end(err)
+		if err != nil {
+			glog.error(compTor, "tor bootstrap failed", "error", err.Error())
+			e.fail(StateBootstrapping, fmt.Errorf("bootstrap: %w", err))
+			return &RequestError{http.StatusServiceUnavailable, codeTorUnavailable, "tor bootstrap failed: " + err.Error()}
+		}
+	}
+	e.observeBootstrap(time.Since(start))
+	e.advance(progressTorTo, PhaseCircuit, "")
+	_, csp := e.trace.start(ctx, "circuit.acquire", spanInternal, "pooled", e.circuits.pooled())
+	c := e.circuits.Next()
+	csp.set("circuit", c.ID)
+	csp.end(nil)
+	e.advance(progressCircuit, PhaseCircuit, "")
+	_, wsp := e.trace.start(ctx, "worker.select", spanInternal, "group", pool.Group)
+	c = e.sess.start(c, pool)
+	wsp.set("worker", c.Worker)
+	wsp.end(nil)
+	e.refreshPath(ctx)
+	if c.Worker != "" {
+		e.advance(progressWorker, PhaseWorker, "")
+	}
+	if err := e.setState(StateConnected); err != nil {
+		// disconnected meanwhile: unbind the session again
+		e.sess.stop()
+		e.clearPath()
+		return err
+	}
+	connected = true
+	e.advance(progressReady, PhaseReady, "")
+	if c.Worker != "" {
+		clog.info(compSession, "circuit bound to worker", "circuit", c.ID, "worker", c.Worker)
+		glog.info(compSession, "using worker", "worker", c.Worker)
+	} else {
+		clog.info(compSession, "circuit without worker", "circuit", c.ID)
+		glog.info(compSession, "no active worker; direct exit")
+	}
+	glog.info(compSession, "connected", "entry", req.Entry, "middle", req.Middle, "exit", req.Exit)
+	e.publish(EventConnected, c)
+	return nil
+}
+
+// Disconnect ends the session and stops tor. Errors stopping tor are
+// returned after the engine reached StateDisconnected.
+func (e *Engine) Disconnect(ctx context.Context) error {
+	if err := e.setState(StateDisconnecting); err != nil {
+		return err
+	}
+	// a connect in progress gives up and releases tor
+	e.endConn()
+	e.torMu.Lock()
+	e.sess.stop()
+	e.clearPath()
+	err := e.tor.Stop(ctx)
+	e.torMu.Unlock()
+	if err != nil {
+		e.genLog.warn(compTor, "tor did not stop cleanly", "error", err.Error())
+	}
+	e.setState(StateDisconnected)
+	e.progress.clear()
+	e.publish(EventProgress, e.progress.get())
+	e.connLog.info(compSession, "disconnected")
+	e.genLog.info(compSession, "disconnected")
+	e.publish(EventDisconnected, nil)
+	return err
+}
+
+// beginConn starts the context of a connection. The tor event follower and
+// a bootstrap in progress end with it.
+func (e *Engine) beginConn() context.Context {
+	ctx, cancel := context.WithCancel(e.streams)
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+	if e.cancelConn != nil {
+		e.cancelConn()
+	}
+	e.cancelConn = cancel
+	return ctx
+}
+
+// endConn cancels the context of the current connection, if any.
+func (e *Engine) endConn() {
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+	if e.cancelConn != nil {
+		e.cancelConn()
+		e.cancelConn = nil
+	}
+}
+
+// stopTor stops tor after a failed attempt. The caller holds torMu.
+func (e *Engine) stopTor() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := e.tor.Stop(ctx); err != nil {
+		e.genLog.warn(compTor, "tor did not stop cleanly", "error", err.Error())
+	}
+}
+
+// setState moves the connection to state next and publishes the change.
+func (e *Engine) setState(next ConnState) error {
+	if err := e.state.to(next); err != nil {
+		return err
+	}
+	e.publish(EventState, e.state.info())
+	return nil
+}
+
+// fail moves the connection from state from to StateError and reports
+// whether it did.
+func (e *Engine) fail(from ConnState, err error) bool {
+	if !e.state.fail(from, err) {
+		return false
+	}
+	e.publish(EventError, err.Error())
+	e.publish(EventState, e.state.info())
+	return true
+}
+
+// advance moves the progress of the attempt forward and publishes it.
+func (e *Engine) advance(percent int, phase, summary string) {
+	if p, ok := e.progress.advance(percent, phase, summary); ok {
+		e.publish(EventProgress, p)
+	}
+}
+
+// NewCircuit rotates the session to a fresh circuit keeping its worker.
+func (e *Engine) NewCircuit() Circuit {
+	c := e.sess.rotate(e.circuits.Next())
+	if _, ok := e.sess.current(); ok {
+		e.refreshPath(context.Background())
+	}
+	e.genLog.info(compSession, "rotated circuit", "circuit", c.ID)
+	e.publish(EventCircuit, c)
+	return c
+}
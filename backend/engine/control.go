@@ -0,0 +1,231 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files tor writes into its data directory for the control port.
+const (
+	controlPortFile   = "control-port"
+	controlCookieFile = "control_auth_cookie"
+)
+
+var errNoCircuit = errors.New("no built circuit")
+
+// controlConn is an authenticated connection to the tor control port, see
+// control-spec.txt. Commands are serialised.
+type controlConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialControl connects to the control port announced in the tor data
+// directory and authenticates with the cookie next to it.
+func dialControl(ctx context.Context, data string) (*controlConn, error) {
+	b, err := os.ReadFile(filepath.Join(data, controlPortFile))
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := strings.CutPrefix(strings.TrimSpace(string(b)), "PORT=")
+	if !ok {
+		return nil, fmt.Errorf("control port file: unexpected %q", b)
+	}
+	cookie, err := os.ReadFile(filepath.Join(data, controlCookieFile))
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &controlConn{conn: conn, r: bufio.NewReader(conn)}
+	if _, err := c.do(ctx, "AUTHENTICATE "+hex.EncodeToString(cookie)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("control auth: %w", err)
+	}
+	return c, nil
+}
+
+// do sends one command and returns the lines of a successful reply. Data
+// blocks ("250+key=" up to ".") are returned as one line joined by "\n".
+func (c *controlConn) do(ctx context.Context, cmd string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(10 * time.Second)
+	}
+	c.conn.SetDeadline(deadline)
+	if _, err := fmt.Fprintf(c.conn, "%s\r\n", cmd); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 4 {
+			return nil, fmt.Errorf("control: short reply %q", line)
+		}
+		code, sep, text := line[:3], line[3], line[4:]
+		if code[0] != '2' {
+			return nil, fmt.Errorf("control: %s", line)
+		}
+		switch sep {
+		case '+':
+			data, err := c.readData()
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, text+data)
+		case '-':
+			lines = append(lines, text)
+		default:
+			return lines, nil
+		}
+	}
+}
+
+func (c *controlConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readData reads a data block up to the terminating ".".
+func (c *controlConn) readData() (string, error) {
+	var b strings.Builder
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return "", err
+		}
+		if line == "." {
+			return b.String(), nil
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(strings.TrimPrefix(line, "."))
+	}
+}
+
+// getInfo returns the value of a GETINFO key.
+func (c *controlConn) getInfo(ctx context.Context, key string) (string, error) {
+	lines, err := c.do(ctx, "GETINFO "+key)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range lines {
+		if v, ok := strings.CutPrefix(l, key+"="); ok {
+			return v, nil
+		}
+	}
+	return "", errors.New("control: no value for " + key)
+}
+
+func (c *controlConn) Close() error {
+	return c.conn.Close()
+}
+
+// subscribe enables the events of the given types and calls fn for each
+// until the connection fails or is closed. The connection serves no
+// commands afterwards.
+func (c *controlConn) subscribe(ctx context.Context, types []string, fn func(TorEvent)) error {
+	if _, err := c.do(ctx, "SETEVENTS "+strings.Join(types, " ")); err != nil {
+		return err
+	}
+	c.conn.SetDeadline(time.Time{})
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		// 650 TYPE text, or 650+TYPE followed by a data block and 650 OK
+		if len(line) < 4 || line[:3] != "650" || line == "650 OK" {
+			continue
+		}
+		typ, text, _ := strings.Cut(line[4:], " ")
+		if line[3] == '+' {
+			data, err := c.readData()
+			if err != nil {
+				return err
+			}
+			text = strings.TrimSpace(text + " " + data)
+		}
+		fn(TorEvent{Type: typ, Text: text})
+	}
+}
+
+// circuitPath returns the relays of the newest built general purpose
+// circuit, resolving their addresses and countries.
+func (c *controlConn) circuitPath(ctx context.Context) ([]Relay, error) {
+	status, err := c.getInfo(ctx, "circuit-status")
+	if err != nil {
+		return nil, err
+	}
+	var hops []string
+	for _, line := range strings.Split(status, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 || f[1] != "BUILT" || !hasField(f[3:], "PURPOSE=GENERAL") {
+			continue
+		}
+		hops = strings.Split(f[2], ",")
+	}
+	if len(hops) == 0 {
+		return nil, errNoCircuit
+	}
+	path := make([]Relay, 0, len(hops))
+	for _, h := range hops {
+		r := parseHop(h)
+		if ns, err := c.getInfo(ctx, "ns/id/"+r.Fingerprint); err == nil {
+			// r nickname identity digest date time IP ORPort DirPort
+			if f := strings.Fields(ns); len(f) >= 8 && f[0] == "r" {
+				r.Nickname = f[1]
+				r.Address = f[6]
+			}
+		}
+		if r.Address != "" {
+			cc, err := c.getInfo(ctx, "ip-to-country/"+r.Address)
+			if err == nil && cc != "??" {
+				r.Country = strings.ToUpper(cc)
+			}
+		}
+		path = append(path, r)
+	}
+	return path, nil
+}
+
+// parseHop parses a LongName path element: $fingerprint, optionally
+// followed by "~nickname" or "=nickname".
+func parseHop(s string) Relay {
+	s = strings.TrimPrefix(s, "$")
+	if i := strings.IndexAny(s, "~="); i >= 0 {
+		return Relay{Fingerprint: s[:i], Nickname: s[i+1:]}
+	}
+	return Relay{Fingerprint: s}
+}
+
+func hasField(fields []string, f string) bool {
+	for _, x := range fields {
+		if x == f {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version is the backend version, set at build time with
+// -ldflags "-X torwell84/backend/engine.Version=...".
+var Version = "dev"
+
+var (
+	ipv4RE   = regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}\b`)
+	ipv6RE   = regexp.MustCompile(`[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}`)
+	onionRE  = regexp.MustCompile(`\b[a-z2-7]{16}(?:[a-z2-7]{40})?\.onion\b`)
+	bearerRE = regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]+`)
+)
+
+// redactor removes secrets and addresses from text bound for a
+// diagnostics bundle. Known secrets and worker URLs are replaced first,
+// then anything that looks like an IP address or onion service.
+type redactor struct {
+	// replace maps literal strings to their placeholder.
+	replace map[string]string
+}
+
+func newRedactor() *redactor {
+	return &redactor{replace: map[string]string{}}
+}
+
+// secret replaces s with "[redacted]".
+func (r *redactor) secret(s string) {
+	if s != "" {
+		r.replace[s] = "[redacted]"
+	}
+}
+
+// worker replaces the worker URL and its host with a numbered placeholder.
+func (r *redactor) worker(raw string, n int) {
+	name := fmt.Sprintf("worker-%d", n)
+	r.replace[raw] = "https://" + name + ".invalid"
+	if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+		r.replace[u.Hostname()] = name + ".invalid"
+	}
+}
+
+func (r *redactor) string(s string) string {
+	// longer strings first, so a URL is replaced before its host
+	keys := make([]string, 0, len(r.replace))
+	for k := range r.replace {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+	for _, k := range keys {
+		s = strings.ReplaceAll(s, k, r.replace[k])
+	}
+	s = bearerRE.ReplaceAllString(s, "Bearer [redacted]")
+	s = onionRE.ReplaceAllString(s, "[onion]")
+	s = ipv4RE.ReplaceAllStringFunc(s, redactIP)
+	s = ipv6RE.ReplaceAllStringFunc(s, redactIP)
+	return s
+}
+
+// redactIP hides an address unless it is loopback or unspecified, which
+// say nothing about the user.
+func redactIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		return s
+	}
+	return "[ip]"
+}
+
+// json encodes v indented and redacts the result.
+func (r *redactor) json(v interface{}) []byte {
+	b, _ := json.MarshalIndent(v, "", "  ")
+	return []byte(r.string(string(b)) + "\n")
+}
+
+// diagnosticsRedactor knows the secrets and workers of the engine.
+func (e *Engine) diagnosticsRedactor() *redactor {
+	r := newRedactor()
+	if b, err := os.ReadFile(filepath.Join(e.dir, apiTokenFile)); err == nil {
+		r.secret(strings.TrimSpace(string(b)))
+	}
+	for _, t := range e.workers.tokens() {
+		r.secret(t)
+	}
+	for i, w := range e.workers.List() {
+		r.worker(w.URL, i+1)
+	}
+	return r
+}
+
+// TorInfo is the tor part of a diagnostics bundle.
+type TorInfo struct {
+	Binary   string    `json:"binary"`
+	Version  string    `json:"version,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	State    StateInfo `json:"state"`
+	Progress Progress  `json:"progress"`
+}
+
+// SystemInfo is the system summary of a diagnostics bundle.
+type SystemInfo struct {
+	Version    string    `json:"version"`
+	GoVersion  string    `json:"goVersion"`
+	OS         string    `json:"os"`
+	Arch       string    `json:"arch"`
+	CPUs       int       `json:"cpus"`
+	Goroutines int       `json:"goroutines"`
+	Time       time.Time `json:"time"`
+}
+
+// torVersion runs the tor binary with --version.
+func torVersion(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, torBinary(), "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return line, nil
+}
+
+// writeBundle writes the diagnostics zip to w. Logs, config, worker health
+// and the last error are redacted; the rest holds no user data.
+func (e *Engine) writeBundle(ctx context.Context, w io.Writer) error {
+	r := e.diagnosticsRedactor()
+	tor := TorInfo{Binary: filepath.Base(torBinary()), State: e.state.info(), Progress: e.progress.get()}
+	// the version itself would read as an IP address to the redactor
+	tor.State.LastError = r.string(tor.State.LastError)
+	if v, err := torVersion(ctx); err != nil {
+		tor.Error = err.Error()
+	} else {
+		tor.Version = v
+	}
+	sys := SystemInfo{
+		Version:    Version,
+		GoVersion:  runtime.Version(),
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		CPUs:       runtime.NumCPU(),
+		Goroutines: runtime.NumGoroutine(),
+		Time:       time.Now().UTC(),
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"logs/connection.jsonl", r.records(e.connLog.list(logFilter{}))},
+		{"logs/general.jsonl", r.records(e.genLog.list(logFilter{}))},
+		{"config.json", r.json(e.getConfig())},
+		{"workers.json", r.json(e.workers.List())},
+		{"tor.json", jsonIndent(tor)},
+		{"system.json", jsonIndent(sys)},
+	}
+
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: sys.Time})
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// records redacts log records as JSON lines.
+func (r *redactor) records(recs []LogRecord) []byte {
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		b, _ := json.Marshal(rec)
+		buf.WriteString(r.string(string(b)))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func jsonIndent(v interface{}) []byte {
+	b, _ := json.MarshalIndent(v, "", "  ")
+	return append(b, '\n')
+}
@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dnsCache caches DNS lookups for a short period. The worker clients dial
+// through it.
+type dnsCache struct {
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+	ttl   time.Duration
+	r     *net.Resolver
+
+	hits, misses atomic.Uint64
+	trace        *tracer
+}
+
+type cacheEntry struct {
+	addrs  []string
+	expiry time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{cache: make(map[string]cacheEntry), ttl: ttl, r: net.DefaultResolver}
+}
+
+// LookupHost resolves host, tracing the lookup as a child of ctx.
+func (d *dnsCache) LookupHost(ctx context.Context, host string) (addrs []string, err error) {
+	ctx, sp := d.trace.start(ctx, "dns.lookup", spanClient, "host", host)
+	defer func() {
+		sp.set("addresses", len(addrs))
+		sp.end(err)
+	}()
+	d.mu.Lock()
+	if e, ok := d.cache[host]; ok && time.Now().Before(e.expiry) {
+		addrs := make([]string, len(e.addrs))
+		copy(addrs, e.addrs)
+		d.mu.Unlock()
+		d.hits.Add(1)
+		sp.set("cached", true)
+		return addrs, nil
+	}
+	d.mu.Unlock()
+	d.misses.Add(1)
+	sp.set("cached", false)
+
+	addrs, err = d.r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.cache[host] = cacheEntry{addrs: addrs, expiry: time.Now().Add(d.ttl)}
+	d.mu.Unlock()
+	return addrs, nil
+}
+
+// DialContext connects to addr, resolving its host through the cache and
+// trying the addresses in turn. IP literals are dialed directly.
+func (d *dnsCache) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := d.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	for _, a := range addrs {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(a, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
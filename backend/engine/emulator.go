@@ -0,0 +1,216 @@
+package engine
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// workerEmulator serves the worker protocol locally so the backend can be
+// developed and tested without Cloudflare.
+type workerEmulator struct {
+	token  string
+	colo   string
+	doh    string
+	limits WorkerLimits
+	client *http.Client
+}
+
+// NewWorkerEmulator serves the worker protocol with token, reporting colo
+// and resolving DNS queries through the DoH server doh.
+func NewWorkerEmulator(token, colo, doh string) http.Handler {
+	return &workerEmulator{
+		token:  token,
+		colo:   colo,
+		doh:    doh,
+		limits: defaultWorkerLimits,
+		client: &http.Client{
+			Timeout: time.Duration(defaultWorkerLimits.TimeoutMs) * time.Millisecond,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (e *workerEmulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(workerTokenHeader)), []byte(e.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case defaultHealthPath:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(HealthInfo{
+			Protocol: maxWorkerProtocol,
+			Colo:     e.colo,
+			Features: []string{FeatureFetch, FeatureWebSocket, FeatureDoH},
+			Limits:   e.limits,
+		})
+	case fetchPath:
+		e.fetch(w, r)
+	case wsPath:
+		e.websocket(w, r)
+	case dohPath:
+		e.dnsQuery(w, r)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (e *workerEmulator) target(r *http.Request, schemes ...string) (*url.URL, bool) {
+	t, err := url.Parse(r.Header.Get(targetHeader))
+	if err != nil {
+		return nil, false
+	}
+	for _, s := range schemes {
+		if t.Scheme == s && t.Host != "" {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+func (e *workerEmulator) fetch(w http.ResponseWriter, r *http.Request) {
+	t, ok := e.target(r, "http", "https")
+	if !ok {
+		http.Error(w, "bad target", http.StatusBadRequest)
+		return
+	}
+	body := io.Reader(r.Body)
+	length := r.ContentLength
+	if max := e.limits.MaxBodyBytes; max > 0 {
+		body = io.LimitReader(r.Body, max)
+		// the upstream length must match the truncated body
+		if length > max {
+			length = max
+		}
+	}
+	out, err := http.NewRequestWithContext(r.Context(), r.Method, t.String(), body)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	out.ContentLength = length
+	// drops the worker token with the other X-Torwell headers
+	copyHeaders(out.Header, r.Header)
+	resp, err := e.client.Do(out)
+	if err != nil {
+		http.Error(w, "upstream error", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	copyHeaders(w.Header(), resp.Header)
+	w.Header().Set(coloHeader, e.colo)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// websocket replays the upgrade request to the target and pipes both
+// connections once the target switched protocols.
+func (e *workerEmulator) websocket(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "expected websocket", http.StatusUpgradeRequired)
+		return
+	}
+	t, ok := e.target(r, "ws", "wss")
+	if !ok {
+		http.Error(w, "bad target", http.StatusBadRequest)
+		return
+	}
+	host := t.Host
+	if t.Port() == "" {
+		if t.Scheme == "wss" {
+			host = net.JoinHostPort(t.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(t.Hostname(), "80")
+		}
+	}
+	var upstream net.Conn
+	var err error
+	if t.Scheme == "wss" {
+		d := &net.Dialer{Timeout: 10 * time.Second}
+		upstream, err = tls.DialWithDialer(d, "tcp", host, &tls.Config{ServerName: t.Hostname(), MinVersion: tls.VersionTLS12})
+	} else {
+		upstream, err = net.DialTimeout("tcp", host, 10*time.Second)
+	}
+	if err != nil {
+		http.Error(w, "upstream error", http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	out, _ := http.NewRequest(http.MethodGet, "http://"+t.Host+t.RequestURI(), nil)
+	for k, vv := range r.Header {
+		if strings.HasPrefix(k, "X-Torwell-") {
+			continue
+		}
+		out.Header[k] = vv
+	}
+	if err := out.Write(upstream); err != nil {
+		http.Error(w, "upstream error", http.StatusBadGateway)
+		return
+	}
+	br := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(br, out)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		http.Error(w, "upstream refused websocket", http.StatusBadGateway)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijack unsupported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if err := resp.Write(conn); err != nil {
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, rw.Reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, br)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (e *workerEmulator) dnsQuery(w http.ResponseWriter, r *http.Request) {
+	u := e.doh
+	if r.URL.RawQuery != "" {
+		u += "?" + r.URL.RawQuery
+	}
+	out, err := http.NewRequestWithContext(r.Context(), r.Method, u, r.Body)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	out.Header.Set("Accept", "application/dns-message")
+	if r.Method == http.MethodPost {
+		out.Header.Set("Content-Type", "application/dns-message")
+	}
+	resp, err := e.client.Do(out)
+	if err != nil {
+		http.Error(w, "upstream error", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
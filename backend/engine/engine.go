@@ -0,0 +1,385 @@
+// Package engine implements the Torwell84 backend: worker and circuit
+// management, the REST API, the local worker proxy and the Tor lifecycle.
+// Every Engine is an isolated instance, so the desktop sidecar, the mobile
+// bindings and tests can run their own.
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAPIAddr is the TCP address of the REST API.
+	DefaultAPIAddr = "127.0.0.1:9472"
+	// DefaultProxyAddr is where the local worker proxy listens.
+	DefaultProxyAddr = "127.0.0.1:9473"
+	// shutdownTimeout bounds the graceful shutdown of Run.
+	shutdownTimeout = 15 * time.Second
+)
+
+// TorEngine runs the Tor daemon for a session. Start is called on connect
+// and Stop on disconnect and shutdown.
+type TorEngine interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+// DefaultConfigDir returns $TORWELL84_CONFIG or the torwell84 directory in
+// the user config directory.
+func DefaultConfigDir() string {
+	if d := os.Getenv("TORWELL84_CONFIG"); d != "" {
+		return d
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(dir, "torwell84")
+}
+
+// Option configures an Engine.
+type Option func(*Engine)
+
+// WithConfigDir stores workers, config, logs and the API token in dir.
+func WithConfigDir(dir string) Option {
+	return func(e *Engine) { e.dir = dir }
+}
+
+// WithAPIAddr serves the token protected API on addr. An empty addr
+// disables the TCP listener.
+func WithAPIAddr(addr string) Option {
+	return func(e *Engine) { e.apiAddr = addr }
+}
+
+// WithAPISocket serves the API on a Unix domain socket at path. A relative
+// path is resolved inside the config directory.
+func WithAPISocket(path string) Option {
+	return func(e *Engine) { e.socket = path }
+}
+
+// WithProxyAddr serves the worker proxy on addr. An empty addr disables it.
+func WithProxyAddr(addr string) Option {
+	return func(e *Engine) { e.proxyAddr = addr }
+}
+
+// WithTor replaces the tor child process.
+func WithTor(t TorEngine) Option {
+	return func(e *Engine) { e.tor = t }
+}
+
+// Engine owns the state of one backend instance.
+type Engine struct {
+	dir       string
+	apiAddr   string
+	socket    string
+	proxyAddr string
+	tor       TorEngine
+
+	workers  *WorkerManager
+	circuits *CircuitManager
+	dns      *dnsCache
+	sess     session
+	handler  http.Handler
+	events   eventHub
+
+	cfgMu sync.RWMutex
+	cfg   Config
+
+	state     *stateMachine
+	progress  progressTracker
+	connLog   logBuffer
+	genLog    logBuffer
+	sinks     sinkSet
+	metrics   metrics
+	trace     *tracer
+	bandwidth *bandwidth
+
+	ipMu     sync.Mutex
+	lastIP   string
+	publicIP string
+	ipLookup string
+
+	pathMu sync.Mutex
+	path   []Relay
+
+	// torMu serializes starting and stopping tor: Connect holds it until
+	// the attempt is connected or has stopped tor again.
+	torMu sync.Mutex
+	// connMu guards cancelConn, which ends the context of the current
+	// connection.
+	connMu     sync.Mutex
+	cancelConn context.CancelFunc
+
+	// streams ends the log streams and the connection context on shutdown.
+	streams     context.Context
+	stopStreams context.CancelFunc
+
+	closeOnce sync.Once
+}
+
+// New creates an engine and loads its state from the config directory.
+func New(opts ...Option) (*Engine, error) {
+	e := &Engine{
+		dir:       DefaultConfigDir(),
+		apiAddr:   DefaultAPIAddr,
+		proxyAddr: DefaultProxyAddr,
+		workers:   NewWorkerManager(),
+		circuits:  NewCircuitManager(3),
+		dns:       newDNSCache(5 * time.Minute),
+		bandwidth: newBandwidth(),
+		state:     newStateMachine(),
+	}
+	e.streams, e.stopStreams = context.WithCancel(context.Background())
+	for _, o := range opts {
+		o(e)
+	}
+	if e.tor == nil {
+		e.tor = &torProcess{dir: e.dir}
+	}
+	if e.socket != "" && !filepath.IsAbs(e.socket) {
+		e.socket = filepath.Join(e.dir, e.socket)
+	}
+	if err := os.MkdirAll(e.dir, 0700); err != nil {
+		return nil, err
+	}
+	// connection logs keep debug records, general logs start at info
+	e.genLog.min = LevelInfo
+	e.connLog.scrub = newScrubber(e.logPrivacy, e.workers.urls)
+	e.genLog.scrub = e.connLog.scrub
+	if err := e.loadConfig(); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	e.configureSinks(true)
+	e.connLog.name, e.connLog.out = "connection", &e.sinks
+	e.genLog.name, e.genLog.out = "general", &e.sinks
+	e.trace = newTracer(func() string { return e.getConfig().Tracing.Endpoint })
+	e.trace.scrub = e.connLog.scrub.field
+	e.trace.onError = func(err error) { e.genLog.warn(compEngine, "trace export failed", "error", err.Error()) }
+	go e.trace.run(e.streams)
+	go e.runBandwidth(e.streams)
+	e.workers.trace = e.trace
+	e.dns.trace = e.trace
+	e.workers.setDialer(e.dns.DialContext)
+	e.workers.Load(filepath.Join(e.dir, "workers.json"))
+	e.workers.LoadUsage(filepath.Join(e.dir, "usage.json"))
+	e.sess.e = e
+	e.workers.Watch(e.sess.failover)
+	e.handler = e.newServer()
+	return e, nil
+}
+
+// ConfigDir returns the directory holding the engine state.
+func (e *Engine) ConfigDir() string {
+	return e.dir
+}
+
+// logDir holds the log files.
+func (e *Engine) logDir() string {
+	return filepath.Join(e.dir, "logs")
+}
+
+// Handler returns the API without authentication, as served on the Unix
+// socket. Run wraps it in the token guard for the TCP listener.
+func (e *Engine) Handler() http.Handler {
+	return e.handler
+}
+
+// Status is the body of GET /status. Connected is kept for older clients
+// and reports StateConnected.
+type Status struct {
+	StateInfo
+	Progress  Progress `json:"progress"`
+	Connected bool     `json:"connected"`
+	Workers   []Worker `json:"workers"`
+	Config    Config   `json:"config"`
+	Circuit   *Circuit `json:"circuit,omitempty"`
+	Chain     Chain    `json:"chain"`
+}
+
+// Status reports the connection, workers and config.
+func (e *Engine) Status() Status {
+	info := e.state.info()
+	st := Status{
+		StateInfo: info,
+		Progress:  e.progress.get(),
+		Connected: info.State == StateConnected,
+		Workers:   e.workers.List(),
+		Config:    e.getConfig(),
+		Chain:     e.chain(),
+	}
+	if c, ok := e.sess.current(); ok {
+		st.Circuit = &c
+	}
+	return st
+}
+
+// Run serves the API and proxy listeners and runs the background loops
+// until ctx is done or a listener fails, then shuts the engine down.
+func (e *Engine) Run(ctx context.Context) error {
+	svc := newService()
+	svc.Go(func(ctx context.Context) { e.workers.RunHealthChecker(ctx, 30*time.Second) })
+	svc.Go(func(ctx context.Context) { e.monitorIP(ctx, 10*time.Second) })
+	svc.Go(func(ctx context.Context) { e.circuits.Run(ctx, 30*time.Second) })
+
+	err := e.listen(svc)
+	if err == nil {
+		select {
+		case <-ctx.Done():
+		case err = <-svc.Err():
+		}
+	}
+	e.shutdown(svc, shutdownTimeout)
+	return err
+}
+
+func (e *Engine) listen(svc *service) error {
+	// the TCP listeners share the token
+	var token string
+	if e.apiAddr != "" || e.proxyAddr != "" {
+		var err error
+		if token, err = writeAPIToken(e.dir); err != nil {
+			return fmt.Errorf("api token: %w", err)
+		}
+	}
+	if e.proxyAddr != "" {
+		l, err := net.Listen("tcp", e.proxyAddr)
+		if err != nil {
+			// the API stays usable without the proxy
+			log.Printf("worker proxy: %v", err)
+		} else {
+			log.Printf("starting worker proxy on %s", e.proxyAddr)
+			svc.ServeProxy(l, &workerProxy{e: e, token: token})
+		}
+	}
+	if e.socket != "" {
+		l, err := listenUnix(e.socket)
+		if err != nil {
+			return fmt.Errorf("api socket: %w", err)
+		}
+		log.Printf("starting server on %s", e.socket)
+		// Peer credentials are checked per connection, so the socket
+		// needs neither token nor host checks.
+		svc.ServeAPI(l, e.handler)
+	}
+	if e.apiAddr != "" {
+		l, err := net.Listen("tcp", e.apiAddr)
+		if err != nil {
+			return fmt.Errorf("api: %w", err)
+		}
+		log.Printf("starting server on %s", e.apiAddr)
+		svc.ServeAPI(l, newAPIGuard(e.handler, token, l.Addr().String()))
+	}
+	return nil
+}
+
+// Close stops tor, flushes the logs and saves the engine state. Run calls
+// it on shutdown; engines only used through Handler must call it.
+func (e *Engine) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return e.close(ctx)
+}
+
+func (e *Engine) close(ctx context.Context) error {
+	var err error
+	e.closeOnce.Do(func() {
+		// ends a connect in progress along with the connection context
+		e.stopStreams()
+		log.Printf("shutdown: stopping tor")
+		e.torMu.Lock()
+		e.sess.stop()
+		if terr := e.tor.Stop(ctx); terr != nil {
+			log.Printf("shutdown: %v", terr)
+		}
+		e.torMu.Unlock()
+		e.state.reset()
+		e.progress.clear()
+		e.clearPath()
+
+		e.trace.wait(ctx)
+		log.Printf("shutdown: closing logs")
+		e.genLog.info(compEngine, "shutting down")
+		e.connLog.close()
+		e.genLog.close()
+		e.sinks.close()
+
+		log.Printf("shutdown: saving state")
+		if err = e.workers.Save(); err != nil {
+			log.Printf("shutdown: workers: %v", err)
+		}
+		if uerr := e.workers.FlushUsage(); uerr != nil {
+			log.Printf("shutdown: usage: %v", uerr)
+			err = uerr
+		}
+		if cerr := e.saveConfig(); cerr != nil {
+			log.Printf("shutdown: config: %v", cerr)
+			err = cerr
+		}
+	})
+	return err
+}
+
+// monitorIP periodically checks the primary IP address and logs changes
+// until ctx is done.
+func (e *Engine) monitorIP(ctx context.Context, interval time.Duration) {
+	ip := getLocalIP()
+	e.setLocalIP(ip)
+	e.genLog.info(compNetwork, "initial ip", "ip", ip)
+	e.lookupPublicIP(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := getLocalIP()
+		if current != ip {
+			e.genLog.info(compNetwork, "ip changed", "ip", current, "previous", ip)
+			ip = current
+			e.setLocalIP(ip)
+			e.lookupPublicIP(ctx)
+		}
+	}
+}
+
+func (e *Engine) setLocalIP(ip string) {
+	e.ipMu.Lock()
+	e.lastIP = ip
+	e.ipMu.Unlock()
+}
+
+// localIP returns the primary IP address last seen by monitorIP.
+func (e *Engine) localIP() string {
+	e.ipMu.Lock()
+	defer e.ipMu.Unlock()
+	return e.lastIP
+}
+
+func getLocalIP() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+				return ipnet.IP.String()
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,2611 @@
+package engine
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"torwell84/backend/client"
+)
+
+// stubTor stands in for the tor daemon.
+type stubTor struct {
+	mu       sync.Mutex
+	running  bool
+	stopped  int
+	onStop   func()
+	startErr error
+}
+
+func (s *stubTor) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.startErr != nil {
+		return s.startErr
+	}
+	s.running = true
+	return nil
+}
+
+func (s *stubTor) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	s.stopped++
+	if s.onStop != nil {
+		s.onStop()
+	}
+	return nil
+}
+
+// newTestEngine returns an isolated engine without listeners and with a
+// stub tor.
+func newTestEngine(t *testing.T, opts ...Option) *Engine {
+	t.Helper()
+	opts = append([]Option{WithConfigDir(t.TempDir()), WithAPIAddr(""), WithProxyAddr(""), WithTor(&stubTor{})}, opts...)
+	e, err := New(opts...)
+	if err != nil {
+		t.Fatalf("engine: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+func TestStatus(t *testing.T) {
+	handler := newTestEngine(t).Handler()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/status", nil)
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var st Status
+	json.NewDecoder(w.Body).Decode(&st)
+	if st.Connected || !st.Config.OBFS4 || !st.Config.PreWarm {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestWorkerCRUD(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	handler := newTestEngine(t).Handler()
+
+	// Add worker
+	postReq := httptest.NewRequest(http.MethodPost, "/workers", strings.NewReader(`{"URL":"`+srv.URL+`"}`))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, postReq)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+
+	// List workers
+	getReq := httptest.NewRequest(http.MethodGet, "/workers", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, getReq)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var got []Worker
+	json.NewDecoder(w.Body).Decode(&got)
+	if len(got) != 1 || got[0].URL != srv.URL {
+		t.Fatalf("unexpected workers list: %v", got)
+	}
+
+	// Remove worker
+	delReq := httptest.NewRequest(http.MethodDelete, "/workers", strings.NewReader(`{"URL":"`+srv.URL+`"}`))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, delReq)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/workers", nil))
+	got = nil
+	json.NewDecoder(w.Body).Decode(&got)
+	if len(got) != 0 {
+		t.Fatalf("worker not removed: %v", got)
+	}
+}
+
+func TestWorkerHealthCheck(t *testing.T) {
+	// healthy server
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	wm := NewWorkerManager()
+	if err := wm.Add(srv.URL); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if len(wm.List()) != 1 || !wm.List()[0].Active {
+		t.Fatal("worker not active")
+	}
+
+	// make server unhealthy
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	wm.CheckAll()
+	if wm.List()[0].Active {
+		t.Fatal("expected inactive worker")
+	}
+}
+
+func TestWorkerNext(t *testing.T) {
+	// two healthy servers
+	srv1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv2.Close()
+
+	wm := NewWorkerManager()
+	if err := wm.Add(srv1.URL); err != nil {
+		t.Fatalf("add1: %v", err)
+	}
+	if err := wm.Add(srv2.URL); err != nil {
+		t.Fatalf("add2: %v", err)
+	}
+
+	url, ok := wm.Next()
+	if !ok || url != srv1.URL {
+		t.Fatalf("expected %s, got %s", srv1.URL, url)
+	}
+	url, ok = wm.Next()
+	if !ok || url != srv2.URL {
+		t.Fatalf("expected %s, got %s", srv2.URL, url)
+	}
+
+	// make first server unhealthy and check failover
+	srv1.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	wm.CheckAll()
+	url, ok = wm.Next()
+	if !ok || url != srv2.URL {
+		t.Fatalf("expected failover to %s, got %s", srv2.URL, url)
+	}
+}
+
+func TestWorkerHealthProtocol(t *testing.T) {
+	healthz := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/.well-known/healthz" && r.URL.Path != "/custom" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}))
+	}
+	plain := healthz("")
+	defer plain.Close()
+	ws := healthz(`{"protocol":2,"colo":"FRA","features":["fetch","websocket"],"limits":{"requestsPerDay":100000}}`)
+	defer ws.Close()
+	future := healthz(`{"protocol":3,"features":["fetch"]}`)
+	defer future.Close()
+
+	wm := NewWorkerManager()
+	if err := wm.Add(future.URL); !errors.Is(err, ErrIncompatibleProtocol) {
+		t.Fatalf("expected incompatible protocol, got %v", err)
+	}
+	if err := wm.Add(plain.URL); err != nil {
+		t.Fatalf("add v1: %v", err)
+	}
+	if err := wm.AddWorker(Worker{URL: ws.URL, HealthPath: "/custom", Expect: []string{"colo"}}); err != nil {
+		t.Fatalf("add v2: %v", err)
+	}
+	if err := wm.AddWorker(Worker{URL: plain.URL + "/", Expect: []string{"colo"}}); err == nil {
+		t.Fatal("expected missing field to be refused")
+	}
+	if h := wm.List()[1].Health; h == nil || h.Protocol != 2 || h.Colo != "FRA" || h.Limits.RequestsPerDay != 100000 {
+		t.Fatalf("health not recorded: %+v", h)
+	}
+	for i := 0; i < 2; i++ {
+		url, ok := wm.NextFor(FeatureWebSocket)
+		if !ok || url != ws.URL {
+			t.Fatalf("expected websocket worker, got %s", url)
+		}
+	}
+	if _, ok := wm.NextFor(FeatureDoH); ok {
+		t.Fatal("no worker supports doh")
+	}
+}
+
+func TestConnectWorkerPool(t *testing.T) {
+	healthy := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	a := httptest.NewServer(http.HandlerFunc(healthy))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(healthy))
+	defer b.Close()
+	c := httptest.NewServer(http.HandlerFunc(healthy))
+	defer c.Close()
+
+	e := newTestEngine(t)
+	wm := e.workers
+	wm.AddWorker(Worker{URL: a.URL, Group: "eu", Priority: 1})
+	wm.AddWorker(Worker{URL: b.URL, Group: "eu"})
+	wm.AddWorker(Worker{URL: c.URL, Group: "us"})
+	handler := e.Handler()
+
+	connect := func(body string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/connect", strings.NewReader(body)))
+		return w.Code
+	}
+	if code := connect(`{"group":"asia"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected unknown group to fail, got %d", code)
+	}
+	if code := connect(`{"cflist":["https://unknown.example"]}`); code != http.StatusBadRequest {
+		t.Fatalf("expected unknown worker to fail, got %d", code)
+	}
+
+	// the preferred worker of the group is bound
+	if code := connect(`{"group":"eu"}`); code != http.StatusOK {
+		t.Fatalf("connect: %d", code)
+	}
+	if cur, _ := e.sess.current(); cur.Worker != b.URL {
+		t.Fatalf("expected %s, got %s", b.URL, cur.Worker)
+	}
+	// binding survives circuit rotation
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/new-circuit", nil))
+	if cur, _ := e.sess.current(); cur.Worker != b.URL {
+		t.Fatalf("binding lost on rotation: %s", cur.Worker)
+	}
+	// failover stays within the group and reconnects until the next
+	// worker passed a fresh health check
+	down := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	b.Config.Handler = down
+	wm.CheckAll()
+	checking, release := make(chan struct{}, 1), make(chan struct{})
+	a.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case checking <- struct{}{}:
+		default:
+		}
+		<-release
+	})
+	failedOver := make(chan struct{})
+	go func() {
+		e.sess.failover()
+		close(failedOver)
+	}()
+	<-checking
+	if st := e.state.current(); st != StateReconnecting {
+		close(release)
+		t.Fatalf("expected reconnecting during the check, got %s", st)
+	}
+	close(release)
+	<-failedOver
+	if cur, _ := e.sess.current(); cur.Worker != a.URL || e.state.current() != StateConnected {
+		t.Fatalf("expected failover to %s, got %s in %s", a.URL, cur.Worker, e.state.current())
+	}
+
+	// without a worker left the session fails instead of leaving the pool
+	a.Config.Handler = down
+	wm.CheckAll()
+	e.sess.failover()
+	if cur, active := e.sess.current(); active || cur.Worker != "" || e.state.current() != StateError {
+		t.Fatalf("expected failed session, got %+v active=%v in %s", cur, active, e.state.current())
+	}
+
+	// explicit cflist on a new connection
+	if code := connect(`{"cflist":["` + c.URL + `"]}`); code != http.StatusOK {
+		t.Fatalf("connect cflist: %d", code)
+	}
+	if cur, _ := e.sess.current(); cur.Worker != c.URL {
+		t.Fatalf("expected %s, got %s", c.URL, cur.Worker)
+	}
+	if code := connect(`{"cflist":["` + c.URL + `"]}`); code != http.StatusConflict {
+		t.Fatalf("expected double connect to conflict, got %d", code)
+	}
+}
+
+func TestWorkerScaffold(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "worker")
+	token, err := ScaffoldWorker(dir, "demo", false)
+	if err != nil {
+		t.Fatalf("scaffold: %v", err)
+	}
+	js, _ := os.ReadFile(filepath.Join(dir, "worker.js"))
+	if !bytes.Contains(js, []byte("const PROTOCOL = 2;")) || !bytes.Contains(js, []byte(`"/.well-known/healthz"`)) {
+		t.Fatalf("unexpected worker.js:\n%s", js)
+	}
+	toml, _ := os.ReadFile(filepath.Join(dir, "wrangler.toml"))
+	if !bytes.Contains(toml, []byte(`name = "demo"`)) || bytes.Contains(toml, []byte(token)) {
+		t.Fatalf("unexpected wrangler.toml:\n%s", toml)
+	}
+	info, err := os.Stat(filepath.Join(dir, ".dev.vars"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("secret file: %v %v", info, err)
+	}
+	if _, err := ScaffoldWorker(dir, "demo", false); err == nil {
+		t.Fatal("expected existing files to be kept")
+	}
+}
+
+func TestWorkerEmulatorBodyLimit(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d %s", r.ContentLength, b)
+	}))
+	defer target.Close()
+	emu := NewWorkerEmulator("secret", "TST", "").(*workerEmulator)
+	emu.limits.MaxBodyBytes = 4
+	srv := httptest.NewServer(emu)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+fetchPath, strings.NewReader("0123456789"))
+	req.Header.Set(workerTokenHeader, "secret")
+	req.Header.Set(targetHeader, target.URL+"/")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "4 0123" {
+		t.Fatalf("unexpected truncated fetch %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestWorkerEmulator(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" {
+			conn, rw, _ := w.(http.Hijacker).Hijack()
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			rw.Flush()
+			buf := make([]byte, 4)
+			n, _ := rw.Read(buf)
+			conn.Write(buf[:n])
+			return
+		}
+		if r.Header.Get(workerTokenHeader) != "" {
+			t.Error("worker token leaked to target")
+		}
+		w.Write([]byte("hello " + r.URL.Path + " " + r.Header.Get("Authorization")))
+	}))
+	defer target.Close()
+	emu := httptest.NewServer(NewWorkerEmulator("secret", "TST", ""))
+	defer emu.Close()
+
+	e := newTestEngine(t)
+	wm := e.workers
+	if err := wm.AddWorker(Worker{URL: emu.URL}); err == nil {
+		t.Fatal("expected unauthenticated worker to fail")
+	}
+	if err := wm.AddWorker(Worker{URL: emu.URL, Token: "secret"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if h := wm.List()[0].Health; h.Colo != "TST" || !h.Supports(FeatureDoH) {
+		t.Fatalf("unexpected health %+v", h)
+	}
+
+	// forward through the local proxy
+	e.sess.start(Circuit{ID: 1}, Pool{})
+	proxy := httptest.NewServer(&workerProxy{e: e, token: "local"})
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	anon := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := anon.Get(target.URL + "/page")
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("expected proxy auth challenge: %v %v", resp, err)
+	}
+	resp.Body.Close()
+	proxyURL.User = url.UserPassword("torwell", "local")
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	req, _ := http.NewRequest(http.MethodGet, target.URL+"/page", nil)
+	req.Header.Set("Authorization", "Bearer site")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("proxy get: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello /page Bearer site" || resp.Header.Get(coloHeader) != "" {
+		t.Fatalf("unexpected proxied response %q %v", body, resp.Header)
+	}
+
+	// websocket relay
+	conn, err := net.Dial("tcp", strings.TrimPrefix(emu.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: emu\r\nX-Torwell-Worker-Token: secret\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n%s: ws%s/\r\n\r\n", targetHeader, strings.TrimPrefix(target.URL, "http"))
+	br := bufio.NewReader(conn)
+	wsResp, err := http.ReadResponse(br, nil)
+	if err != nil || wsResp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade failed: %v %v", wsResp, err)
+	}
+	conn.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(br, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("echo failed: %q %v", echo, err)
+	}
+}
+
+func TestWorkerCheckUnlocked(t *testing.T) {
+	// checks after the one on add hang until released
+	release, waiting := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	checks := 0
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		checks++
+		first := checks == 1
+		mu.Unlock()
+		if !first {
+			waiting <- struct{}{}
+			<-release
+		}
+	}))
+	defer slow.Close()
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	defer unblock()
+	wm := NewWorkerManager()
+	if err := wm.AddWorker(Worker{URL: slow.URL}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wm.CheckAll()
+		close(done)
+	}()
+	<-waiting
+	updated := make(chan error, 1)
+	go func() {
+		group := "eu"
+		updated <- wm.Update(slow.URL, WorkerUpdate{Group: &group})
+	}()
+	select {
+	case err := <-updated:
+		if err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("workers locked during the health check")
+	}
+	unblock()
+	<-done
+	if w := wm.List()[0]; !w.Active || w.Group != "eu" {
+		t.Fatalf("check result or update lost: %+v", w)
+	}
+}
+
+func TestWorkerQuota(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer srv.Close()
+	spare := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer spare.Close()
+
+	dir := t.TempDir()
+	usageFile := filepath.Join(dir, "usage.json")
+	wm := NewWorkerManager()
+	wm.LoadUsage(usageFile)
+	// health checks do not count toward the quota, forwarded requests do
+	if err := wm.AddWorker(Worker{URL: srv.URL, Quota: 4, SoftLimit: 0.75}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	wm.AddWorker(Worker{URL: spare.URL, Priority: 1})
+
+	wm.CheckAll()
+	for i := 0; i < 3; i++ {
+		if url, _ := wm.Next(); url != srv.URL {
+			t.Fatalf("expected preferred worker, got %s", url)
+		}
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+fetchPath, strings.NewReader("abc"))
+		resp, err := wm.Forward(srv.URL, req)
+		if err != nil {
+			t.Fatalf("forward: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	u := wm.List()[0].Usage
+	if u == nil || u.Requests != 3 || u.Bytes != 39 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+	if url, _ := wm.Next(); url != spare.URL {
+		t.Fatalf("expected worker near quota to be skipped, got %s", url)
+	}
+
+	// removing and adding the worker again keeps its usage for the day
+	wm.Remove(srv.URL)
+	if err := wm.AddWorker(Worker{URL: srv.URL, Quota: 4, SoftLimit: 0.75}); err != nil {
+		t.Fatalf("re-add: %v", err)
+	}
+	if got := wm.usage.Get(srv.URL); got.Requests != 3 {
+		t.Fatalf("usage reset by remove: %+v", got)
+	}
+	if url, _ := wm.Next(); url != spare.URL {
+		t.Fatalf("expected re-added worker to stay skipped, got %s", url)
+	}
+
+	// usage survives a restart
+	if err := wm.FlushUsage(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	wm2 := NewWorkerManager()
+	wm2.LoadUsage(usageFile)
+	if got := wm2.usage.Get(srv.URL); got.Requests != 3 {
+		t.Fatalf("usage not restored: %+v", got)
+	}
+
+	// counters of previous days are dropped
+	stale := map[string]WorkerUsage{srv.URL: {Day: "2000-01-01", Requests: 99}}
+	b, _ := json.Marshal(stale)
+	os.WriteFile(usageFile, b, 0600)
+	wm3 := NewWorkerManager()
+	wm3.LoadUsage(usageFile)
+	if got := wm3.usage.Get(srv.URL); got.Requests != 0 {
+		t.Fatalf("expected daily reset, got %+v", got)
+	}
+}
+
+func TestWorkerPersistence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "workers.json")
+	wm := NewWorkerManager()
+	if err := wm.Load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	if err := wm.Add(srv.URL); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	wm2 := NewWorkerManager()
+	if err := wm2.Load(path); err != nil {
+		t.Fatalf("load2: %v", err)
+	}
+	if len(wm2.List()) != 1 || wm2.List()[0].URL != srv.URL {
+		t.Fatalf("persistence failed: %v", wm2.List())
+	}
+
+	// checks only save when they change a worker
+	os.Remove(path)
+	wm.CheckAll()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("unchanged check saved workers: %v", err)
+	}
+	down.Store(true)
+	wm.CheckAll()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("failed check not saved: %v", err)
+	}
+}
+
+func TestWorkerTLSPinning(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+
+	wm := NewWorkerManager()
+	if err := wm.AddWorker(Worker{URL: srv.URL, TLS: &TLSPolicy{CAFile: ca}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	got := wm.List()[0]
+	if got.TLS == nil || len(got.TLS.Pins) != 1 || got.TLS.Pins[0] != spkiPin(srv.Certificate()) {
+		t.Fatalf("expected pin captured on first use: %+v", got.TLS)
+	}
+
+	// simulate a key change by pinning a different key
+	wm.workers[0].TLS.Pins = []string{"AAAA"}
+	wm.dropClient(srv.URL)
+	wm.CheckAll()
+	got = wm.List()[0]
+	if got.Active || got.Error != ErrPinMismatch.Error() {
+		t.Fatalf("expected pin mismatch, got %+v", got)
+	}
+
+	if err := wm.Repin(srv.URL); err != nil {
+		t.Fatalf("repin: %v", err)
+	}
+	got = wm.List()[0]
+	if !got.Active || got.TLS.Pins[0] != spkiPin(srv.Certificate()) {
+		t.Fatalf("repin failed: %+v", got)
+	}
+
+	// TLS 1.2 is refused by the default policy
+	srv12 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv12.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv12.StartTLS()
+	defer srv12.Close()
+	ca12 := filepath.Join(t.TempDir(), "ca12.pem")
+	os.WriteFile(ca12, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv12.Certificate().Raw}), 0600)
+	if err := wm.AddWorker(Worker{URL: srv12.URL, TLS: &TLSPolicy{CAFile: ca12}}); err == nil {
+		t.Fatal("expected tls 1.2 worker to be refused")
+	}
+	if err := wm.AddWorker(Worker{URL: srv12.URL, TLS: &TLSPolicy{CAFile: ca12, MinVersion: "1.2"}}); err != nil {
+		t.Fatalf("add tls 1.2: %v", err)
+	}
+}
+
+func TestAPIGuard(t *testing.T) {
+	dir := t.TempDir()
+	token, err := writeAPIToken(dir)
+	if err != nil {
+		t.Fatalf("token: %v", err)
+	}
+	info, _ := os.Stat(filepath.Join(dir, apiTokenFile))
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("token file mode %v", info.Mode())
+	}
+	g := newAPIGuard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), token, "127.0.0.1:9472")
+
+	cases := []struct {
+		name    string
+		method  string
+		host    string
+		headers map[string]string
+		want    int
+	}{
+		{"no token", "GET", "127.0.0.1:9472", nil, http.StatusUnauthorized},
+		{"bearer", "GET", "127.0.0.1:9472", map[string]string{"Authorization": "Bearer " + token}, http.StatusOK},
+		{"wrong token", "GET", "localhost:9472", map[string]string{"X-Torwell-Token": "nope"}, http.StatusUnauthorized},
+		{"rebinding", "GET", "evil.example:9472", map[string]string{"X-Torwell-Token": token}, http.StatusForbidden},
+		{"foreign origin", "POST", "127.0.0.1:9472", map[string]string{"X-Torwell-Token": token, "Origin": "https://evil.example"}, http.StatusForbidden},
+		{"tauri origin", "POST", "127.0.0.1:9472", map[string]string{"X-Torwell-Token": token, "Origin": "tauri://localhost", "Content-Type": "application/json"}, http.StatusOK},
+		{"preflight", "OPTIONS", "127.0.0.1:9472", map[string]string{"Origin": "tauri://localhost"}, http.StatusNoContent},
+		{"json post", "POST", "[::1]:9472", map[string]string{"Authorization": "Bearer " + token, "Content-Type": "application/json"}, http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/connect", nil)
+		req.Host = c.host
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		if w.Code != c.want {
+			t.Errorf("%s: expected %d, got %d", c.name, c.want, w.Code)
+		}
+		if c.name == "tauri origin" && w.Header().Get("Access-Control-Expose-Headers") != "Content-Disposition" {
+			t.Errorf("%s: bundle name not exposed", c.name)
+		}
+	}
+
+	// a form post carrying only safelisted headers is refused
+	req := httptest.NewRequest(http.MethodPost, "/connect", strings.NewReader("a=b"))
+	req.Host = "127.0.0.1:9472"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if !isSimpleRequest(req) {
+		t.Fatal("expected simple request")
+	}
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("simple post: expected 403, got %d", w.Code)
+	}
+	req.Header.Set("X-Torwell-Token", token)
+	if isSimpleRequest(req) {
+		t.Fatal("token header makes the request non-simple")
+	}
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	var spec struct {
+		Servers []struct{ URL string }
+		Paths   map[string]map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("parse spec: %v", err)
+	}
+	if len(spec.Servers) != 1 || !strings.HasSuffix(spec.Servers[0].URL, apiPrefix) {
+		t.Fatalf("unexpected servers %+v", spec.Servers)
+	}
+	documented := map[string]bool{}
+	for path, ops := range spec.Paths {
+		for method := range ops {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+	for _, rt := range newTestEngine(t).apiRoutes() {
+		key := rt.method + " " + rt.path
+		if !documented[key] {
+			t.Errorf("route %s missing from openapi.json", key)
+		}
+		delete(documented, key)
+	}
+	for key := range documented {
+		t.Errorf("openapi.json documents unknown route %s", key)
+	}
+}
+
+func TestAPIv1(t *testing.T) {
+	handler := newTestEngine(t).Handler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	decodeErr := func(w *httptest.ResponseRecorder) apiError {
+		var env struct{ Error apiError }
+		if err := json.NewDecoder(w.Body).Decode(&env); err != nil {
+			t.Fatalf("error envelope: %v", err)
+		}
+		return env.Error
+	}
+
+	if w := do(http.MethodGet, "/api/v1/status", ""); w.Code != http.StatusOK || w.Header().Get("Deprecation") != "" {
+		t.Fatalf("v1 status: %d %v", w.Code, w.Header())
+	}
+	w := do(http.MethodGet, "/status", "")
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "true" || !strings.Contains(w.Header().Get("Link"), "/api/v1/status") {
+		t.Fatalf("legacy alias: %d %v", w.Code, w.Header())
+	}
+
+	w = do(http.MethodGet, "/api/v1/connect", "")
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" || decodeErr(w).Code != codeMethodNotAllowed {
+		t.Fatalf("expected 405 envelope, got %d", w.Code)
+	}
+	w = do(http.MethodPost, "/api/v1/connect", "{")
+	if w.Code != http.StatusBadRequest || decodeErr(w).Code != codeInvalidJSON {
+		t.Fatalf("expected invalid json, got %d", w.Code)
+	}
+	w = do(http.MethodGet, "/api/v1/nope", "")
+	if w.Code != http.StatusNotFound || decodeErr(w).Code != codeNotFound {
+		t.Fatalf("expected 404 envelope, got %d", w.Code)
+	}
+	w = do(http.MethodGet, "/api/v1/openapi.json", "")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), openAPISpec) {
+		t.Fatalf("openapi: %d", w.Code)
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), APISocketFile)
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode: %v %v", info, err)
+	}
+	go http.Serve(l, newTestEngine(t).Handler())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://torwell84/api/v1/status")
+	if err != nil {
+		t.Fatalf("get over socket: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	pl := &peerCredListener{uid: 1000}
+	if !pl.allowed(1000) || !pl.allowed(0) || pl.allowed(1001) {
+		t.Fatal("unexpected peer policy")
+	}
+	if runtime.GOOS == "linux" && os.Getuid() != 0 {
+		// connections from other users are dropped
+		l.(*peerCredListener).uid = os.Getuid() + 1
+		client.CloseIdleConnections()
+		if _, err := client.Get("http://torwell84/api/v1/status"); err == nil {
+			t.Fatal("expected foreign uid to be refused")
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	e := newTestEngine(t)
+	dir := e.ConfigDir()
+	// the client discovers the token through the config directory
+	os.Setenv("TORWELL84_CONFIG", dir)
+	defer os.Unsetenv("TORWELL84_CONFIG")
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer worker.Close()
+
+	token, _ := writeAPIToken(dir)
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config.Handler = newAPIGuard(e.Handler(), token, srv.Listener.Addr().String())
+	srv.Start()
+	defer srv.Close()
+
+	c, err := client.Discover(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("discover: %v", err)
+	}
+	ctx := context.Background()
+	if err := c.AddWorker(ctx, client.AddWorkerRequest{URL: worker.URL, Group: "eu"}); err != nil {
+		t.Fatalf("add worker: %v", err)
+	}
+	if h, err := c.TestWorker(ctx, client.AddWorkerRequest{URL: worker.URL}); err != nil || h.Protocol != 1 {
+		t.Fatalf("test worker: %+v %v", h, err)
+	}
+	err = c.Connect(ctx, client.ConnectRequest{Group: "asia"})
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != codeUnknownGroup {
+		t.Fatalf("expected unknown group error, got %v", err)
+	}
+	if err := c.Connect(ctx, client.ConnectRequest{Exit: "US", Group: "eu"}); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	st, err := c.Status(ctx)
+	if err != nil || !st.Connected || st.Circuit == nil || st.Circuit.Worker != worker.URL {
+		t.Fatalf("status: %+v %v", st, err)
+	}
+	if err := c.SetConfig(ctx, client.Config{OBFS4: false, PreWarm: true}); err != nil {
+		t.Fatalf("set config: %v", err)
+	}
+	if cfg, _ := c.Config(ctx); cfg.OBFS4 {
+		t.Fatal("config not saved")
+	}
+	logs, err := c.Logs(ctx, "general", nil)
+	if err != nil || len(logs.Records) == 0 {
+		t.Fatalf("logs: %v %v", logs, err)
+	}
+	files, err := c.LogFiles(ctx)
+	if err != nil || len(files) == 0 {
+		t.Fatalf("log files: %v %v", files, err)
+	}
+
+	// without the token the request is refused
+	if _, err := client.New(srv.URL, "wrong").Status(ctx); !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %v", err)
+	}
+}
+
+func TestTorrcUpload(t *testing.T) {
+	e := newTestEngine(t)
+	dir := e.ConfigDir()
+
+	tor := filepath.Join(dir, "tor")
+	os.WriteFile(tor, []byte("#!/bin/sh\nexit 0"), 0755)
+	os.Setenv("TOR_BINARY", tor)
+	defer os.Unsetenv("TOR_BINARY")
+
+	handler := e.Handler()
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	fw, _ := w.CreateFormFile("file", "torrc")
+	fw.Write([]byte("SocksPort 9050"))
+	w.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/torrc", body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("upload failed: %d", resp.Code)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "torrc")); err != nil {
+		t.Fatalf("torrc not saved: %v", err)
+	}
+}
+
+func TestConfigEndpoints(t *testing.T) {
+	e := newTestEngine(t)
+	handler := e.Handler()
+
+	// get default config
+	req := httptest.NewRequest(http.MethodGet, "/config", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get config failed: %d", w.Code)
+	}
+	var c Config
+	json.NewDecoder(w.Body).Decode(&c)
+	if !c.OBFS4 || !c.PreWarm {
+		t.Fatalf("unexpected default config %+v", c)
+	}
+
+	// update config
+	body := strings.NewReader(`{"obfs4":false}`)
+	req = httptest.NewRequest(http.MethodPost, "/config", body)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("post config failed: %d", w.Code)
+	}
+
+	// verify saved value
+	req = httptest.NewRequest(http.MethodGet, "/config", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	json.NewDecoder(w.Body).Decode(&c)
+	if c.OBFS4 != false {
+		t.Fatalf("config not updated: %+v", c)
+	}
+	if data, _ := os.ReadFile(filepath.Join(e.ConfigDir(), "config.json")); !bytes.Contains(data, []byte(`"obfs4": false`)) {
+		t.Fatalf("config not saved: %s", data)
+	}
+}
+
+func TestConnectAndLogs(t *testing.T) {
+	e := newTestEngine(t)
+	handler := e.Handler()
+
+	// connect
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/connect", nil)
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !e.tor.(*stubTor).running {
+		t.Fatalf("connect: %d", w.Code)
+	}
+
+	// status
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/status", nil)
+	handler.ServeHTTP(w, req)
+	var st Status
+	json.NewDecoder(w.Body).Decode(&st)
+	if !st.Connected || st.Circuit == nil {
+		t.Fatalf("status not connected: %+v", st)
+	}
+
+	// logs
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/logs/general", nil)
+	handler.ServeHTTP(w, req)
+	var logs LogPage
+	json.NewDecoder(w.Body).Decode(&logs)
+	if len(logs.Records) == 0 || logs.Records[0].Component == "" {
+		t.Fatalf("expected logs, got %+v", logs)
+	}
+
+	// disconnect stops tor
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/disconnect", nil))
+	if w.Code != http.StatusOK || e.tor.(*stubTor).running {
+		t.Fatalf("disconnect: %d", w.Code)
+	}
+	e.Close()
+	data, _ := os.ReadFile(filepath.Join(e.ConfigDir(), "logs", "connection.log"))
+	if !bytes.Contains(data, []byte(`"level":"info","component":"session","message":"disconnected"`)) {
+		t.Fatalf("connection log not written: %s", data)
+	}
+}
+
+func TestConnectionState(t *testing.T) {
+	st := &stubTor{startErr: errors.New("no tor binary")}
+	e := newTestEngine(t, WithTor(st))
+	handler := e.Handler()
+	events, unsubscribe := e.Subscribe()
+	defer unsubscribe()
+	do := func(path string) (int, Status) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		code := w.Code
+		if code == http.StatusConflict {
+			var env struct{ Error apiError }
+			if json.NewDecoder(w.Body).Decode(&env); env.Error.Code != codeInvalidState {
+				t.Fatalf("%s: unexpected error %+v", path, env.Error)
+			}
+		}
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+		var status Status
+		json.NewDecoder(w.Body).Decode(&status)
+		return code, status
+	}
+
+	if code, _ := do("/disconnect"); code != http.StatusConflict {
+		t.Fatalf("disconnect while disconnected: %d", code)
+	}
+	code, status := do("/connect")
+	if code != http.StatusServiceUnavailable || status.State != StateError || status.LastError != "no tor binary" {
+		t.Fatalf("expected error state, got %d %+v", code, status.StateInfo)
+	}
+
+	// a failed attempt can be retried
+	st.startErr = nil
+	time.Sleep(5 * time.Millisecond)
+	code, status = do("/connect")
+	if code != http.StatusOK || status.State != StateConnected || !status.Connected || status.LastError == "" {
+		t.Fatalf("expected connected, got %d %+v", code, status.StateInfo)
+	}
+	if code, _ := do("/connect"); code != http.StatusConflict {
+		t.Fatalf("double connect: %d", code)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, status = do("/new-circuit"); status.DurationMs < 5 || time.Since(status.Since) < 5*time.Millisecond {
+		t.Fatalf("state age not reported: %+v", status.StateInfo)
+	}
+	code, status = do("/disconnect")
+	if code != http.StatusOK || status.State != StateDisconnected || status.Connected {
+		t.Fatalf("disconnect: %d %+v", code, status.StateInfo)
+	}
+
+	var states []string
+	for len(events) > 0 {
+		if ev := <-events; ev.Type == EventState {
+			states = append(states, string(ev.Data.(StateInfo).State))
+		}
+	}
+	want := "connecting,error,connecting,bootstrapping,connected,disconnecting,disconnected"
+	if got := strings.Join(states, ","); got != want {
+		t.Fatalf("state events %s, want %s", got, want)
+	}
+
+	// concurrent connects race for a single transition
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ok := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e.Connect(context.Background(), ConnectRequest{}) == nil {
+				mu.Lock()
+				ok++
+				mu.Unlock()
+			}
+			e.Status()
+		}()
+	}
+	wg.Wait()
+	if ok != 1 {
+		t.Fatalf("expected exactly one connect to win, got %d", ok)
+	}
+}
+
+// bootTor is a stub tor replaying bootstrap statuses.
+type bootTor struct {
+	stubTor
+	steps []BootstrapStatus
+}
+
+func (b *bootTor) Bootstrap(ctx context.Context, fn func(BootstrapStatus)) error {
+	for _, st := range b.steps {
+		fn(st)
+	}
+	if len(b.steps) == 0 || b.steps[len(b.steps)-1].Percent < 100 {
+		return errors.New("tor exited during bootstrap")
+	}
+	return nil
+}
+
+func TestConnectProgress(t *testing.T) {
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer worker.Close()
+	tor := &bootTor{steps: []BootstrapStatus{
+		{0, "starting", "Starting"},
+		{5, "conn", "Connecting to a relay"},
+		{15, "handshake_done", "Handshake with a relay done"},
+		{10, "conn_done", "late notice"},
+		{75, "enough_dirinfo", "Loaded enough directory info to build circuits"},
+		{90, "circuit_create", "Establishing a Tor circuit"},
+		{100, "done", "Done"},
+	}}
+	e := newTestEngine(t, WithTor(tor))
+	e.workers.Add(worker.URL)
+	events, unsubscribe := e.Subscribe()
+	defer unsubscribe()
+
+	if err := e.Connect(context.Background(), ConnectRequest{}); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	var percents, phases []string
+	last := -1
+	for len(events) > 0 {
+		ev := <-events
+		if ev.Type != EventProgress {
+			continue
+		}
+		p := ev.Data.(Progress)
+		if p.Percent < last || p.Attempt != 1 {
+			t.Fatalf("progress went backwards: %+v after %d", p, last)
+		}
+		last = p.Percent
+		percents = append(percents, fmt.Sprint(p.Percent))
+		if len(phases) == 0 || phases[len(phases)-1] != p.Phase {
+			phases = append(phases, p.Phase)
+		}
+	}
+	if got := strings.Join(percents, ","); got != "0,5,10,13,20,62,73,80,85,95,100" {
+		t.Fatalf("unexpected progress %s", got)
+	}
+	want := "connecting,handshake,establishing-circuit,attaching-worker,ready"
+	if got := strings.Join(phases, ","); got != want {
+		t.Fatalf("phases %s, want %s", got, want)
+	}
+	if p := e.Status().Progress; p.Percent != 100 || p.Phase != PhaseReady {
+		t.Fatalf("status progress %+v", p)
+	}
+
+	// a failed bootstrap keeps its progress and starts over on retry
+	e.Disconnect(context.Background())
+	tor.steps = tor.steps[:3]
+	if err := e.Connect(context.Background(), ConnectRequest{}); err == nil {
+		t.Fatal("expected bootstrap failure")
+	}
+	st := e.Status()
+	if st.State != StateError || st.Progress.Attempt != 2 || st.Progress.Percent != 20 || !strings.Contains(st.LastError, "bootstrap") {
+		t.Fatalf("unexpected status after failure: %+v %+v", st.StateInfo, st.Progress)
+	}
+	if tor.running {
+		t.Fatal("tor left running after failed bootstrap")
+	}
+}
+
+func TestTorBootstrapLog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell")
+	}
+	dir := t.TempDir()
+	script := filepath.Join(dir, "tor.sh")
+	os.WriteFile(script, []byte(`#!/bin/sh
+echo "May 01 10:00:00.000 [notice] Bootstrapped 0% (starting): Starting"
+echo "May 01 10:00:01.000 [notice] Bootstrapped 50% (loading_descriptors): Loading relay descriptors"
+echo "May 01 10:00:02.000 [notice] Bootstrapped 100% (done): Done"
+exec sleep 30
+`), 0755)
+	os.Setenv("TOR_BINARY", script)
+	defer os.Unsetenv("TOR_BINARY")
+
+	tp := &torProcess{dir: dir}
+	if err := tp.Bootstrap(context.Background(), func(BootstrapStatus) {}); err != errTorNotRunning {
+		t.Fatalf("expected not running, got %v", err)
+	}
+	if err := tp.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer tp.Stop(context.Background())
+	var seen []BootstrapStatus
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tp.Bootstrap(ctx, func(st BootstrapStatus) { seen = append(seen, st) }); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	last := seen[len(seen)-1]
+	if last != (BootstrapStatus{100, "done", "Done"}) {
+		t.Fatalf("unexpected statuses %+v", seen)
+	}
+}
+
+// slowTor bootstraps until its context ends while booting is set, and
+// follows events until its context ends, counting the followers.
+type slowTor struct {
+	stubTor
+	booting   chan struct{}
+	followers int
+}
+
+func (s *slowTor) Bootstrap(ctx context.Context, fn func(BootstrapStatus)) error {
+	if s.booting == nil {
+		return nil
+	}
+	s.booting <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *slowTor) Events(ctx context.Context, types []string, fn func(TorEvent)) error {
+	s.mu.Lock()
+	s.followers++
+	s.mu.Unlock()
+	<-ctx.Done()
+	s.mu.Lock()
+	s.followers--
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *slowTor) waitFollowers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		got := s.followers
+		s.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d tor event followers, got %d", n, got)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConnectLifecycle(t *testing.T) {
+	tor := &slowTor{booting: make(chan struct{})}
+	e := newTestEngine(t, WithTor(tor))
+
+	// the bootstrap outlives the request and ends with a disconnect
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- e.Connect(ctx, ConnectRequest{}) }()
+	<-tor.booting
+	cancel()
+	select {
+	case err := <-errc:
+		t.Fatalf("connect ended with its request: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := e.Connect(context.Background(), ConnectRequest{}); err == nil {
+		t.Fatal("expected a concurrent connect to be refused")
+	}
+	if err := e.Disconnect(context.Background()); err != nil {
+		t.Fatalf("disconnect: %v", err)
+	}
+	if err := <-errc; err == nil {
+		t.Fatal("expected the interrupted connect to fail")
+	}
+	tor.mu.Lock()
+	running := tor.running
+	tor.mu.Unlock()
+	if _, active := e.sess.current(); running || active || e.state.current() != StateDisconnected {
+		t.Fatalf("left running %v, session %v, state %s", running, active, e.state.current())
+	}
+	tor.waitFollowers(t, 0)
+
+	// every connection has a single follower, ended by the disconnect
+	tor.booting = nil
+	for i := 0; i < 3; i++ {
+		if err := e.Connect(context.Background(), ConnectRequest{}); err != nil {
+			t.Fatalf("connect %d: %v", i, err)
+		}
+		tor.waitFollowers(t, 1)
+		if err := e.Disconnect(context.Background()); err != nil {
+			t.Fatalf("disconnect %d: %v", i, err)
+		}
+		tor.waitFollowers(t, 0)
+	}
+}
+
+// pathTor reports a fixed circuit path.
+type pathTor struct {
+	stubTor
+	path []Relay
+}
+
+func (p *pathTor) CircuitPath(ctx context.Context) ([]Relay, error) {
+	return p.path, nil
+}
+
+func TestChain(t *testing.T) {
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"protocol":2,"colo":"FRA","features":["fetch"]}`))
+	}))
+	defer worker.Close()
+	lookup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("203.0.113.7\n"))
+	}))
+	defer lookup.Close()
+	tor := &pathTor{path: []Relay{
+		{"guard", "AAAA", "DE", "198.51.100.1"},
+		{"middle", "BBBB", "NL", "198.51.100.2"},
+		{"exit", "CCCC", "", "198.51.100.3"},
+	}}
+	e := newTestEngine(t, WithTor(tor), WithPublicIPLookup(lookup.URL))
+
+	// disconnected: every hop after the user is null
+	b, _ := json.Marshal(e.Status().Chain)
+	if !strings.Contains(string(b), `"entry":null,"middle":null,"exit":null,"worker":null`) {
+		t.Fatalf("unexpected chain %s", b)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { e.monitorIP(ctx, time.Hour); close(done) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Status().Chain.You == nil || e.Status().Chain.You.PublicIP == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("public ip not looked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if err := e.workers.Add(worker.URL); err != nil {
+		t.Fatalf("add worker: %v", err)
+	}
+	if err := e.Connect(context.Background(), ConnectRequest{}); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	ch := e.Status().Chain
+	if ch.You.PublicIP != "203.0.113.7" || ch.You.LocalIP != e.localIP() {
+		t.Fatalf("unexpected you %+v", ch.You)
+	}
+	if ch.Entry == nil || ch.Entry.Nickname != "guard" || ch.Middle == nil || ch.Middle.Country != "NL" || ch.Exit == nil || ch.Exit.Fingerprint != "CCCC" {
+		t.Fatalf("unexpected relays %+v %+v %+v", ch.Entry, ch.Middle, ch.Exit)
+	}
+	if ch.Worker == nil || ch.Worker.URL != worker.URL || ch.Worker.Colo != "FRA" {
+		t.Fatalf("unexpected worker %+v", ch.Worker)
+	}
+
+	e.Disconnect(context.Background())
+	if ch := e.Status().Chain; ch.Entry != nil || ch.Worker != nil || ch.You == nil {
+		t.Fatalf("chain kept after disconnect: %+v", ch)
+	}
+}
+
+func TestControlCircuitPath(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	replies := map[string]string{
+		"AUTHENTICATE 6b6579": "250 OK\r\n",
+		"GETINFO circuit-status": "250+circuit-status=\r\n" +
+			"3 BUILT $AAAA~guard,$BBBB~middle BUILD_FLAGS=IS_INTERNAL PURPOSE=HS_CLIENT_REND\r\n" +
+			"4 BUILT $AAAA~guard,$BBBB~middle,$CCCC~exit BUILD_FLAGS=NEED_CAPACITY PURPOSE=GENERAL\r\n" +
+			"5 EXTENDED $AAAA~guard PURPOSE=GENERAL\r\n.\r\n250 OK\r\n",
+		"GETINFO ns/id/AAAA":                 "250+ns/id/AAAA=\r\nr guard qq rr 2024-05-01 10:00:00 198.51.100.1 443 0\r\ns Guard Running\r\n.\r\n250 OK\r\n",
+		"GETINFO ns/id/BBBB":                 "552 Unrecognized key\r\n",
+		"GETINFO ns/id/CCCC":                 "250+ns/id/CCCC=\r\nr exit qq rr 2024-05-01 10:00:00 198.51.100.3 9001 0\r\n.\r\n250 OK\r\n",
+		"GETINFO ip-to-country/198.51.100.1": "250-ip-to-country/198.51.100.1=de\r\n250 OK\r\n",
+		"GETINFO ip-to-country/198.51.100.3": "250-ip-to-country/198.51.100.3=??\r\n250 OK\r\n",
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			reply, ok := replies[sc.Text()]
+			if !ok {
+				reply = "510 Unrecognized command\r\n"
+			}
+			io.WriteString(conn, reply)
+		}
+	}()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, controlPortFile), []byte("PORT="+l.Addr().String()+"\n"), 0600)
+	os.WriteFile(filepath.Join(dir, controlCookieFile), []byte("key"), 0600)
+	ctx := context.Background()
+	c, err := dialControl(ctx, dir)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	path, err := c.circuitPath(ctx)
+	if err != nil {
+		t.Fatalf("path: %v", err)
+	}
+	want := []Relay{
+		{"guard", "AAAA", "DE", "198.51.100.1"},
+		{"middle", "BBBB", "", ""},
+		{"exit", "CCCC", "", "198.51.100.3"},
+	}
+	if fmt.Sprint(path) != fmt.Sprint(want) {
+		t.Fatalf("path %+v, want %+v", path, want)
+	}
+	if _, err := c.do(ctx, "SIGNAL BOGUS"); err == nil || !strings.Contains(err.Error(), "510") {
+		t.Fatalf("expected command error, got %v", err)
+	}
+}
+
+// eventTor replays control port events once tor starts.
+type eventTor struct {
+	stubTor
+	events []TorEvent
+	types  []string
+}
+
+func (s *eventTor) Events(ctx context.Context, types []string, fn func(TorEvent)) error {
+	s.mu.Lock()
+	s.types = types
+	s.mu.Unlock()
+	for _, ev := range s.events {
+		fn(ev)
+	}
+	fn(TorEvent{Type: "NOTICE", Text: "done"})
+	return nil
+}
+
+func TestTorEvents(t *testing.T) {
+	tor := &eventTor{events: []TorEvent{
+		{"NOTICE", "Bootstrapped 5% (conn): Connecting to a relay"},
+		{"NOTICE", "Opening Socks listener on 127.0.0.1:9050"},
+		{"WARN", "Problem bootstrapping. Stuck at 5%"},
+		{"WARN", "Problem bootstrapping. Stuck at 5%"},
+		{"WARN", "Problem bootstrapping. Stuck at 5%"},
+		{"STATUS_CLIENT", "NOTICE BOOTSTRAP PROGRESS=5 TAG=conn SUMMARY=\"Connecting to a relay\""},
+		{"STATUS_CLIENT", "NOTICE CIRCUIT_ESTABLISHED"},
+		{"STATUS_GENERAL", `WARN CLOCK_SKEW SKEW=-3600 SOURCE="NETWORKSTATUS:relay \"one\""`},
+		{"ERR", "Could not bind"},
+	}}
+	e := newTestEngine(t, WithTor(tor))
+	if err := e.Connect(context.Background(), ConnectRequest{}); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logMessages(e.connLog.list(logFilter{components: []string{compTor}})), "done") {
+		if time.Now().After(deadline) {
+			t.Fatal("tor events not logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tor.mu.Lock()
+	types := strings.Join(tor.types, " ")
+	tor.mu.Unlock()
+	if types != "NOTICE WARN ERR STATUS_CLIENT STATUS_GENERAL CIRC BW STREAM STREAM_BW" {
+		t.Fatalf("subscribed to %s", types)
+	}
+
+	conn := e.connLog.list(logFilter{level: LevelInfo, components: []string{compTor}})
+	if got, want := logMessages(conn), "Opening Socks listener on 127.0.0.1:9050,Problem bootstrapping. Stuck at 5%,circuit established,clock skew,Could not bind,done"; got != want {
+		t.Fatalf("connection log %q, want %q", got, want)
+	}
+	gen := e.genLog.list(logFilter{components: []string{compTor}})
+	if got, want := logMessages(gen), "Problem bootstrapping. Stuck at 5%,clock skew,Could not bind"; got != want {
+		t.Fatalf("general log %q, want %q", got, want)
+	}
+	if r := gen[1]; r.Level != LevelWarn || r.Fields["event"] != "STATUS_GENERAL" || r.Fields["skew"] != "-3600" || r.Fields["source"] != `NETWORKSTATUS:relay "one"` {
+		t.Fatalf("unexpected status record %+v", r)
+	}
+	if gen[0].Level != LevelWarn || gen[2].Level != LevelError {
+		t.Fatalf("unexpected levels %v %v", gen[0].Level, gen[2].Level)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("0123456789"))
+	}))
+	defer target.Close()
+	emu := httptest.NewServer(NewWorkerEmulator("secret", "TST", ""))
+	defer emu.Close()
+
+	tor := &eventTor{events: []TorEvent{
+		{"CIRC", "1 LAUNCHED BUILD_FLAGS=NEED_CAPACITY"},
+		{"CIRC", "1 BUILT $AAAA~relay PURPOSE=GENERAL"},
+		{"CIRC", "2 BUILT $BBBB~relay PURPOSE=GENERAL"},
+		{"CIRC", "3 FAILED REASON=TIMEOUT"},
+	}}
+	e := newTestEngine(t, WithTor(tor))
+	if err := e.workers.AddWorker(Worker{URL: emu.URL, Token: "secret"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := e.Connect(context.Background(), ConnectRequest{}); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for e.metrics.circuitsFailed.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("circuit events not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	proxy := httptest.NewServer(&workerProxy{e: e, token: "local"})
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("torwell", "local")
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Post(target.URL, "text/plain", strings.NewReader("abcd"))
+	if err != nil {
+		t.Fatalf("proxy post: %v", err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	for _, path := range []string{"/metrics", "/api/v1/metrics"} {
+		w := httptest.NewRecorder()
+		e.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != metricsContentType {
+			t.Fatalf("%s: %d %s", path, w.Code, w.Header().Get("Content-Type"))
+		}
+		if w.Header().Get("Deprecation") != "" {
+			t.Fatalf("%s marked deprecated", path)
+		}
+		body := w.Body.String()
+		for _, want := range []string{
+			"# TYPE torwell84_connection_state gauge",
+			`torwell84_connection_state{state="connected"} 1`,
+			`torwell84_connection_state{state="disconnected"} 0`,
+			"torwell84_bootstrap_duration_seconds_count 1",
+			`torwell84_bootstrap_duration_seconds_bucket{le="+Inf"} 1`,
+			"torwell84_circuits_built_total 2",
+			"torwell84_circuits_failed_total 1",
+			"torwell84_circuits_pooled ",
+			fmt.Sprintf(`torwell84_worker_up{worker=%q} 1`, emu.URL),
+			fmt.Sprintf(`torwell84_worker_health_checks_total{worker=%q,result="ok"} 1`, emu.URL),
+			fmt.Sprintf(`torwell84_worker_selections_total{worker=%q} `, emu.URL),
+			"torwell84_dns_cache_hits_total 0",
+			"torwell84_proxy_streams_total 1",
+			"torwell84_proxy_streams_active 0",
+			`torwell84_proxy_bytes_total{direction="sent"} 4`,
+			`torwell84_proxy_bytes_total{direction="received"} 10`,
+			`torwell84_log_records_dropped_total{log="general"} 0`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Fatalf("%s: missing %q in\n%s", path, want, body)
+			}
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		spans []otlpSpan
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if r.URL.Path != tracesPath || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected export %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+	emu := httptest.NewServer(NewWorkerEmulator("secret", "TST", ""))
+	defer emu.Close()
+
+	e := newTestEngine(t, WithTor(&pathTor{}))
+	handler := e.Handler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/config", strings.NewReader(`{"tracing":{"endpoint":"http://collector.example:4318"}}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("remote collector accepted: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/config", strings.NewReader(`{"tracing":{"endpoint":"`+collector.URL+`"}}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("set tracing: %d %s", w.Code, w.Body)
+	}
+	if err := e.workers.AddWorker(Worker{URL: emu.URL, Token: "secret"}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	const trace, parent = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/connect", nil)
+	req.Header.Set("traceparent", "00-"+trace+"-"+parent+"-01")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get(requestIDHeader) != trace {
+		t.Fatalf("connect: %d request id %q", w.Code, w.Header().Get(requestIDHeader))
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/status", nil))
+	if id := w.Header().Get(requestIDHeader); len(id) != 32 || id == trace {
+		t.Fatalf("status request id %q", id)
+	}
+	var tagged int
+	for _, r := range append(e.connLog.list(logFilter{}), e.genLog.list(logFilter{})...) {
+		if r.Component == compSession && r.Message != "disconnected" {
+			if r.Fields["request_id"] != trace || r.Fields["span_id"] == nil {
+				t.Fatalf("record without request id %+v", r)
+			}
+			tagged++
+		}
+	}
+	if tagged == 0 {
+		t.Fatal("no connect records")
+	}
+	e.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	byName := map[string]otlpSpan{}
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	conn := byName["connect"]
+	if conn.TraceID != trace || conn.ParentSpanID != parent || conn.Kind != spanServer || conn.Status.Code != statusOK {
+		t.Fatalf("unexpected connect span %+v", conn)
+	}
+	for _, name := range []string{"tor.start", "circuit.acquire", "worker.select", "tor.circuit_path"} {
+		if s, ok := byName[name]; !ok || s.TraceID != trace || s.ParentSpanID != conn.SpanID {
+			t.Fatalf("span %s %+v not a child of connect", name, s)
+		}
+	}
+	hc := byName["worker.health_check"]
+	if hc.TraceID == trace || hc.ParentSpanID != "" {
+		t.Fatalf("health check joined the connect trace %+v", hc)
+	}
+	for _, a := range append(hc.Attributes, byName["worker.select"].Attributes...) {
+		if a.Key == "worker" && (a.Value.String == nil || !strings.HasPrefix(*a.Value.String, "worker-")) {
+			t.Fatalf("worker attribute not scrubbed: %+v", a.Value)
+		}
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	e := newTestEngine(t)
+	b := e.bandwidth
+	now := time.Unix(1_699_999_980, 0) // on a minute
+	b.now = func() time.Time { return now }
+	for _, ev := range []TorEvent{
+		{"BW", "3000 1000"},
+		{"STREAM", "7 NEW 0 example.com:443 SOURCE_ADDR=127.0.0.1:5000 PURPOSE=USER"},
+		{"STREAM", "7 SUCCEEDED 12 93.184.216.34:443"},
+		{"STREAM_BW", "7 200 1800 2024-05-01T10:00:00.000000"},
+		{"STREAM_BW", "8 5 5 2024-05-01T10:00:00.000000"},
+		{"STREAM", "7 CLOSED 12 93.184.216.34:443 REASON=DONE"},
+		{"STREAM_BW", "7 10 10 2024-05-01T10:00:00.000000"},
+	} {
+		b.torEvent(ev)
+	}
+	b.proxy("https://w.example", 500, 100)
+	now = now.Add(61 * time.Second)
+	b.torEvent(TorEvent{"BW", "600 0"})
+
+	// the update covers the last second, then one zero update once idle
+	now = now.Add(time.Second)
+	u, ok := b.update()
+	if !ok || u.Tor.Read != 600 || u.Circuits != nil || u.Workers != nil {
+		t.Fatalf("unexpected update %v %+v", ok, u)
+	}
+	now = now.Add(time.Second)
+	if u, ok := b.update(); !ok || u.Tor.Read != 0 {
+		t.Fatalf("expected a zero update, got %v %+v", ok, u)
+	}
+	if _, ok := b.update(); ok {
+		t.Fatal("idle engine keeps publishing")
+	}
+
+	now = now.Add(time.Minute)
+	w := httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/stats/bandwidth?resolution=1m", nil))
+	var st BandwidthStats
+	if err := json.NewDecoder(w.Body).Decode(&st); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("stats: %d %v", w.Code, err)
+	}
+	samples := st.Tor.Samples
+	if st.Resolution != "1m" || len(samples) != 119 || st.Tor.ReadBytes != 3600 || st.Tor.WrittenBytes != 1000 {
+		t.Fatalf("unexpected tor series %+v", st.Tor)
+	}
+	// 3000 bytes in the minute before last, 600 in the last one
+	if last := samples[len(samples)-1]; last.Read != 10 || samples[len(samples)-2].Read != 50 || !last.Time.Equal(time.Unix(1_700_000_040, 0)) {
+		t.Fatalf("unexpected minute samples %+v %+v", samples[len(samples)-2], last)
+	}
+	if c := st.Circuits["12"]; len(st.Circuits) != 1 || c.ReadBytes != 1800 || c.WrittenBytes != 200 {
+		t.Fatalf("unexpected circuits %+v", st.Circuits)
+	}
+	if wk := st.Workers["https://w.example"]; wk.ReadBytes != 500 || wk.WrittenBytes != 100 {
+		t.Fatalf("unexpected workers %+v", st.Workers)
+	}
+	w = httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/stats/bandwidth?resolution=5s", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown resolution: %d", w.Code)
+	}
+
+	// slots older than the ring read as zero
+	now = now.Add(3 * time.Minute)
+	if st, _ := b.stats("1s"); st.Tor.Samples[len(st.Tor.Samples)-1].Read != 0 || st.Tor.ReadBytes != 3600 {
+		t.Fatalf("stale samples %+v", st.Tor)
+	}
+
+	srv := httptest.NewServer(e.Handler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/api/v1/stats/bandwidth/stream")
+	if err != nil || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("stream: %v", err)
+	}
+	defer resp.Body.Close()
+	e.publish(EventState, e.state.info())
+	e.publish(EventBandwidth, BandwidthUpdate{Tor: BandwidthSample{Read: 42}})
+	r := bufio.NewReader(resp.Body)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+		if v, ok := strings.CutPrefix(line, "data: "); ok {
+			var u BandwidthUpdate
+			if json.Unmarshal([]byte(v), &u); u.Tor.Read != 42 {
+				t.Fatalf("unexpected event %s", v)
+			}
+			break
+		}
+	}
+}
+
+func TestRepeatLimiter(t *testing.T) {
+	now := time.Now()
+	rl := newRepeatLimiter(time.Minute)
+	rl.now = func() time.Time { return now }
+	if ok, _ := rl.allow("a"); !ok {
+		t.Fatal("first message held back")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.allow("a"); ok {
+			t.Fatal("repeat let through")
+		}
+	}
+	if ok, _ := rl.allow("b"); !ok {
+		t.Fatal("other message held back")
+	}
+	now = now.Add(time.Minute)
+	if ok, n := rl.allow("a"); !ok || n != 3 {
+		t.Fatalf("after the window: %v %d", ok, n)
+	}
+}
+
+func TestControlEvents(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			switch {
+			case strings.HasPrefix(sc.Text(), "AUTHENTICATE"):
+				io.WriteString(conn, "250 OK\r\n")
+			case sc.Text() == "SETEVENTS WARN STATUS_CLIENT":
+				io.WriteString(conn, "250 OK\r\n650 WARN Guard is down\r\n"+
+					"650+WARN\r\nfirst line\r\n..dotted\r\n.\r\n650 OK\r\n"+
+					"650 STATUS_CLIENT NOTICE CIRCUIT_ESTABLISHED\r\n")
+				return
+			}
+		}
+	}()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, controlPortFile), []byte("PORT="+l.Addr().String()+"\n"), 0600)
+	os.WriteFile(filepath.Join(dir, controlCookieFile), []byte("key"), 0600)
+	c, err := dialControl(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	var got []TorEvent
+	err = c.subscribe(context.Background(), []string{"WARN", "STATUS_CLIENT"}, func(ev TorEvent) { got = append(got, ev) })
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	want := []TorEvent{{"WARN", "Guard is down"}, {"WARN", "first line\n.dotted"}, {"STATUS_CLIENT", "NOTICE CIRCUIT_ESTABLISHED"}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("events %q, want %q", got, want)
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	dir := t.TempDir()
+	lw, err := newLogWriter(dir, "test", defaultLogConfig())
+	if err != nil {
+		t.Fatalf("newLogWriter: %v", err)
+	}
+	lw.Write(LogRecord{Time: time.Now(), Level: LevelInfo, Component: "test", Message: "one"})
+	lw.Write(LogRecord{Time: time.Now(), Level: LevelWarn, Component: "test", Message: "two", Fields: map[string]interface{}{"n": 2}})
+	lw.Close()
+	data, err := os.ReadFile(filepath.Join(dir, "test.log"))
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	var got []LogRecord
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var r LogRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			t.Fatalf("not a JSON line %q: %v", line, err)
+		}
+		got = append(got, r)
+	}
+	if len(got) != 2 || got[0].Message != "one" || got[1].Level != LevelWarn || got[1].Fields["n"] != 2.0 {
+		t.Fatalf("unexpected records %+v", got)
+	}
+}
+
+func TestLogRetention(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "test.log"), []byte(`{"message":"previous run"}`+"\n"), 0600)
+	old := filepath.Join(dir, "test-20200101-000000.log.gz")
+	os.WriteFile(old, nil, 0600)
+	os.Chtimes(old, time.Now().AddDate(0, 0, -30), time.Now().AddDate(0, 0, -30))
+
+	cfg := LogConfig{MaxSizeMB: 1, MaxFiles: 2, MaxAgeDays: 7, Compress: true, RotateOnStart: true}
+	lw, err := newLogWriter(dir, "test", cfg)
+	if err != nil {
+		t.Fatalf("newLogWriter: %v", err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatalf("expired file kept: %v", err)
+	}
+	// each record is over half the limit, so every second one rotates
+	big := strings.Repeat("x", 600<<10)
+	for i := 0; i < 6; i++ {
+		lw.Write(LogRecord{Level: LevelInfo, Component: "test", Message: big})
+	}
+	lw.Close()
+
+	rotated, _ := filepath.Glob(filepath.Join(dir, "test-*"))
+	if len(rotated) != 2 {
+		t.Fatalf("expected 2 rotated files, got %v", rotated)
+	}
+	for _, name := range rotated {
+		if !strings.HasSuffix(name, ".log.gz") {
+			t.Fatalf("rotated file not compressed: %s", name)
+		}
+		f, _ := os.Open(name)
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		data, _ := io.ReadAll(zr)
+		f.Close()
+		if !bytes.Contains(data, []byte(`"message":"xxx`)) {
+			t.Fatalf("%s: unexpected content %.40q", name, data)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "test.log")); bytes.Contains(data, []byte("previous run")) {
+		t.Fatal("previous run not rotated on start")
+	}
+
+	e := newTestEngine(t)
+	w := httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/config", strings.NewReader(`{"logs":{"maxFiles":-1}}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("negative limit: expected 400, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/config", strings.NewReader(`{"logs":{"maxFiles":1}}`)))
+	if c := e.getConfig(); w.Code != http.StatusOK || c.Logs.MaxFiles != 1 || c.Logs.MaxSizeMB != 1 || !c.OBFS4 {
+		t.Fatalf("partial update: %d %+v", w.Code, c)
+	}
+}
+
+func TestLogBackpressure(t *testing.T) {
+	dir := t.TempDir()
+	lw, err := newLogWriter(dir, "test", defaultLogConfig())
+	if err != nil {
+		t.Fatalf("newLogWriter: %v", err)
+	}
+	// stall the writer so the queue fills up
+	lw.mu.Lock()
+	const n = logQueueSize + 100
+	for i := 0; i < n; i++ {
+		lw.Write(LogRecord{Level: LevelInfo, Component: "test", Message: "m"})
+	}
+	st := lw.stats()
+	lw.mu.Unlock()
+	if st.Dropped < 99 || st.Queued+int(st.Dropped) > n {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	lw.Close()
+
+	data, _ := os.ReadFile(filepath.Join(dir, "test.log"))
+	if lines := bytes.Count(data, []byte("\n")); uint64(lines) != n-st.Dropped+1 {
+		t.Fatalf("expected %d lines, got %d", n-st.Dropped+1, lines)
+	}
+	if !bytes.Contains(data, []byte(fmt.Sprintf(`"message":"log entries dropped","fields":{"count":%d}`, st.Dropped))) {
+		t.Fatalf("drop not noted in the file")
+	}
+
+	e := newTestEngine(t)
+	w := httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/logs/stats", nil))
+	var rep LogStatsReport
+	if err := json.NewDecoder(w.Body).Decode(&rep); err != nil || w.Code != http.StatusOK || rep.General.Dropped != 0 {
+		t.Fatalf("log stats: %d %+v %v", w.Code, rep, err)
+	}
+}
+
+func TestLogSinks(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	dir := t.TempDir()
+	embedded := newRingSink(10)
+	e := newTestEngine(t, WithLogSink("embedded", embedded, LevelError))
+	handler := e.Handler()
+
+	body := fmt.Sprintf(`{"logSinks":[
+		{"type":"file","level":"debug"},
+		{"name":"mem","type":"memory","level":"warn","logs":["general"],"size":2},
+		{"type":"syslog","level":"info","network":"udp","address":%q,"facility":"local0"},
+		{"name":"other","type":"file","logs":["connection"],"dir":%q}]}`, pc.LocalAddr().String(), dir)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/config", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("set sinks: %d %s", w.Code, w.Body)
+	}
+	e.genLog.info(compEngine, "hello", "note", `a "b"]`)
+	e.genLog.warn(compTor, "w1")
+	e.genLog.warn(compTor, "w2")
+	e.genLog.error(compTor, "w3")
+	e.connLog.debug(compTor, "dbg")
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("syslog: %v", err)
+	}
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<134>1 ") || !strings.HasSuffix(msg, ` torwell84 `+strconv.Itoa(os.Getpid())+` general [torwell84@32473 component="engine" note="a \"b\"\]"] hello`) {
+		t.Fatalf("unexpected syslog message %q", msg)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/logs/sinks/mem", nil))
+	var recs []SinkRecord
+	json.NewDecoder(w.Body).Decode(&recs)
+	if len(recs) != 2 || recs[0].Log != "general" || recs[0].Message != "w2" || recs[1].Level != LevelError {
+		t.Fatalf("memory sink %d %+v", w.Code, recs)
+	}
+	if got := embedded.Records(); len(got) != 1 || got[0].Message != "w3" {
+		t.Fatalf("embedded sink %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/logs/sinks", nil))
+	var sinks []SinkInfo
+	json.NewDecoder(w.Body).Decode(&sinks)
+	var names []string
+	for _, s := range sinks {
+		names = append(names, fmt.Sprintf("%s:%d", s.SinkConfig.name(), s.Written))
+	}
+	if got := strings.Join(names, " "); got != "file:5 mem:3 syslog:4 other:1 embedded:1" {
+		t.Fatalf("sinks %s", got)
+	}
+
+	for _, bad := range []string{`{"type":"bogus"}`, `{"type":"memory"},{"type":"memory"}`, `{"type":"file","logs":["tor"]}`, `{"type":"syslog","network":"tcp"}`} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/config", strings.NewReader(`{"logSinks":[`+bad+`]}`)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", bad, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/logs/sinks/file", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("file sink records: expected 404, got %d", w.Code)
+	}
+
+	e.sinks.close()
+	if data, _ := os.ReadFile(filepath.Join(dir, "connection.log")); !bytes.Contains(data, []byte(`"message":"dbg"`)) {
+		t.Fatalf("other file sink: %s", data)
+	}
+	if fileExists(filepath.Join(dir, "general.log")) {
+		t.Fatal("other file sink wrote the general log")
+	}
+}
+
+func TestTextSink(t *testing.T) {
+	var buf bytes.Buffer
+	ts := &textSink{w: &buf}
+	ts.Write("general", LogRecord{
+		Time:      time.Date(2024, 5, 1, 10, 0, 5, 0, time.UTC),
+		Level:     LevelWarn,
+		Component: compSession,
+		Message:   "failover",
+		Fields:    map[string]interface{}{"circuit": 4, "reason": "health check failed"},
+	})
+	if got, want := buf.String(), "2024-05-01T10:00:05Z WARN  general session: failover circuit=4 reason=\"health check failed\"\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestLogFilter(t *testing.T) {
+	e := newTestEngine(t)
+	// the query matches the raw target below
+	e.updateConfig(Config{LogPrivacy: PrivacyOff})
+	e.genLog.debug(compTor, "dropped below info")
+	e.genLog.info(compSession, "first", "circuit", 1)
+	e.genLog.warn(compTor, "second")
+	e.genLog.error(compWorker, "third", "target", "https://w")
+	// spread the records so the time range is unambiguous
+	base := time.Now().Add(-time.Hour)
+	for i := range e.genLog.records {
+		e.genLog.records[i].Time = base.Add(time.Duration(i) * time.Minute)
+	}
+	mid := base.Add(time.Minute)
+	handler := e.Handler()
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"", "first,second,third"},
+		{"?level=WARN", "second,third"},
+		{"?component=tor,worker", "second,third"},
+		{"?component=session&component=worker&level=error", "third"},
+		{"?since=" + url.QueryEscape(mid.Format(time.RFC3339Nano)), "second,third"},
+		{"?until=" + url.QueryEscape(mid.Format(time.RFC3339Nano)), "first"},
+		{"?since=90m", "first,second,third"},
+		{"?until=59m", "first,second"},
+		{"?q=HTTPS://W", "third"},
+		{"?q=circuit=1", "first"},
+		{"?q=TOR", "second"},
+		{"?order=desc", "third,second,first"},
+	} {
+		if got := logMessages(getLogs(t, handler, "general"+tc.query).Records); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.query, got, tc.want)
+		}
+	}
+	for _, q := range []string{"?level=loud", "?since=yesterday", "?cursor=x", "?limit=0", "?limit=1001", "?order=up"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/logs/connection"+q, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", q, w.Code)
+		}
+	}
+}
+
+// getLogs fetches a page of /logs/<query>.
+func getLogs(t *testing.T, handler http.Handler, query string) LogPage {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/logs/"+query, nil))
+	var p LogPage
+	if err := json.NewDecoder(w.Body).Decode(&p); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("%s: %d %v", query, w.Code, err)
+	}
+	return p
+}
+
+func logMessages(recs []LogRecord) string {
+	var msgs []string
+	for _, r := range recs {
+		msgs = append(msgs, r.Message)
+	}
+	return strings.Join(msgs, ",")
+}
+
+func TestLogPagination(t *testing.T) {
+	e := newTestEngine(t)
+	for i := 0; i < 250; i++ {
+		e.connLog.debug(compTor, fmt.Sprintf("m%d", i))
+	}
+	handler := e.Handler()
+
+	// forward pages of the default size until next is empty
+	var seen int
+	var last uint64
+	for cursor, pages := "", 0; ; pages++ {
+		p := getLogs(t, handler, "connection?cursor="+cursor)
+		for _, r := range p.Records {
+			if r.Seq <= last {
+				t.Fatalf("records out of order: %d after %d", r.Seq, last)
+			}
+			last = r.Seq
+		}
+		seen += len(p.Records)
+		if p.Next == "" {
+			if seen != 250 || pages != 2 {
+				t.Fatalf("saw %d records in %d pages", seen, pages+1)
+			}
+			break
+		}
+		cursor = p.Next
+	}
+
+	// backward from the newest
+	p := getLogs(t, handler, "connection?order=desc&limit=2")
+	if logMessages(p.Records) != "m249,m248" || p.Next == "" {
+		t.Fatalf("unexpected newest page %+v", p)
+	}
+	p = getLogs(t, handler, "connection?order=desc&limit=2&cursor="+p.Next)
+	if logMessages(p.Records) != "m247,m246" {
+		t.Fatalf("unexpected second page %+v", p)
+	}
+	// the cursor pages over matching records only
+	p = getLogs(t, handler, "connection?q=m24&limit=5")
+	if logMessages(p.Records) != "m24,m240,m241,m242,m243" {
+		t.Fatalf("unexpected search page %s", logMessages(p.Records))
+	}
+	p = getLogs(t, handler, "connection?q=m24&limit=5&cursor="+p.Next)
+	if logMessages(p.Records) != "m244,m245,m246,m247,m248" || p.Next == "" {
+		t.Fatalf("unexpected search page %s", logMessages(p.Records))
+	}
+}
+
+func TestLogStream(t *testing.T) {
+	e := newTestEngine(t)
+	e.genLog.info(compEngine, "before")
+	srv := httptest.NewServer(e.Handler())
+	defer srv.Close()
+
+	// read returns the data of the next n log events on the stream
+	open := func(query string, lastID string) (*bufio.Reader, func()) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/logs/general/stream"+query, nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("stream: %v %+v", err, resp)
+		}
+		return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+	}
+	next := func(r *bufio.Reader) (id string, rec LogRecord) {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read stream: %v", err)
+			}
+			if v, ok := strings.CutPrefix(line, "id: "); ok {
+				id = strings.TrimSpace(v)
+			}
+			if v, ok := strings.CutPrefix(line, "data: "); ok {
+				json.Unmarshal([]byte(v), &rec)
+				return id, rec
+			}
+		}
+	}
+
+	r, closeStream := open("?level=warn", "")
+	defer closeStream()
+	e.genLog.info(compEngine, "filtered")
+	e.genLog.warn(compTor, "live")
+	id, rec := next(r)
+	if rec.Message != "live" || id != fmt.Sprint(rec.Seq) {
+		t.Fatalf("unexpected event %s %+v", id, rec)
+	}
+
+	// a reconnect replays what was missed after Last-Event-ID
+	r2, closeReplay := open("", "1")
+	defer closeReplay()
+	if _, rec := next(r2); rec.Message != "filtered" {
+		t.Fatalf("expected replay from cursor, got %+v", rec)
+	}
+
+	// shutdown ends open streams
+	e.Close()
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatalf("stream not closed cleanly: %v", err)
+	}
+}
+
+func TestLogFiles(t *testing.T) {
+	e := newTestEngine(t)
+	e.genLog.info(compEngine, "on disk")
+	e.sinks.close()
+	os.WriteFile(filepath.Join(e.logDir(), "general-20240501-100000.log"), []byte(`{"seq":1}`+"\n"), 0600)
+	os.WriteFile(filepath.Join(e.logDir(), "notes.txt"), []byte("x"), 0600)
+	handler := e.Handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/logs/files", nil))
+	var files []LogFile
+	json.NewDecoder(w.Body).Decode(&files)
+	names := map[string]bool{}
+	for _, f := range files {
+		names[f.Name] = true
+	}
+	if !names["general.log"] || !names["connection.log"] || !names["general-20240501-100000.log"] || names["notes.txt"] {
+		t.Fatalf("unexpected files %+v", files)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/logs/files/general.log", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"message":"on disk"`) || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("read file: %d %s", w.Code, w.Body)
+	}
+	for _, name := range []string{"notes.txt", "..%2Fconfig.json", "general-1.log"} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/logs/files/"+name, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", name, w.Code)
+		}
+	}
+}
+
+func TestClearLogs(t *testing.T) {
+	e := newTestEngine(t)
+	handler := e.Handler()
+	e.connLog.info(compSession, "one")
+	e.genLog.info(compSession, "two")
+	rotated := filepath.Join(e.logDir(), "general-20240501-100000.log")
+	os.WriteFile(rotated, []byte("{}\n"), 0600)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/logs/connection", nil))
+	if w.Code != http.StatusNoContent || len(e.connLog.list(logFilter{})) != 0 || len(e.genLog.list(logFilter{})) != 1 {
+		t.Fatalf("clear connection: %d", w.Code)
+	}
+	if !fileExists(rotated) {
+		t.Fatal("memory clear removed files")
+	}
+
+	// cursors keep counting after a clear
+	e.connLog.info(compSession, "three")
+	if recs := e.connLog.list(logFilter{}); len(recs) != 1 || recs[0].Seq != 2 {
+		t.Fatalf("unexpected records after clear %+v", recs)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/logs/general?disk=true", nil))
+	if w.Code != http.StatusNoContent || fileExists(rotated) {
+		t.Fatalf("clear general on disk: %d", w.Code)
+	}
+	e.genLog.info(compSession, "after")
+
+	// clearing while the sinks are reconfigured must not touch closed writers
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			level := []Level{LevelDebug, LevelInfo}[i%2]
+			e.sinks.configure([]SinkConfig{{Type: SinkFile, Level: level}}, func(c SinkConfig) (LogSink, error) {
+				return e.openSink(c, false)
+			})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		e.connLog.clear(true)
+	}
+	<-done
+
+	e.sinks.close()
+	data, _ := os.ReadFile(filepath.Join(e.logDir(), "general.log"))
+	if bytes.Contains(data, []byte(`"two"`)) || !bytes.Contains(data, []byte(`"after"`)) {
+		t.Fatalf("general.log not truncated: %s", data)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/logs/general?disk=maybe", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestDiagnosticsBundle(t *testing.T) {
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer worker.Close()
+	e := newTestEngine(t)
+	if err := e.workers.AddWorker(Worker{URL: worker.URL, Token: "worker-secret-token"}); err != nil {
+		t.Fatalf("add worker: %v", err)
+	}
+	token, err := writeAPIToken(e.ConfigDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the bundle redacts even records written without scrubbing
+	e.updateConfig(Config{LogPrivacy: PrivacyOff})
+	e.genLog.info(compNetwork, "ip changed", "ip", "192.0.2.44", "previous", "2001:db8::1")
+	e.genLog.info(compAPI, "request", "auth", "Bearer "+token, "onion", "duskgytldkxiuqc6.onion")
+	e.connLog.info(compSession, "circuit bound to worker", "worker", worker.URL)
+
+	w := httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/diagnostics/bundle", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" ||
+		!strings.HasPrefix(w.Header().Get("Content-Disposition"), `attachment; filename="torwell84-diagnostics-`) {
+		t.Fatalf("bundle: %d %v", w.Code, w.Header())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("zip: %v", err)
+	}
+	contents := map[string]string{}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		contents[f.Name] = string(b)
+	}
+	for _, name := range []string{"logs/connection.jsonl", "logs/general.jsonl", "config.json", "workers.json", "tor.json", "system.json"} {
+		if _, ok := contents[name]; !ok {
+			t.Errorf("bundle lacks %s", name)
+		}
+	}
+	all := strings.Join([]string{contents["logs/connection.jsonl"], contents["logs/general.jsonl"], contents["workers.json"]}, "\n")
+	workerHost := strings.TrimPrefix(worker.URL, "http://")
+	for _, leak := range []string{token, "worker-secret-token", "192.0.2.44", "2001:db8::1", "duskgytldkxiuqc6", workerHost} {
+		if strings.Contains(all, leak) {
+			t.Errorf("bundle leaks %q", leak)
+		}
+	}
+	if !strings.Contains(contents["logs/connection.jsonl"], "https://worker-1.invalid") || !strings.Contains(contents["logs/general.jsonl"], "[ip]") {
+		t.Errorf("unexpected redaction:\n%s", all)
+	}
+	var sys SystemInfo
+	if err := json.Unmarshal([]byte(contents["system.json"]), &sys); err != nil || sys.OS != runtime.GOOS || sys.Version == "" {
+		t.Errorf("system.json: %v %+v", err, sys)
+	}
+	var tor TorInfo
+	if err := json.Unmarshal([]byte(contents["tor.json"]), &tor); err != nil || tor.State.State != StateDisconnected {
+		t.Errorf("tor.json: %v %+v", err, tor)
+	}
+}
+
+func TestLogPrivacy(t *testing.T) {
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer worker.Close()
+	e := newTestEngine(t)
+	if err := e.workers.Add(worker.URL); err != nil {
+		t.Fatalf("add worker: %v", err)
+	}
+	if e.getConfig().LogPrivacy != PrivacyStandard {
+		t.Fatalf("default privacy %q", e.getConfig().LogPrivacy)
+	}
+	last := func() LogRecord {
+		recs := e.genLog.list(logFilter{})
+		return recs[len(recs)-1]
+	}
+
+	// standard: addresses, onions and workers become stable pseudonyms
+	e.genLog.info(compNetwork, "ip changed to 192.0.2.7 from 127.0.0.1", "ip", "192.0.2.7")
+	r := last()
+	ip := r.Fields["ip"].(string)
+	if !strings.HasPrefix(ip, "ip-") || r.Message != "ip changed to "+ip+" from 127.0.0.1" {
+		t.Fatalf("unexpected scrubbing %+v", r)
+	}
+	e.genLog.info(compSession, "fetch "+worker.URL+"/fetch failed via duskgytldkxiuqc6.onion",
+		"worker", worker.URL, "previous_worker", "https://gone.example", "entry", "DE", "target", "https://example.com:443")
+	r = last()
+	wk := r.Fields["worker"].(string)
+	if !strings.HasPrefix(wk, "worker-") || !strings.HasPrefix(r.Fields["previous_worker"].(string), "worker-") ||
+		r.Message != "fetch "+wk+"/fetch failed via "+e.connLog.scrub.pseudonym("onion", "duskgytldkxiuqc6.onion") {
+		t.Fatalf("unexpected scrubbing %+v", r)
+	}
+	if r.Fields["entry"] != "DE" || r.Fields["target"] != "https://"+e.connLog.scrub.pseudonym("host", "example.com")+":443" {
+		t.Fatalf("unexpected standard field scrubbing %+v", r.Fields)
+	}
+	// standard: hostnames in messages, keeping localhost
+	e.genLog.info(compNetwork, "dial relay.example.net:9001 for https://news.example.org/x and http://localhost:9472")
+	r = last()
+	if want := "dial " + e.connLog.scrub.pseudonym("host", "relay.example.net") + ":9001 for https://" +
+		e.connLog.scrub.pseudonym("host", "news.example.org") + "/x and http://localhost:9472"; r.Message != want {
+		t.Fatalf("hostnames not scrubbed at standard: %q", r.Message)
+	}
+	e.connLog.info(compSession, "again", "ip", "192.0.2.7")
+	if recs := e.connLog.list(logFilter{}); recs[len(recs)-1].Fields["ip"] != ip {
+		t.Fatal("pseudonym not stable across logs")
+	}
+
+	// paranoid: countries as well
+	e.updateConfig(Config{LogPrivacy: PrivacyParanoid})
+	e.genLog.info(compSession, "dial relay.example.net:9001 for http://localhost:9472", "entry", "DE", "target", "https://example.com:443/x")
+	r = last()
+	if strings.Contains(r.Message, "relay.example.net") || !strings.Contains(r.Message, ":9001 for http://localhost:9472") ||
+		!strings.HasPrefix(r.Fields["entry"].(string), "country-") || strings.Contains(r.Fields["target"].(string), "example.com") {
+		t.Fatalf("unexpected paranoid scrubbing %+v", r)
+	}
+
+	// off keeps everything
+	e.updateConfig(Config{LogPrivacy: PrivacyOff})
+	e.genLog.info(compNetwork, "ip", "ip", "192.0.2.7")
+	if last().Fields["ip"] != "192.0.2.7" {
+		t.Fatal("privacy off scrubbed")
+	}
+
+	// another engine run uses different pseudonyms
+	if other := newTestEngine(t); other.connLog.scrub.pseudonym("ip", "192.0.2.7") == ip {
+		t.Fatal("pseudonyms linkable across runs")
+	}
+
+	w := httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/config", strings.NewReader(`{"logPrivacy":"loose"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown level, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	e.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/config", strings.NewReader(`{"obfs4":true,"logPrivacy":"paranoid"}`)))
+	if w.Code != http.StatusOK || e.getConfig().LogPrivacy != PrivacyParanoid {
+		t.Fatalf("set privacy: %d %+v", w.Code, e.getConfig())
+	}
+}
+
+func TestCircuitManager(t *testing.T) {
+	cm := NewCircuitManager(2)
+	first := cm.Next()
+	second := cm.Next()
+	if first.ID == second.ID {
+		t.Fatalf("expected different circuits")
+	}
+	third := cm.Next()
+	if third.ID == second.ID {
+		t.Fatalf("rotation failed")
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	d := newDNSCache(time.Second)
+	addrs1, err := d.LookupHost(context.Background(), "localhost")
+	if err != nil || len(addrs1) == 0 {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	addrs2, err := d.LookupHost(context.Background(), "localhost")
+	if err != nil {
+		t.Fatalf("lookup2: %v", err)
+	}
+	if &addrs1[0] == &addrs2[0] {
+		t.Fatalf("expected copy of cached slice")
+	}
+
+	// worker clients dial through the cache of the engine
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	e := newTestEngine(t)
+	if err := e.workers.AddWorker(Worker{URL: "http://localhost:" + port}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if e.dns.misses.Load() != 1 {
+		t.Fatalf("expected the worker lookup to miss the cache, got %d misses", e.dns.misses.Load())
+	}
+	conn, err := e.dns.DialContext(context.Background(), "tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+	if e.dns.hits.Load() != 1 {
+		t.Fatalf("expected a cache hit, got %d", e.dns.hits.Load())
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	record := func(s string) {
+		mu.Lock()
+		order = append(order, s)
+		mu.Unlock()
+	}
+	st := &stubTor{onStop: func() { record("tor") }}
+	e := newTestEngine(t, WithTor(st))
+	dir := e.ConfigDir()
+	e.workers.Add("https://a.example")
+	st.Start(context.Background())
+
+	svc := newService()
+	svc.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		record("loop")
+	})
+
+	// an in-flight proxy stream must be drained, not cut
+	started, release := make(chan struct{}), make(chan struct{})
+	pl, _ := net.Listen("tcp", "127.0.0.1:0")
+	svc.ServeProxy(pl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+		record("proxy")
+	}))
+	al, _ := net.Listen("tcp", "127.0.0.1:0")
+	svc.ServeAPI(al, e.Handler())
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + pl.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(b)
+	}()
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		e.shutdown(svc, 5*time.Second)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := http.Get("http://" + al.Addr().String() + "/status"); err == nil {
+		t.Fatalf("api still accepting requests during shutdown")
+	}
+	select {
+	case <-done:
+		t.Fatalf("shutdown did not wait for the proxy stream")
+	default:
+	}
+	close(release)
+	<-done
+	if b := <-body; b != "done" {
+		t.Fatalf("proxy stream cut: %q", b)
+	}
+
+	if got := strings.Join(order, ","); got != "proxy,loop,tor" {
+		t.Fatalf("shutdown order %s", got)
+	}
+	if st.running {
+		t.Fatalf("tor still running")
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "logs", "general.log"))
+	if !bytes.Contains(data, []byte("shutting down")) {
+		t.Fatalf("log not flushed: %s", data)
+	}
+	for _, f := range []string{"workers.json", "config.json"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Fatalf("state not persisted: %v", err)
+		}
+	}
+}
+
+func TestEngineRun(t *testing.T) {
+	e := newTestEngine(t, WithAPISocket(APISocketFile), WithAPIAddr("127.0.0.1:0"))
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- e.Run(ctx) }()
+
+	path := filepath.Join(e.ConfigDir(), APISocketFile)
+	c := client.NewUnix(path)
+	var err error
+	for i := 0; i < 50; i++ {
+		if _, err = c.Status(ctx); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("status over socket: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(e.ConfigDir(), apiTokenFile)); err != nil {
+		t.Fatalf("api token not written: %v", err)
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket left behind: %v", err)
+	}
+}
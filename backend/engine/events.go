@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published by the engine.
+const (
+	EventConnected    = "connected"
+	EventDisconnected = "disconnected"
+	EventCircuit      = "circuit"
+	EventState        = "state"
+	EventProgress     = "progress"
+	EventError        = "error"
+)
+
+// Event is a change of the engine state.
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// eventHub fans events out to subscribers. Slow subscribers lose events
+// instead of blocking the engine.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Subscribe returns a channel receiving engine events and a function that
+// ends the subscription.
+func (e *Engine) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+	h := &e.events
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = map[chan Event]struct{}{}
+	}
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, ch)
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (e *Engine) publish(typ string, data interface{}) {
+	ev := Event{Type: typ, Time: time.Now(), Data: data}
+	h := &e.events
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
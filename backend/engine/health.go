@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Worker features advertised in the healthz document.
+const (
+	FeatureFetch     = "fetch"
+	FeatureWebSocket = "websocket"
+	FeatureDoH       = "doh"
+)
+
+// Supported range of the worker health protocol. Version 1 workers answer
+// healthz with a bare 200 and only support fetch.
+const (
+	minWorkerProtocol = 1
+	maxWorkerProtocol = 2
+)
+
+// Worker forwarding protocol. Every request carries the worker token in the
+// worker token header, leaving Authorization to the relayed request.
+// Forwarded requests name their destination in the target header: /fetch
+// relays an HTTP request, /ws a WebSocket and /dns-query is an RFC 8484 DoH
+// endpoint.
+const (
+	defaultHealthPath = "/.well-known/healthz"
+	fetchPath         = "/fetch"
+	wsPath            = "/ws"
+	dohPath           = "/dns-query"
+	targetHeader      = "X-Torwell-Target"
+	workerTokenHeader = "X-Torwell-Worker-Token"
+	coloHeader        = "X-Torwell-Colo"
+)
+
+// ErrIncompatibleProtocol is returned for workers speaking an unsupported
+// health protocol version.
+var ErrIncompatibleProtocol = errors.New("incompatible worker protocol")
+
+// HealthInfo is the healthz document served by protocol v2 workers.
+type HealthInfo struct {
+	Protocol int          `json:"protocol"`
+	Colo     string       `json:"colo,omitempty"`
+	Features []string     `json:"features"`
+	Limits   WorkerLimits `json:"limits"`
+}
+
+// WorkerLimits describes the limits a worker enforces on forwarded traffic.
+type WorkerLimits struct {
+	MaxBodyBytes   int64 `json:"maxBodyBytes,omitempty"`
+	RequestsPerDay int64 `json:"requestsPerDay,omitempty"`
+	TimeoutMs      int64 `json:"timeoutMs,omitempty"`
+}
+
+// Supports reports whether the worker advertises the given feature.
+// An empty feature is supported by every worker.
+func (h *HealthInfo) Supports(feature string) bool {
+	if feature == "" {
+		return true
+	}
+	if h == nil {
+		return feature == FeatureFetch
+	}
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHealth decodes a healthz body. Empty or non-JSON bodies are treated
+// as protocol v1 unless expect lists fields that must be present.
+func parseHealth(r io.Reader, expect []string) (*HealthInfo, error) {
+	b, err := io.ReadAll(io.LimitReader(r, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if len(strings.TrimSpace(string(b))) == 0 || json.Unmarshal(b, &fields) != nil {
+		if len(expect) > 0 {
+			return nil, errors.New("health response is not a json document")
+		}
+		return &HealthInfo{Protocol: 1, Features: []string{FeatureFetch}}, nil
+	}
+	for _, f := range expect {
+		if v, ok := fields[f]; !ok || string(v) == "null" {
+			return nil, fmt.Errorf("health response lacks %q", f)
+		}
+	}
+	var h HealthInfo
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["protocol"]; !ok {
+		h.Protocol = 1
+	}
+	if h.Features == nil {
+		h.Features = []string{FeatureFetch}
+	}
+	if h.Protocol < minWorkerProtocol || h.Protocol > maxWorkerProtocol {
+		return nil, fmt.Errorf("%w: version %d", ErrIncompatibleProtocol, h.Protocol)
+	}
+	return &h, nil
+}
@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// service owns the servers and background loops started by Engine.Run.
+// They are shut down in order: API, proxies, loops, then Engine.close stops
+// tor, the log writers and persists the state.
+type service struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	loops   sync.WaitGroup
+	api     []*http.Server
+	proxies []*http.Server
+	errc    chan error
+}
+
+func newService() *service {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &service{ctx: ctx, cancel: cancel, errc: make(chan error, 4)}
+}
+
+// Go runs fn until the service shuts down.
+func (s *service) Go(fn func(ctx context.Context)) {
+	s.loops.Add(1)
+	go func() {
+		defer s.loops.Done()
+		fn(s.ctx)
+	}()
+}
+
+// ServeAPI serves the API on l.
+func (s *service) ServeAPI(l net.Listener, h http.Handler) {
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	s.api = append(s.api, srv)
+	go s.serve(srv, l)
+}
+
+// ServeProxy serves a proxy on l; its streams are drained on shutdown.
+func (s *service) ServeProxy(l net.Listener, h http.Handler) {
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	s.proxies = append(s.proxies, srv)
+	go s.serve(srv, l)
+}
+
+func (s *service) serve(srv *http.Server, l net.Listener) {
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.errc <- err
+	}
+}
+
+// Err reports the first server failure.
+func (s *service) Err() <-chan error {
+	return s.errc
+}
+
+// shutdown stops the servers of s and the engine within timeout.
+func (e *Engine) shutdown(s *service, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.Printf("shutdown: stopping api")
+	// log streams never go idle on their own
+	e.stopStreams()
+	for _, srv := range s.api {
+		if err := srv.Shutdown(ctx); err != nil {
+			srv.Close()
+		}
+	}
+	log.Printf("shutdown: draining proxies")
+	for _, srv := range s.proxies {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: proxy streams cut: %v", err)
+			srv.Close()
+		}
+	}
+	s.cancel()
+	s.loops.Wait()
+	e.close(ctx)
+}
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+)
+
+// APISocketFile is the name of the API socket inside the config directory.
+const APISocketFile = "api.sock"
+
+// errPeerCredUnsupported is returned where the platform cannot report the
+// credentials of a socket peer. The socket permissions still apply.
+var errPeerCredUnsupported = errors.New("peer credentials unsupported")
+
+// listenUnix opens the API socket at path, replacing a stale one, and
+// restricts it to the current user. The socket is created under umask 0177
+// so it is never reachable by others, and the listener is closed, removing
+// the socket, if it cannot be made private. Connections from other users
+// are refused where peer credentials are available.
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var l net.Listener
+	err := withUmask(0177, func() (err error) {
+		l, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("api socket: %w", err)
+	}
+	return &peerCredListener{Listener: l, uid: os.Getuid()}, nil
+}
+
+// peerCredListener only accepts connections from uid or root.
+type peerCredListener struct {
+	net.Listener
+	uid int
+}
+
+func (l *peerCredListener) allowed(uid int) bool {
+	return uid == l.uid || uid == 0
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := peerUID(c)
+		switch {
+		case errors.Is(err, errPeerCredUnsupported):
+			return c, nil
+		case err != nil:
+			log.Printf("api socket: peer credentials: %v", err)
+		case l.allowed(uid):
+			return c, nil
+		default:
+			log.Printf("api socket: refused connection from uid %d", uid)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,608 @@
+package engine
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log record.
+type Level int
+
+// Log levels, from the most verbose.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// MarshalText encodes the level by name.
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText accepts the level names case-insensitively.
+func (l *Level) UnmarshalText(b []byte) error {
+	lv, err := ParseLevel(string(b))
+	if err != nil {
+		return err
+	}
+	*l = lv
+	return nil
+}
+
+// ParseLevel parses a level name such as "info" or "WARN".
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Log components.
+const (
+	compEngine  = "engine"
+	compSession = "session"
+	compTor     = "tor"
+	compWorker  = "worker"
+	compNetwork = "network"
+	compAPI     = "api"
+)
+
+// LogRecord is one structured log entry. It is written as a JSON line and
+// served by /logs.
+type LogRecord struct {
+	// Seq numbers the records of a log from 1 and serves as cursor.
+	Seq       uint64                 `json:"seq"`
+	Time      time.Time              `json:"time"`
+	Level     Level                  `json:"level"`
+	Component string                 `json:"component"`
+	Message   string                 `json:"message"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// LogConfig sets the rotation and retention of the log files.
+type LogConfig struct {
+	// MaxSizeMB rotates the current file once it grows past this size;
+	// 0 never rotates by size.
+	MaxSizeMB int `json:"maxSizeMb"`
+	// MaxFiles is the number of rotated files kept per log; 0 keeps all.
+	MaxFiles int `json:"maxFiles"`
+	// MaxAgeDays removes rotated files older than this; 0 keeps them.
+	MaxAgeDays int `json:"maxAgeDays"`
+	// Compress gzips rotated files.
+	Compress bool `json:"compress"`
+	// RotateOnStart moves the previous run's file aside, so each run
+	// starts with empty logs.
+	RotateOnStart bool `json:"rotateOnStart"`
+}
+
+// defaultLogConfig keeps about a week of logs in at most 5 MB per log.
+func defaultLogConfig() LogConfig {
+	return LogConfig{MaxSizeMB: 1, MaxFiles: 5, MaxAgeDays: 7, Compress: true, RotateOnStart: true}
+}
+
+// validate rejects negative limits.
+func (c LogConfig) validate() error {
+	if c.MaxSizeMB < 0 || c.MaxFiles < 0 || c.MaxAgeDays < 0 {
+		return &RequestError{http.StatusBadRequest, codeBadRequest, "log limits must not be negative"}
+	}
+	return nil
+}
+
+// logQueueSize bounds the entries waiting for the disk. Entries beyond it
+// are dropped rather than blocking the caller.
+const logQueueSize = 1024
+
+// LogStats reports the state of a log writer.
+type LogStats struct {
+	// Queued is the number of entries waiting to be written.
+	Queued int `json:"queued"`
+	// Dropped counts the entries lost to a full queue since start.
+	Dropped uint64 `json:"dropped"`
+}
+
+// logWriter writes log records as JSON lines to a file, rotating it by
+// size and pruning the rotated files by count and age.
+type logWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	cfg  LogConfig
+	dir  string
+	base string
+	ch   chan []byte
+	wg   sync.WaitGroup
+	// cleared answers a clear request, a nil entry on ch.
+	cleared chan error
+	// dropped counts entries lost to a full queue; unreported those not
+	// yet noted in the file.
+	dropped    atomic.Uint64
+	unreported atomic.Uint64
+}
+
+func newLogWriter(dir, base string, cfg LogConfig) (*logWriter, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lw := &logWriter{dir: dir, base: base, cfg: cfg, ch: make(chan []byte, logQueueSize), cleared: make(chan error)}
+	if err := lw.open(); err != nil {
+		return nil, err
+	}
+	if cfg.RotateOnStart && lw.size > 0 {
+		if err := lw.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	lw.prune()
+	lw.wg.Add(1)
+	go lw.loop()
+	return lw, nil
+}
+
+func (lw *logWriter) loop() {
+	defer lw.wg.Done()
+	for entry := range lw.ch {
+		if entry == nil {
+			lw.cleared <- lw.truncate()
+			continue
+		}
+		lw.write(entry)
+		// note the losses once the queue has drained
+		if len(lw.ch) == 0 {
+			if n := lw.unreported.Swap(0); n > 0 {
+				lw.write(droppedLine(n))
+			}
+		}
+	}
+}
+
+// droppedLine is the record noting n lost entries in the file.
+func droppedLine(n uint64) []byte {
+	line, _ := json.Marshal(LogRecord{
+		Time:      time.Now().UTC(),
+		Level:     LevelWarn,
+		Component: compEngine,
+		Message:   "log entries dropped",
+		Fields:    map[string]interface{}{"count": n},
+	})
+	return append(line, '\n')
+}
+
+func (lw *logWriter) write(line []byte) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if lw.file == nil {
+		if err := lw.open(); err != nil {
+			return
+		}
+	}
+	n, _ := lw.file.Write(line)
+	lw.size += int64(n)
+	if max := int64(lw.cfg.MaxSizeMB) << 20; max > 0 && lw.size > max {
+		_ = lw.rotate()
+	}
+}
+
+func (lw *logWriter) open() error {
+	path := filepath.Join(lw.dir, lw.base+".log")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	lw.file = f
+	info, err := f.Stat()
+	if err == nil {
+		lw.size = info.Size()
+	}
+	return nil
+}
+
+// rotate renames the current file with a timestamp, compresses it if
+// configured, prunes old files and opens a new one.
+func (lw *logWriter) rotate() error {
+	lw.file.Close()
+	ts := time.Now().Format("20060102-150405")
+	old := filepath.Join(lw.dir, fmt.Sprintf("%s-%s.log", lw.base, ts))
+	// a second rotation within the same second gets a counter
+	for i := 2; fileExists(old) || fileExists(old+".gz"); i++ {
+		old = filepath.Join(lw.dir, fmt.Sprintf("%s-%s-%d.log", lw.base, ts, i))
+	}
+	os.Rename(filepath.Join(lw.dir, lw.base+".log"), old)
+	lw.size = 0
+	if lw.cfg.Compress {
+		if err := gzipFile(old); err != nil {
+			log.Printf("log compress: %v", err)
+		}
+	}
+	lw.prune()
+	return lw.open()
+}
+
+// rotated returns the rotated files of the log, newest first.
+func (lw *logWriter) rotated() []os.FileInfo {
+	var files []os.FileInfo
+	for _, pattern := range []string{lw.base + "-*.log", lw.base + "-*.log.gz"} {
+		names, _ := filepath.Glob(filepath.Join(lw.dir, pattern))
+		for _, name := range names {
+			if info, err := os.Stat(name); err == nil {
+				files = append(files, info)
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].ModTime().Equal(files[j].ModTime()) {
+			return files[i].ModTime().After(files[j].ModTime())
+		}
+		return files[i].Name() > files[j].Name()
+	})
+	return files
+}
+
+// prune removes rotated files beyond the count and age limits.
+func (lw *logWriter) prune() {
+	cutoff := time.Now().AddDate(0, 0, -lw.cfg.MaxAgeDays)
+	for i, f := range lw.rotated() {
+		if (lw.cfg.MaxFiles > 0 && i >= lw.cfg.MaxFiles) || (lw.cfg.MaxAgeDays > 0 && f.ModTime().Before(cutoff)) {
+			os.Remove(filepath.Join(lw.dir, f.Name()))
+		}
+	}
+}
+
+// setConfig applies new limits, pruning at once.
+func (lw *logWriter) setConfig(cfg LogConfig) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.cfg = cfg
+	lw.prune()
+}
+
+// gzipFile compresses path to path.gz and removes the original.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	in.Close()
+	// keep the modification time for pruning by age
+	if info, err := os.Stat(path); err == nil {
+		os.Chtimes(path+".gz", info.ModTime(), info.ModTime())
+	}
+	return os.Remove(path)
+}
+
+// clear empties the current file and removes the rotated ones once the
+// entries queued before are written.
+func (lw *logWriter) clear() error {
+	lw.ch <- nil
+	return <-lw.cleared
+}
+
+func (lw *logWriter) truncate() error {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	for _, f := range lw.rotated() {
+		if err := os.Remove(filepath.Join(lw.dir, f.Name())); err != nil {
+			return err
+		}
+	}
+	if lw.file == nil {
+		return nil
+	}
+	if err := lw.file.Truncate(0); err != nil {
+		return err
+	}
+	lw.size = 0
+	return nil
+}
+
+// Write queues r for writing. When the queue is full the entry is dropped
+// and counted; the record itself stays in memory.
+func (lw *logWriter) Write(r LogRecord) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	select {
+	case lw.ch <- line:
+	default:
+		lw.dropped.Add(1)
+		lw.unreported.Add(1)
+	}
+}
+
+func (lw *logWriter) stats() LogStats {
+	return LogStats{Queued: len(lw.ch), Dropped: lw.dropped.Load()}
+}
+
+// Close flushes pending log entries and closes the file.
+func (lw *logWriter) Close() {
+	close(lw.ch)
+	lw.wg.Wait()
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if lw.file != nil {
+		lw.file.Close()
+		lw.file = nil
+	}
+}
+
+// logBuffer keeps the recent records of a log in memory and passes them to
+// the sinks. Records below min are dropped and the rest are scrubbed
+// before they are kept.
+type logBuffer struct {
+	mu      sync.Mutex
+	min     Level
+	scrub   *scrubber
+	seq     uint64
+	records []LogRecord
+	// name is the log passed to the sinks of out.
+	name string
+	out  *sinkSet
+	// changed is closed and replaced when a record is added.
+	changed chan struct{}
+}
+
+// log appends a record, keeping the last 1000. kv holds alternating keys
+// and values.
+func (b *logBuffer) log(level Level, component, msg string, kv ...interface{}) {
+	if level < b.min {
+		return
+	}
+	r := LogRecord{Time: time.Now().UTC(), Level: level, Component: component, Message: msg}
+	if len(kv) > 1 {
+		r.Fields = make(map[string]interface{}, len(kv)/2)
+		for i := 0; i+1 < len(kv); i += 2 {
+			r.Fields[fmt.Sprint(kv[i])] = kv[i+1]
+		}
+	}
+	if b.scrub != nil {
+		b.scrub.record(&r)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	r.Seq = b.seq
+	b.records = append(b.records, r)
+	if len(b.records) > 1000 {
+		b.records = b.records[len(b.records)-1000:]
+	}
+	if b.out != nil {
+		b.out.write(b.name, r)
+	}
+	if b.changed != nil {
+		close(b.changed)
+		b.changed = nil
+	}
+}
+
+// wait returns a channel that is closed once the next record is added.
+func (b *logBuffer) wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.changed == nil {
+		b.changed = make(chan struct{})
+	}
+	return b.changed
+}
+
+func (b *logBuffer) debug(component, msg string, kv ...interface{}) {
+	b.log(LevelDebug, component, msg, kv...)
+}
+
+func (b *logBuffer) info(component, msg string, kv ...interface{}) {
+	b.log(LevelInfo, component, msg, kv...)
+}
+
+func (b *logBuffer) warn(component, msg string, kv ...interface{}) {
+	b.log(LevelWarn, component, msg, kv...)
+}
+
+func (b *logBuffer) error(component, msg string, kv ...interface{}) {
+	b.log(LevelError, component, msg, kv...)
+}
+
+// ctxLog tags the records of a log with the request ID and span of a
+// context.
+type ctxLog struct {
+	b  *logBuffer
+	kv []interface{}
+}
+
+// with returns the log for the request traced in ctx.
+func (b *logBuffer) with(ctx context.Context) ctxLog {
+	l := ctxLog{b: b}
+	if sc, ok := spanFrom(ctx); ok {
+		l.kv = []interface{}{"request_id", sc.trace.String()}
+		if sc.span != (spanID{}) {
+			l.kv = append(l.kv, "span_id", sc.span.String())
+		}
+	}
+	return l
+}
+
+func (l ctxLog) log(level Level, component, msg string, kv []interface{}) {
+	l.b.log(level, component, msg, append(kv, l.kv...)...)
+}
+
+func (l ctxLog) debug(component, msg string, kv ...interface{}) {
+	l.log(LevelDebug, component, msg, kv)
+}
+
+func (l ctxLog) info(component, msg string, kv ...interface{}) {
+	l.log(LevelInfo, component, msg, kv)
+}
+
+func (l ctxLog) warn(component, msg string, kv ...interface{}) {
+	l.log(LevelWarn, component, msg, kv)
+}
+
+func (l ctxLog) error(component, msg string, kv ...interface{}) {
+	l.log(LevelError, component, msg, kv)
+}
+
+// logFilter selects records by minimum level, component, time range and
+// text. Zero fields match everything.
+type logFilter struct {
+	level      Level
+	components []string
+	since      time.Time
+	until      time.Time
+	// text is matched case-insensitively against the message, component
+	// and field values.
+	text string
+}
+
+func (f logFilter) match(r LogRecord) bool {
+	if r.Level < f.level {
+		return false
+	}
+	if f.text != "" && !r.contains(f.text) {
+		return false
+	}
+	if !f.since.IsZero() && r.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !r.Time.Before(f.until) {
+		return false
+	}
+	if len(f.components) == 0 {
+		return true
+	}
+	for _, c := range f.components {
+		if c == r.Component {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether text, in lower case, occurs in the record.
+func (r LogRecord) contains(text string) bool {
+	if strings.Contains(strings.ToLower(r.Message), text) || strings.Contains(r.Component, text) {
+		return true
+	}
+	for k, v := range r.Fields {
+		if strings.Contains(strings.ToLower(k+"="+fmt.Sprint(v)), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the records matching f, oldest first.
+func (b *logBuffer) list(f logFilter) []LogRecord {
+	return b.page(f, 0, false, 0).Records
+}
+
+// LogPage is one page of /logs. Next is the cursor of the following page
+// and empty on the last one.
+type LogPage struct {
+	Records []LogRecord `json:"records"`
+	Next    string      `json:"next,omitempty"`
+}
+
+// page returns up to limit records matching f after cursor, oldest first,
+// or before cursor, newest first, when desc is set. A zero cursor starts at
+// the oldest or newest record and a zero limit returns all of them.
+func (b *logBuffer) page(f logFilter, cursor uint64, desc bool, limit int) LogPage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := LogPage{Records: []LogRecord{}}
+	n := len(b.records)
+	for i := 0; i < n; i++ {
+		r := b.records[i]
+		if desc {
+			r = b.records[n-1-i]
+		}
+		if cursor != 0 && (!desc && r.Seq <= cursor || desc && r.Seq >= cursor) {
+			continue
+		}
+		if !f.match(r) {
+			continue
+		}
+		if limit > 0 && len(p.Records) == limit {
+			p.Next = strconv.FormatUint(p.Records[limit-1].Seq, 10)
+			break
+		}
+		p.Records = append(p.Records, r)
+	}
+	return p
+}
+
+// clear drops the records in memory and, with disk set, the files of the
+// file sinks. Sequence numbers keep counting so cursors stay valid.
+func (b *logBuffer) clear(disk bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.records = nil
+	if !disk || b.out == nil {
+		return nil
+	}
+	return b.out.clearFiles(b.name)
+}
+
+// stats adds up the queues of the file sinks.
+func (b *logBuffer) stats() LogStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var st LogStats
+	if b.out == nil {
+		return st
+	}
+	for _, w := range b.out.files(b.name) {
+		ws := w.stats()
+		st.Queued += ws.Queued
+		st.Dropped += ws.Dropped
+	}
+	return st
+}
+
+// close detaches the sinks; later records stay in memory.
+func (b *logBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.out = nil
+}
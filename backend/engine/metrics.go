@@ -0,0 +1,208 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsContentType is the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// bootstrapBuckets are the bucket bounds of the bootstrap duration, in
+// seconds.
+var bootstrapBuckets = []float64{1, 2, 5, 10, 20, 30, 60, 120, 180}
+
+// metrics holds the counters the engine updates as it runs. Gauges such as
+// the state and worker health are read when scraped.
+type metrics struct {
+	bootstrap      histogram
+	circuitsBuilt  atomic.Uint64
+	circuitsFailed atomic.Uint64
+	proxyStreams   atomic.Uint64
+	proxyActive    atomic.Int64
+	proxySent      atomic.Uint64
+	proxyReceived  atomic.Uint64
+}
+
+// histogram counts observations into cumulative buckets.
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+	for i, b := range buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// countCircuit counts the built and failed circuits of a CIRC event,
+// "ID STATUS PATH ...".
+func (m *metrics) countCircuit(ev TorEvent) {
+	f := strings.Fields(ev.Text)
+	if len(f) < 2 {
+		return
+	}
+	switch f[1] {
+	case "BUILT":
+		m.circuitsBuilt.Add(1)
+	case "FAILED":
+		m.circuitsFailed.Add(1)
+	}
+}
+
+// metricWriter renders metric families in the text exposition format.
+type metricWriter struct {
+	bytes.Buffer
+}
+
+// family starts a metric family with its help and type lines.
+func (w *metricWriter) family(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample; labels alternate names and values.
+func (w *metricWriter) sample(name string, v float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatSample(v))
+	w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatSample(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func boolSample(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// histogram writes the buckets, sum and count of h.
+func (w *metricWriter) histogram(name string, buckets []float64, h *histogram) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range buckets {
+		var n uint64
+		if h.counts != nil {
+			n = h.counts[i]
+		}
+		w.sample(name+"_bucket", float64(n), "le", formatSample(b))
+	}
+	w.sample(name+"_bucket", float64(h.count), "le", "+Inf")
+	w.sample(name+"_sum", h.sum)
+	w.sample(name+"_count", float64(h.count))
+}
+
+// allStates lists the connection states in a stable order.
+var allStates = []ConnState{
+	StateDisconnected, StateConnecting, StateBootstrapping, StateConnected,
+	StateReconnecting, StateDisconnecting, StateError,
+}
+
+// writeMetrics renders every metric of the engine.
+func (e *Engine) writeMetrics(w *metricWriter) {
+	info := e.state.info()
+	w.family("torwell84_connection_state", "gauge", "Current connection state, 1 for the active state.")
+	for _, s := range allStates {
+		w.sample("torwell84_connection_state", boolSample(info.State == s), "state", string(s))
+	}
+	w.family("torwell84_connection_state_seconds", "gauge", "Time spent in the current connection state.")
+	w.sample("torwell84_connection_state_seconds", float64(info.DurationMs)/1000)
+	w.family("torwell84_bootstrap_duration_seconds", "histogram", "Time from starting tor to a bootstrapped connection.")
+	w.histogram("torwell84_bootstrap_duration_seconds", bootstrapBuckets, &e.metrics.bootstrap)
+
+	w.family("torwell84_circuits_built_total", "counter", "Circuits tor reported built.")
+	w.sample("torwell84_circuits_built_total", float64(e.metrics.circuitsBuilt.Load()))
+	w.family("torwell84_circuits_failed_total", "counter", "Circuits tor reported failed.")
+	w.sample("torwell84_circuits_failed_total", float64(e.metrics.circuitsFailed.Load()))
+	w.family("torwell84_circuits_pooled", "gauge", "Pre-warmed circuits waiting in the pool.")
+	w.sample("torwell84_circuits_pooled", float64(e.circuits.pooled()))
+
+	workers := e.workers.List()
+	sort.Slice(workers, func(i, j int) bool { return workers[i].URL < workers[j].URL })
+	w.family("torwell84_worker_up", "gauge", "Whether the worker passed its last health check.")
+	for _, wk := range workers {
+		w.sample("torwell84_worker_up", boolSample(wk.Active), "worker", wk.URL)
+	}
+	w.family("torwell84_worker_health_latency_seconds", "gauge", "Duration of the last successful health check.")
+	for _, wk := range workers {
+		w.sample("torwell84_worker_health_latency_seconds", e.workers.workerStat(wk.URL).latency.Seconds(), "worker", wk.URL)
+	}
+	w.family("torwell84_worker_health_checks_total", "counter", "Health checks by result.")
+	for _, wk := range workers {
+		st := e.workers.workerStat(wk.URL)
+		w.sample("torwell84_worker_health_checks_total", float64(st.checks-st.failures), "worker", wk.URL, "result", "ok")
+		w.sample("torwell84_worker_health_checks_total", float64(st.failures), "worker", wk.URL, "result", "error")
+	}
+	w.family("torwell84_worker_selections_total", "counter", "Times the worker was picked for a session or request.")
+	for _, wk := range workers {
+		w.sample("torwell84_worker_selections_total", float64(e.workers.workerStat(wk.URL).selected), "worker", wk.URL)
+	}
+
+	w.family("torwell84_dns_cache_hits_total", "counter", "DNS lookups answered from the cache.")
+	w.sample("torwell84_dns_cache_hits_total", float64(e.dns.hits.Load()))
+	w.family("torwell84_dns_cache_misses_total", "counter", "DNS lookups sent to the resolver.")
+	w.sample("torwell84_dns_cache_misses_total", float64(e.dns.misses.Load()))
+
+	w.family("torwell84_proxy_streams_total", "counter", "Requests relayed by the worker proxy.")
+	w.sample("torwell84_proxy_streams_total", float64(e.metrics.proxyStreams.Load()))
+	w.family("torwell84_proxy_streams_active", "gauge", "Requests the worker proxy is relaying.")
+	w.sample("torwell84_proxy_streams_active", float64(e.metrics.proxyActive.Load()))
+	w.family("torwell84_proxy_bytes_total", "counter", "Body bytes relayed by the worker proxy.")
+	w.sample("torwell84_proxy_bytes_total", float64(e.metrics.proxySent.Load()), "direction", "sent")
+	w.sample("torwell84_proxy_bytes_total", float64(e.metrics.proxyReceived.Load()), "direction", "received")
+
+	w.family("torwell84_log_records_dropped_total", "counter", "Log records not written to disk because the queue was full.")
+	w.sample("torwell84_log_records_dropped_total", float64(e.connLog.stats().Dropped), "log", "connection")
+	w.sample("torwell84_log_records_dropped_total", float64(e.genLog.stats().Dropped), "log", "general")
+}
+
+// handleMetrics serves the metrics for Prometheus.
+func (e *Engine) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var mw metricWriter
+	e.writeMetrics(&mw)
+	w.Header().Set("Content-Type", metricsContentType)
+	w.Write(mw.Bytes())
+}
+
+// observeBootstrap records how long the connection took to bootstrap.
+func (e *Engine) observeBootstrap(d time.Duration) {
+	e.metrics.bootstrap.observe(bootstrapBuckets, d.Seconds())
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package engine
+
+import "net"
+
+// peerUID is not available on this platform; the socket relies on its
+// file permissions.
+func peerUID(c net.Conn) (int, error) {
+	return -1, errPeerCredUnsupported
+}
@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// PrivacyLevel controls how much identifying data log records keep.
+type PrivacyLevel string
+
+// Privacy levels. PrivacyStandard replaces IP addresses, onion addresses,
+// Worker URLs and hostnames with pseudonyms; PrivacyParanoid also replaces
+// the chosen countries.
+const (
+	PrivacyOff      PrivacyLevel = "off"
+	PrivacyStandard PrivacyLevel = "standard"
+	PrivacyParanoid PrivacyLevel = "paranoid"
+)
+
+// Valid reports whether p is a known level.
+func (p PrivacyLevel) Valid() bool {
+	switch p {
+	case PrivacyOff, PrivacyStandard, PrivacyParanoid:
+		return true
+	}
+	return false
+}
+
+var (
+	// URL hosts and host:port pairs; bare dotted names are too often
+	// file names to be told apart from hosts.
+	urlHostRE  = regexp.MustCompile(`(?i)\b[a-z][a-z0-9+.-]*://([^/\s:"'\[\]]+)`)
+	hostPortRE = regexp.MustCompile(`(?i)\b((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,63}):\d{1,5}\b`)
+)
+
+// Field keys whose values are replaced whatever they look like.
+var (
+	workerFields  = map[string]bool{"worker": true, "previous_worker": true}
+	countryFields = map[string]bool{"entry": true, "middle": true, "exit": true, "country": true}
+	hostFields    = map[string]bool{"host": true}
+)
+
+// scrubber replaces identifying values in log records with pseudonyms
+// that are stable for the lifetime of the engine, so records can still be
+// correlated, but cannot be linked across runs.
+type scrubber struct {
+	key     []byte
+	level   func() PrivacyLevel
+	workers func() []string
+}
+
+func newScrubber(level func() PrivacyLevel, workers func() []string) *scrubber {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &scrubber{key: key, level: level, workers: workers}
+}
+
+// pseudonym derives the stable name of value, such as "ip-1a2b3c4d".
+func (s *scrubber) pseudonym(kind, value string) string {
+	m := hmac.New(sha256.New, s.key)
+	m.Write([]byte(kind + "\x00" + strings.ToLower(value)))
+	return kind + "-" + hex.EncodeToString(m.Sum(nil)[:4])
+}
+
+// record scrubs the message and string fields of r in place.
+func (s *scrubber) record(r *LogRecord) {
+	level := s.level()
+	if level == PrivacyOff || level == "" {
+		return
+	}
+	workers := s.workers()
+	r.Message = s.text(r.Message, workers)
+	for k, v := range r.Fields {
+		if str, ok := v.(string); ok && str != "" {
+			r.Fields[k] = s.value(k, str, level, workers)
+		}
+	}
+}
+
+// field scrubs a single value under key k, such as a span attribute.
+func (s *scrubber) field(k, v string) string {
+	level := s.level()
+	if level == PrivacyOff || level == "" || v == "" {
+		return v
+	}
+	return s.value(k, v, level, s.workers())
+}
+
+func (s *scrubber) value(k, v string, level PrivacyLevel, workers []string) string {
+	switch {
+	case workerFields[k]:
+		return s.pseudonym("worker", v)
+	case countryFields[k] && level == PrivacyParanoid:
+		return s.pseudonym("country", v)
+	case hostFields[k]:
+		return s.host(v)
+	}
+	return s.text(v, workers)
+}
+
+// text scrubs free text: Worker URLs and hosts first, then onion and IP
+// addresses and every remaining hostname.
+func (s *scrubber) text(t string, workers []string) string {
+	for _, w := range workers {
+		if strings.Contains(t, w) {
+			t = strings.ReplaceAll(t, w, s.pseudonym("worker", w))
+		}
+		// address literals are left to the IP scrubbing below
+		if u, err := url.Parse(w); err == nil && u.Hostname() != "" && net.ParseIP(u.Hostname()) == nil && strings.Contains(t, u.Hostname()) {
+			t = strings.ReplaceAll(t, u.Hostname(), s.pseudonym("worker", w))
+		}
+	}
+	t = onionRE.ReplaceAllStringFunc(t, func(o string) string { return s.pseudonym("onion", o) })
+	t = ipv4RE.ReplaceAllStringFunc(t, s.ip)
+	t = ipv6RE.ReplaceAllStringFunc(t, s.ip)
+	t = urlHostRE.ReplaceAllStringFunc(t, func(m string) string {
+		host := urlHostRE.FindStringSubmatch(m)[1]
+		return strings.TrimSuffix(m, host) + s.host(host)
+	})
+	t = hostPortRE.ReplaceAllStringFunc(t, func(m string) string {
+		host, port, _ := strings.Cut(m, ":")
+		return s.host(host) + ":" + port
+	})
+	return t
+}
+
+// ip replaces an address unless it is loopback or unspecified.
+func (s *scrubber) ip(a string) string {
+	ip := net.ParseIP(a)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		return a
+	}
+	return s.pseudonym("ip", ip.String())
+}
+
+// host replaces a hostname, keeping localhost and names already scrubbed.
+func (s *scrubber) host(h string) string {
+	if h == "localhost" || strings.HasSuffix(h, ".invalid") || isPseudonym(h) {
+		return h
+	}
+	return s.pseudonym("host", h)
+}
+
+func isPseudonym(s string) bool {
+	for _, kind := range []string{"ip", "host", "onion", "worker", "country"} {
+		if rest, ok := strings.CutPrefix(s, kind+"-"); ok && len(rest) == 8 {
+			if _, err := hex.DecodeString(rest); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// logPrivacy returns the configured level.
+func (e *Engine) logPrivacy() PrivacyLevel {
+	return e.getConfig().LogPrivacy
+}
+
+// errInvalidPrivacy is returned for unknown privacy levels.
+func errInvalidPrivacy(p PrivacyLevel) error {
+	return &RequestError{http.StatusBadRequest, codeBadRequest, fmt.Sprintf("unknown log privacy %q; use off, standard or paranoid", p)}
+}
@@ -0,0 +1,86 @@
+package engine
+
+import "sync"
+
+// Connection phases reported with the progress.
+const (
+	PhaseConnecting = "connecting"
+	PhaseHandshake  = "handshake"
+	PhaseCircuit    = "establishing-circuit"
+	PhaseWorker     = "attaching-worker"
+	PhaseReady      = "ready"
+)
+
+// Weights of the connect steps on the 0-100 scale. Tor bootstrap maps
+// linearly onto torFrom..torTo.
+const (
+	progressTorStarted = 5
+	progressTorFrom    = 10
+	progressTorTo      = 80
+	progressCircuit    = 85
+	progressWorker     = 95
+	progressReady      = 100
+)
+
+// Progress of the current connect attempt.
+type Progress struct {
+	// Attempt counts connects since the engine started.
+	Attempt int    `json:"attempt"`
+	Percent int    `json:"percent"`
+	Phase   string `json:"phase,omitempty"`
+	// Summary is tor's description of its current bootstrap step.
+	Summary string `json:"summary,omitempty"`
+}
+
+// progressTracker keeps the progress of an attempt monotonic.
+type progressTracker struct {
+	mu sync.Mutex
+	p  Progress
+}
+
+// start begins a new attempt.
+func (t *progressTracker) start() Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p = Progress{Attempt: t.p.Attempt + 1, Phase: PhaseConnecting}
+	return t.p
+}
+
+// advance moves to percent and phase unless that would go backwards. It
+// reports whether the progress changed.
+func (t *progressTracker) advance(percent int, phase, summary string) (Progress, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if percent < t.p.Percent || (percent == t.p.Percent && (summary == "" || summary == t.p.Summary)) {
+		return t.p, false
+	}
+	t.p.Percent, t.p.Phase, t.p.Summary = percent, phase, summary
+	return t.p, true
+}
+
+// clear ends the attempt, for example on disconnect.
+func (t *progressTracker) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p = Progress{Attempt: t.p.Attempt}
+}
+
+func (t *progressTracker) get() Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.p
+}
+
+// torProgress maps a tor bootstrap status onto the weighted scale and the
+// UI phases: connecting to the first relay, the handshake and directory
+// download, then building the first circuit.
+func torProgress(st BootstrapStatus) (int, string) {
+	phase := PhaseConnecting
+	switch {
+	case st.Percent >= 90:
+		phase = PhaseCircuit
+	case st.Percent >= 14:
+		phase = PhaseHandshake
+	}
+	return progressTorFrom + st.Percent*(progressTorTo-progressTorFrom)/100, phase
+}
@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are stripped from proxied requests and responses.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// workerProxy is a local HTTP forward proxy relaying absolute-form requests
+// through the worker bound to the current session using the /fetch
+// forwarding protocol. Direct exits are served by the Tor SOCKS port.
+// Clients authenticate with the API token, so other local processes and
+// users cannot relay through the session.
+type workerProxy struct {
+	e     *Engine
+	token string
+}
+
+func (p *workerProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !proxyAuthorized(r, p.token) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="torwell84"`)
+		http.Error(w, "proxy credentials required", http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		http.Error(w, "CONNECT is not supported by the worker hop", http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.URL.IsAbs() || (r.URL.Scheme != "http" && r.URL.Scheme != "https") {
+		http.Error(w, "absolute http(s) url required", http.StatusBadRequest)
+		return
+	}
+	// the span covers the stream setup, up to the response headers
+	ctx, sp := p.e.trace.start(r.Context(), "proxy.stream", spanClient, "method", r.Method, "host", r.URL.Hostname())
+	worker, ok := p.e.proxyWorker(FeatureFetch)
+	if !ok {
+		sp.end(errors.New("no worker bound to the session"))
+		http.Error(w, "no worker bound to the session", http.StatusServiceUnavailable)
+		return
+	}
+	sp.set("worker", worker)
+
+	m := &p.e.metrics
+	m.proxyStreams.Add(1)
+	m.proxyActive.Add(1)
+	defer m.proxyActive.Add(-1)
+	body := r.Body
+	if r.ContentLength != 0 {
+		body = meteredReader{r.Body, func(n int) {
+			m.proxySent.Add(uint64(n))
+			p.e.bandwidth.proxy(worker, 0, uint64(n))
+		}}
+	}
+	out, err := http.NewRequestWithContext(ctx, r.Method, worker+fetchPath, body)
+	if err != nil {
+		sp.end(err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	out.ContentLength = r.ContentLength
+	copyHeaders(out.Header, r.Header)
+	out.Header.Set(targetHeader, r.URL.String())
+
+	resp, err := p.e.workers.Forward(worker, out)
+	if err != nil {
+		sp.end(err)
+		http.Error(w, "worker unreachable", http.StatusBadGateway)
+		return
+	}
+	sp.set("status", resp.StatusCode)
+	sp.end(nil)
+	defer resp.Body.Close()
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, meteredReader{resp.Body, func(n int) {
+		m.proxyReceived.Add(uint64(n))
+		p.e.bandwidth.proxy(worker, uint64(n), 0)
+	}})
+}
+
+// proxyWorker returns the session worker if it supports feature, otherwise
+// another worker of the session pool that does.
+func (e *Engine) proxyWorker(feature string) (string, bool) {
+	c, active := e.sess.current()
+	if !active {
+		return "", false
+	}
+	if c.Worker != "" {
+		for _, w := range e.workers.List() {
+			if w.URL == c.Worker && w.Active && w.Health.Supports(feature) {
+				return c.Worker, true
+			}
+		}
+	}
+	e.sess.mu.Lock()
+	pool := e.sess.pool
+	e.sess.mu.Unlock()
+	return e.workers.NextIn(pool, feature)
+}
+
+// copyHeaders copies src into dst leaving out hop-by-hop and protocol headers.
+func copyHeaders(dst, src http.Header) {
+	drop := map[string]bool{}
+	for _, h := range hopHeaders {
+		drop[h] = true
+	}
+	for _, f := range strings.Split(src.Get("Connection"), ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			drop[http.CanonicalHeaderKey(f)] = true
+		}
+	}
+	for k, vv := range src {
+		if drop[k] || strings.HasPrefix(k, "X-Torwell-") {
+			continue
+		}
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
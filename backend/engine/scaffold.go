@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"crypto/rand"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+//go:embed templates/*.tmpl
+var templateFS embed.FS
+
+// defaultWorkerLimits mirrors the limits of the Cloudflare free tier.
+var defaultWorkerLimits = WorkerLimits{
+	MaxBodyBytes:   100 << 20,
+	RequestsPerDay: 100000,
+	TimeoutMs:      30000,
+}
+
+// ScaffoldWorker renders the Cloudflare Worker templates into dir with a
+// fresh token and returns the token.
+func ScaffoldWorker(dir, name string, force bool) (string, error) {
+	token, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	features, _ := json.Marshal([]string{FeatureFetch, FeatureWebSocket, FeatureDoH})
+	data := struct {
+		Name              string
+		Protocol          int
+		FeaturesJSON      string
+		HealthPath        string
+		CompatibilityDate string
+		Limits            WorkerLimits
+	}{name, maxWorkerProtocol, string(features), defaultHealthPath, time.Now().Format("2006-01-02"), defaultWorkerLimits}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	files := map[string]string{"worker.js": "templates/worker.js.tmpl", "wrangler.toml": "templates/wrangler.toml.tmpl"}
+	for out, tmpl := range files {
+		t, err := template.ParseFS(templateFS, tmpl)
+		if err != nil {
+			return "", err
+		}
+		if err := writeNew(filepath.Join(dir, out), 0644, force, func(w io.Writer) error { return t.Execute(w, data) }); err != nil {
+			return "", err
+		}
+	}
+	err = writeNew(filepath.Join(dir, ".dev.vars"), 0600, force, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "TORWELL_TOKEN=%s\n", token)
+		return err
+	})
+	return token, err
+}
+
+// writeNew creates path and fills it with fn, refusing to overwrite
+// existing files unless force is set.
+func writeNew(path string, perm os.FileMode, force bool, fn func(io.Writer) error) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		return err
+	}
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// NewToken returns a random URL-safe secret.
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
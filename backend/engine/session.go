@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"errors"
+	"sync"
+)
+
+// errNoWorkerLeft fails a session whose pool has no healthy worker left.
+var errNoWorkerLeft = errors.New("no active worker left in pool")
+
+// session binds the circuit and worker chosen by /connect for as long as
+// the connection lasts. Failover only picks workers from the same pool.
+type session struct {
+	e       *Engine
+	mu      sync.Mutex
+	active  bool
+	pool    Pool
+	circuit Circuit
+}
+
+// start opens a session on circuit c restricted to pool.
+func (s *session) start(c Circuit, pool Pool) Circuit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = true
+	s.pool = pool
+	c.Worker, _ = s.e.workers.NextIn(pool, "")
+	s.circuit = c
+	return c
+}
+
+// stop ends the session.
+func (s *session) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = false
+	s.circuit = Circuit{}
+	s.pool = Pool{}
+}
+
+// rotate moves the session to circuit c keeping the bound worker.
+func (s *session) rotate(c Circuit) Circuit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.active {
+		return c
+	}
+	c.Worker = s.circuit.Worker
+	s.circuit = c
+	return c
+}
+
+// current returns the bound circuit and whether a session is active.
+func (s *session) current() (Circuit, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.circuit, s.active
+}
+
+// failover rebinds the session when its worker became unhealthy. A
+// connected session stays in StateReconnecting until a worker of its pool
+// passes a fresh health check, and moves to StateError, unbound, when none
+// is left. The checks run without the session lock.
+func (s *session) failover() {
+	s.mu.Lock()
+	if !s.active {
+		s.mu.Unlock()
+		return
+	}
+	old, pool := s.circuit.Worker, s.pool
+	s.mu.Unlock()
+	if old != "" && s.e.workers.Active(old) {
+		return
+	}
+	next, ok := s.e.workers.NextIn(pool, "")
+	if !ok && old == "" {
+		return
+	}
+	// only a connected session passes through StateReconnecting
+	reconnecting := s.e.setState(StateReconnecting) == nil
+	for ok && s.e.workers.Recheck(next) != nil {
+		s.e.connLog.warn(compSession, "failover worker failed its health check", "worker", next)
+		next, ok = s.e.workers.NextIn(pool, "")
+	}
+
+	s.mu.Lock()
+	if !s.active || s.circuit.Worker != old {
+		// disconnected or rebound meanwhile
+		s.mu.Unlock()
+		return
+	}
+	if !ok {
+		id := s.circuit.ID
+		s.active = false
+		s.circuit = Circuit{}
+		s.pool = Pool{}
+		s.mu.Unlock()
+		s.e.clearPath()
+		s.e.connLog.warn(compSession, "no active worker left in pool", "circuit", id, "previous_worker", old)
+		if reconnecting {
+			s.e.fail(StateReconnecting, errNoWorkerLeft)
+		}
+		return
+	}
+	s.circuit.Worker = next
+	c := s.circuit
+	s.mu.Unlock()
+	s.e.connLog.info(compSession, "worker failover", "circuit", c.ID, "worker", next, "previous_worker", old)
+	s.e.publish(EventCircuit, c)
+	if reconnecting {
+		s.e.setState(StateConnected)
+	}
+}
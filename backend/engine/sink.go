@@ -0,0 +1,580 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink types.
+const (
+	SinkFile   = "file"
+	SinkStderr = "stderr"
+	SinkSyslog = "syslog"
+	SinkMemory = "memory"
+)
+
+// logNames are the logs a sink can receive.
+var logNames = []string{"connection", "general"}
+
+// LogSink receives the records of the connection and general logs. Write
+// is called with the log name in the order the records are added and must
+// not block for long.
+type LogSink interface {
+	Write(log string, r LogRecord) error
+	Close() error
+}
+
+// SinkConfig configures a log sink. Records below Level are not passed to
+// it, and neither are the logs missing from Logs when it is set.
+type SinkConfig struct {
+	// Name identifies the sink; it defaults to the type.
+	Name  string   `json:"name,omitempty"`
+	Type  string   `json:"type"`
+	Level Level    `json:"level"`
+	Logs  []string `json:"logs,omitempty"`
+	// Dir is the directory of a file sink, logs/ in the config directory
+	// by default. Only that one is served by /logs/files.
+	Dir string `json:"dir,omitempty"`
+	// Network ("udp" or "unixgram"), Address and Facility select the
+	// syslog server, the local /dev/log by default.
+	Network  string `json:"network,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Facility string `json:"facility,omitempty"`
+	// Size is the number of records a memory sink keeps, 1000 by default.
+	Size int `json:"size,omitempty"`
+}
+
+// name returns the configured name or the type.
+func (c SinkConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Type
+}
+
+// defaultSinks writes both logs to files.
+func defaultSinks() []SinkConfig {
+	return []SinkConfig{{Type: SinkFile, Level: LevelDebug}}
+}
+
+// validateSinks rejects unknown types, logs and facilities, and duplicate
+// names.
+func validateSinks(cfgs []SinkConfig) error {
+	names := map[string]bool{}
+	for _, c := range cfgs {
+		var msg string
+		switch {
+		case c.Type != SinkFile && c.Type != SinkStderr && c.Type != SinkSyslog && c.Type != SinkMemory:
+			msg = fmt.Sprintf("unknown sink type %q; use file, stderr, syslog or memory", c.Type)
+		case names[c.name()]:
+			msg = fmt.Sprintf("duplicate sink name %q", c.name())
+		case c.Network != "" && c.Network != "udp" && c.Network != "unixgram":
+			msg = fmt.Sprintf("unknown syslog network %q; use udp or unixgram", c.Network)
+		case c.Facility != "" && !knownFacility(c.Facility):
+			msg = fmt.Sprintf("unknown syslog facility %q", c.Facility)
+		case c.Size < 0:
+			msg = "sink size must not be negative"
+		}
+		for _, l := range c.Logs {
+			if l != "connection" && l != "general" {
+				msg = fmt.Sprintf("unknown log %q; use connection or general", l)
+			}
+		}
+		if msg != "" {
+			return &RequestError{http.StatusBadRequest, codeBadRequest, msg}
+		}
+		names[c.name()] = true
+	}
+	return nil
+}
+
+// SinkInfo is a sink as listed by /logs/sinks.
+type SinkInfo struct {
+	SinkConfig
+	Written uint64 `json:"written"`
+	// Error is the last error opening or writing the sink.
+	Error string `json:"error,omitempty"`
+}
+
+// sink is an open LogSink with its config. Extra sinks come from the
+// embedder and outlive reconfiguration.
+type sink struct {
+	cfg   SinkConfig
+	extra bool
+	LogSink
+
+	mu      sync.Mutex
+	written uint64
+	err     string
+}
+
+// accepts reports whether r of log passes the sink's filters.
+func (s *sink) accepts(log string, r LogRecord) bool {
+	if r.Level < s.cfg.Level {
+		return false
+	}
+	if len(s.cfg.Logs) == 0 {
+		return true
+	}
+	for _, l := range s.cfg.Logs {
+		if l == log {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sink) info() SinkInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SinkInfo{SinkConfig: s.cfg, Written: s.written, Error: s.err}
+}
+
+// sinkSet passes the records of both logs to the open sinks.
+type sinkSet struct {
+	mu     sync.RWMutex
+	sinks  []*sink
+	closed bool
+}
+
+// write passes r to every sink accepting it.
+func (ss *sinkSet) write(log string, r LogRecord) {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	for _, s := range ss.sinks {
+		if s.LogSink == nil || !s.accepts(log, r) {
+			continue
+		}
+		err := s.Write(log, r)
+		s.mu.Lock()
+		s.written++
+		if err != nil {
+			s.err = err.Error()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// configure opens the sinks of cfgs. Sinks whose config did not change
+// are kept, so memory sinks keep their records; the others are closed.
+// Sinks that fail to open are listed with their error.
+func (ss *sinkSet) configure(cfgs []SinkConfig, open func(SinkConfig) (LogSink, error)) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		return
+	}
+	old := map[string]*sink{}
+	var extra []*sink
+	for _, s := range ss.sinks {
+		if s.extra {
+			extra = append(extra, s)
+		} else {
+			old[s.cfg.name()] = s
+		}
+	}
+	sinks := make([]*sink, 0, len(cfgs)+len(extra))
+	for _, c := range cfgs {
+		if s, ok := old[c.name()]; ok && reflect.DeepEqual(s.cfg, c) && s.LogSink != nil {
+			delete(old, c.name())
+			sinks = append(sinks, s)
+			continue
+		}
+		s := &sink{cfg: c}
+		ls, err := open(c)
+		if err != nil {
+			log.Printf("log sink %s: %v", c.name(), err)
+			s.err = err.Error()
+		} else {
+			s.LogSink = ls
+		}
+		sinks = append(sinks, s)
+	}
+	for _, s := range old {
+		if s.LogSink != nil {
+			s.Close()
+		}
+	}
+	ss.sinks = append(sinks, extra...)
+}
+
+// add appends a sink opened by the embedder.
+func (ss *sinkSet) add(name string, ls LogSink, level Level) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.sinks = append(ss.sinks, &sink{cfg: SinkConfig{Name: name, Level: level}, extra: true, LogSink: ls})
+}
+
+// list returns the sinks in order.
+func (ss *sinkSet) list() []SinkInfo {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	infos := make([]SinkInfo, 0, len(ss.sinks))
+	for _, s := range ss.sinks {
+		infos = append(infos, s.info())
+	}
+	return infos
+}
+
+// find returns the open sink called name.
+func (ss *sinkSet) find(name string) LogSink {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	for _, s := range ss.sinks {
+		if s.cfg.name() == name {
+			return s.LogSink
+		}
+	}
+	return nil
+}
+
+// files returns the writers of log in the file sinks.
+func (ss *sinkSet) files(log string) []*logWriter {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	var ws []*logWriter
+	for _, s := range ss.sinks {
+		if fs, ok := s.LogSink.(*fileSink); ok && fs.writers[log] != nil {
+			ws = append(ws, fs.writers[log])
+		}
+	}
+	return ws
+}
+
+// clearFiles clears the files of log in the file sinks. The lock is held
+// until the writers are done, so configure cannot close them meanwhile.
+func (ss *sinkSet) clearFiles(log string) error {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	for _, s := range ss.sinks {
+		if fs, ok := s.LogSink.(*fileSink); ok && fs.writers[log] != nil {
+			if err := fs.writers[log].clear(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setLogConfig passes new file limits to the file sinks.
+func (ss *sinkSet) setLogConfig(cfg LogConfig) {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	for _, s := range ss.sinks {
+		if fs, ok := s.LogSink.(*fileSink); ok {
+			for _, w := range fs.writers {
+				w.setConfig(cfg)
+			}
+		}
+	}
+}
+
+// close flushes and closes every sink; later records are not written.
+func (ss *sinkSet) close() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, s := range ss.sinks {
+		if s.LogSink != nil {
+			s.Close()
+		}
+	}
+	ss.sinks = nil
+	ss.closed = true
+}
+
+// openSink opens the sink of c. Only sinks opened at startup rotate their
+// files on start.
+func (e *Engine) openSink(c SinkConfig, start bool) (LogSink, error) {
+	switch c.Type {
+	case SinkFile:
+		dir := c.Dir
+		if dir == "" {
+			dir = e.logDir()
+		}
+		lc := e.getConfig().Logs
+		lc.RotateOnStart = lc.RotateOnStart && start
+		return newFileSink(dir, c.Logs, lc)
+	case SinkStderr:
+		return &textSink{w: os.Stderr}, nil
+	case SinkSyslog:
+		return newSyslogSink(c)
+	case SinkMemory:
+		return newRingSink(c.Size), nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q", c.Type)
+}
+
+// configureSinks opens the sinks of the current config.
+func (e *Engine) configureSinks(start bool) {
+	e.sinks.configure(e.getConfig().LogSinks, func(c SinkConfig) (LogSink, error) {
+		return e.openSink(c, start)
+	})
+}
+
+// WithLogSink adds a sink of the embedder that receives the records at
+// level and above. It is listed by /logs/sinks but not kept in the config.
+func WithLogSink(name string, s LogSink, level Level) Option {
+	return func(e *Engine) { e.sinks.add(name, s, level) }
+}
+
+// fileSink writes each log as JSON lines to its own rotating file.
+type fileSink struct {
+	writers map[string]*logWriter
+}
+
+func newFileSink(dir string, logs []string, cfg LogConfig) (*fileSink, error) {
+	if len(logs) == 0 {
+		logs = logNames
+	}
+	fs := &fileSink{writers: map[string]*logWriter{}}
+	for _, l := range logs {
+		w, err := newLogWriter(dir, l, cfg)
+		if err != nil {
+			fs.Close()
+			return nil, err
+		}
+		fs.writers[l] = w
+	}
+	return fs, nil
+}
+
+func (fs *fileSink) Write(log string, r LogRecord) error {
+	if w := fs.writers[log]; w != nil {
+		w.Write(r)
+	}
+	return nil
+}
+
+func (fs *fileSink) Close() error {
+	for _, w := range fs.writers {
+		w.Close()
+	}
+	return nil
+}
+
+// textSink writes records as readable lines, such as
+// "2024-05-01T10:00:05Z INFO  general session: connected circuit=4".
+type textSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (t *textSink) Write(log string, r LogRecord) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %s %s: %s", r.Time.UTC().Format(time.RFC3339), strings.ToUpper(r.Level.String()), log, r.Component, r.Message)
+	for _, k := range sortedKeys(r.Fields) {
+		v := fmt.Sprint(r.Fields[k])
+		if strings.ContainsAny(v, " \t\"=") || v == "" {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, " %s=%s", k, v)
+	}
+	b.WriteByte('\n')
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := io.WriteString(t.w, b.String())
+	return err
+}
+
+func (t *textSink) Close() error {
+	return nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// syslogFacilities maps facility names to their codes.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "daemon": 3, "auth": 4, "syslog": 5,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+func knownFacility(f string) bool {
+	_, ok := syslogFacilities[f]
+	return ok
+}
+
+// syslogWriteTimeout keeps a full local socket from blocking the logs.
+const syslogWriteTimeout = 100 * time.Millisecond
+
+// syslogSink sends records as RFC 5424 messages, one per datagram. The
+// log name is the MSGID and the component and fields are structured data.
+type syslogSink struct {
+	mu       sync.Mutex
+	network  string
+	address  string
+	facility int
+	host     string
+	conn     net.Conn
+}
+
+func newSyslogSink(c SinkConfig) (*syslogSink, error) {
+	s := &syslogSink{network: c.Network, address: c.Address, facility: syslogFacilities["daemon"], host: "-"}
+	if s.network == "" {
+		s.network = "unixgram"
+	}
+	if s.address == "" {
+		s.address = "/dev/log"
+		if runtime.GOOS == "darwin" {
+			s.address = "/var/run/syslog"
+		}
+	}
+	if f, ok := syslogFacilities[c.Facility]; ok {
+		s.facility = f
+	}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		s.host = h
+	}
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *syslogSink) dial() error {
+	conn, err := net.DialTimeout(s.network, s.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// syslogSeverity maps a level to a syslog severity.
+func syslogSeverity(l Level) int {
+	switch l {
+	case LevelDebug:
+		return 7
+	case LevelInfo:
+		return 6
+	case LevelWarn:
+		return 4
+	}
+	return 3
+}
+
+// format renders r as "<PRI>1 TIMESTAMP HOST APP PROCID MSGID [SD] MSG".
+func (s *syslogSink) format(log string, r LogRecord) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s torwell84 %d %s [torwell84@32473 component=\"%s\"",
+		s.facility*8+syslogSeverity(r.Level), r.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.host, os.Getpid(), log, sdEscape(r.Component))
+	for _, k := range sortedKeys(r.Fields) {
+		fmt.Fprintf(&b, " %s=\"%s\"", sdName(k), sdEscape(fmt.Sprint(r.Fields[k])))
+	}
+	b.WriteString("] ")
+	b.WriteString(r.Message)
+	return b.String()
+}
+
+func (s *syslogSink) Write(log string, r LogRecord) error {
+	msg := s.format(log, r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	if _, err := io.WriteString(s.conn, msg); err != nil {
+		// redial with the next record, the server may have restarted
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// sdEscape escapes a structured data parameter value.
+func sdEscape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(v)
+}
+
+// sdName turns a field key into a valid parameter name: printable ASCII
+// without '=', ' ', ']' and '"', at most 32 characters.
+func sdName(k string) string {
+	b := []byte(k)
+	for i, c := range b {
+		if c <= ' ' || c > '~' || c == '=' || c == ']' || c == '"' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 32 {
+		b = b[:32]
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
+
+// SinkRecord is a record kept by a memory sink with the log it came from.
+type SinkRecord struct {
+	Log string `json:"log"`
+	LogRecord
+}
+
+// ringSink keeps the last records in memory.
+type ringSink struct {
+	mu      sync.Mutex
+	size    int
+	records []SinkRecord
+}
+
+func newRingSink(size int) *ringSink {
+	if size == 0 {
+		size = 1000
+	}
+	return &ringSink{size: size}
+}
+
+func (rs *ringSink) Write(log string, r LogRecord) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.records = append(rs.records, SinkRecord{Log: log, LogRecord: r})
+	if len(rs.records) > rs.size {
+		rs.records = rs.records[len(rs.records)-rs.size:]
+	}
+	return nil
+}
+
+// Records returns a copy of the kept records, oldest first.
+func (rs *ringSink) Records() []SinkRecord {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return append([]SinkRecord{}, rs.records...)
+}
+
+func (rs *ringSink) Close() error {
+	return nil
+}
@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConnState is the state of the tor connection.
+type ConnState string
+
+// Connection states.
+const (
+	StateDisconnected  ConnState = "disconnected"
+	StateConnecting    ConnState = "connecting"
+	StateBootstrapping ConnState = "bootstrapping"
+	StateConnected     ConnState = "connected"
+	StateReconnecting  ConnState = "reconnecting"
+	StateDisconnecting ConnState = "disconnecting"
+	StateError         ConnState = "error"
+)
+
+// transitions lists the states each state may move to.
+var transitions = map[ConnState][]ConnState{
+	StateDisconnected:  {StateConnecting},
+	StateConnecting:    {StateBootstrapping, StateDisconnecting, StateError},
+	StateBootstrapping: {StateConnected, StateDisconnecting, StateError},
+	StateConnected:     {StateReconnecting, StateDisconnecting, StateError},
+	StateReconnecting:  {StateConnected, StateDisconnecting, StateError},
+	StateDisconnecting: {StateDisconnected, StateError},
+	StateError:         {StateConnecting, StateDisconnecting},
+}
+
+// stateMachine holds the connection state, when it was entered and the
+// last error.
+type stateMachine struct {
+	mu      sync.Mutex
+	state   ConnState
+	since   time.Time
+	lastErr string
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{state: StateDisconnected, since: time.Now()}
+}
+
+// errInvalidTransition builds the 409 returned for a refused transition.
+func errInvalidTransition(from, to ConnState) error {
+	return &RequestError{http.StatusConflict, codeInvalidState, fmt.Sprintf("cannot go from %s to %s", from, to)}
+}
+
+// to moves to state next if that is allowed from the current state.
+func (m *stateMachine) to(next ConnState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.toLocked(next)
+}
+
+func (m *stateMachine) toLocked(next ConnState) error {
+	for _, s := range transitions[m.state] {
+		if s == next {
+			m.state = next
+			m.since = time.Now()
+			return nil
+		}
+	}
+	return errInvalidTransition(m.state, next)
+}
+
+// fail moves from state from to StateError recording err. It reports
+// false when the state moved on meanwhile, for example to a disconnect.
+func (m *stateMachine) fail(from ConnState, err error) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state != from || m.toLocked(StateError) != nil {
+		return false
+	}
+	m.lastErr = err.Error()
+	return true
+}
+
+// reset returns to StateDisconnected from any state.
+func (m *stateMachine) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state != StateDisconnected {
+		m.state = StateDisconnected
+		m.since = time.Now()
+	}
+}
+
+// StateInfo describes the connection state in /status.
+type StateInfo struct {
+	State ConnState `json:"state"`
+	Since time.Time `json:"since"`
+	// DurationMs is how long the state has held.
+	DurationMs int64  `json:"durationMs"`
+	LastError  string `json:"lastError,omitempty"`
+}
+
+func (m *stateMachine) info() StateInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return StateInfo{
+		State:      m.state,
+		Since:      m.since,
+		DurationMs: time.Since(m.since).Milliseconds(),
+		LastError:  m.lastErr,
+	}
+}
+
+func (m *stateMachine) current() ConnState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
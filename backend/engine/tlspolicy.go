@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrPinMismatch is returned when a worker presents a key that matches none
+// of its configured SPKI pins.
+var ErrPinMismatch = errors.New("tls pin mismatch")
+
+// TLSPolicy describes how connections to a single worker are secured.
+// The zero value enforces TLS 1.3 with AEAD ciphers and pins the worker key
+// on first use.
+type TLSPolicy struct {
+	// MinVersion is "1.3" (default) or "1.2".
+	MinVersion string `json:",omitempty"`
+	// Ciphers selects the TLS 1.2 suites: "aead" (default) allows
+	// ChaCha20-Poly1305 and AES-GCM, "chacha20" allows ChaCha20-Poly1305
+	// only. TLS 1.3 suites are chosen by the Go runtime, which prefers
+	// ChaCha20-Poly1305 on hardware without AES acceleration.
+	Ciphers string `json:",omitempty"`
+	// Pins holds base64 SHA-256 hashes of accepted SubjectPublicKeyInfos.
+	Pins []string `json:",omitempty"`
+	// CAFile is an optional PEM bundle used instead of the system roots.
+	CAFile string `json:",omitempty"`
+	// NoTOFU disables capturing a pin on the first successful check.
+	NoTOFU bool `json:",omitempty"`
+}
+
+var (
+	aeadSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+	chachaSuites = aeadSuites[:2]
+)
+
+// config builds a tls.Config enforcing the policy.
+func (p *TLSPolicy) config() (*tls.Config, error) {
+	var pol TLSPolicy
+	if p != nil {
+		pol = *p
+	}
+	c := &tls.Config{}
+	switch pol.MinVersion {
+	case "", "1.3":
+		c.MinVersion = tls.VersionTLS13
+	case "1.2":
+		c.MinVersion = tls.VersionTLS12
+	default:
+		return nil, fmt.Errorf("unsupported tls version %q", pol.MinVersion)
+	}
+	switch pol.Ciphers {
+	case "", "aead":
+		c.CipherSuites = aeadSuites
+	case "chacha20":
+		c.CipherSuites = chachaSuites
+	default:
+		return nil, fmt.Errorf("unsupported cipher preference %q", pol.Ciphers)
+	}
+	if pol.CAFile != "" {
+		b, err := os.ReadFile(pol.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificates in ca file")
+		}
+		c.RootCAs = pool
+	}
+	if len(pol.Pins) > 0 {
+		pins := make(map[string]bool, len(pol.Pins))
+		for _, p := range pol.Pins {
+			pins[p] = true
+		}
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				if pins[spkiPin(cert)] {
+					return nil
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+	return c, nil
+}
+
+// spkiPin returns the base64 SHA-256 hash of the certificate public key.
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (p *TLSPolicy) noTOFU() bool {
+	return p != nil && p.NoTOFU
+}
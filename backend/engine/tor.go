@@ -0,0 +1,290 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errTorNotRunning = errors.New("tor is not running")
+
+// BootstrapStatus is a tor bootstrap phase, as in
+// "Bootstrapped 45% (requesting_descriptors): Asking for relay descriptors".
+type BootstrapStatus struct {
+	Percent int    `json:"percent"`
+	Tag     string `json:"tag"`
+	Summary string `json:"summary"`
+}
+
+// Bootstrapper is implemented by tor engines that report their bootstrap
+// progress. Engines without it count as bootstrapped once started.
+type Bootstrapper interface {
+	// Bootstrap calls fn for each new bootstrap status and returns once tor
+	// reached 100%, failed or ctx is done.
+	Bootstrap(ctx context.Context, fn func(BootstrapStatus)) error
+}
+
+// Relay is a tor relay on the circuit path.
+type Relay struct {
+	Nickname    string `json:"nickname,omitempty"`
+	Fingerprint string `json:"fingerprint"`
+	Country     string `json:"country,omitempty"`
+	Address     string `json:"address,omitempty"`
+}
+
+// PathReporter is implemented by tor engines that can tell which relays
+// carry the traffic, from the entry guard to the exit.
+type PathReporter interface {
+	CircuitPath(ctx context.Context) ([]Relay, error)
+}
+
+// TorEvent is an asynchronous control port event, such as "WARN" with
+// the text of the log message or "STATUS_CLIENT" with
+// "NOTICE CIRCUIT_ESTABLISHED".
+type TorEvent struct {
+	Type string
+	Text string
+}
+
+// EventSource is implemented by tor engines that report control port
+// events.
+type EventSource interface {
+	// Events calls fn for each event of the given types and returns once
+	// tor exits or ctx is done.
+	Events(ctx context.Context, types []string, fn func(TorEvent)) error
+}
+
+var bootstrapRE = regexp.MustCompile(`Bootstrapped (\d+)%(?: \(([a-z_]+)\))?: (.*)`)
+
+// parseBootstrap parses a bootstrap notice from a tor log line.
+func parseBootstrap(line string) (BootstrapStatus, bool) {
+	m := bootstrapRE.FindStringSubmatch(line)
+	if m == nil {
+		return BootstrapStatus{}, false
+	}
+	pct, _ := strconv.Atoi(m[1])
+	return BootstrapStatus{Percent: pct, Tag: m[2], Summary: m[3]}, true
+}
+
+// torBinary returns the tor executable, honouring TOR_BINARY.
+func torBinary() string {
+	if t := os.Getenv("TOR_BINARY"); t != "" {
+		return t
+	}
+	return "tor"
+}
+
+// torProcess runs tor as a child process using the uploaded torrc when
+// present. The child exits on its own when the backend dies.
+type torProcess struct {
+	dir  string
+	mu   sync.Mutex
+	cmd  *exec.Cmd
+	done chan struct{}
+
+	// boot is the last bootstrap status; changed is closed and replaced
+	// whenever it moves.
+	boot    BootstrapStatus
+	changed chan struct{}
+
+	// ctrl is dialled on first use and closed with tor.
+	ctrl *controlConn
+}
+
+func (t *torProcess) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cmd != nil {
+		return nil
+	}
+	data := filepath.Join(t.dir, "tor")
+	if err := os.MkdirAll(data, 0700); err != nil {
+		return err
+	}
+	// bootstrap progress is read from the notice log on stdout, circuit
+	// details from the control port
+	args := []string{
+		"--DataDirectory", data,
+		"--Log", "notice stdout",
+		"--ControlPort", "auto",
+		"--ControlPortWriteToFile", filepath.Join(data, controlPortFile),
+		"--CookieAuthentication", "1",
+		"--CookieAuthFile", filepath.Join(data, controlCookieFile),
+		"__OwningControllerProcess", strconv.Itoa(os.Getpid()),
+	}
+	os.Remove(filepath.Join(data, controlPortFile))
+	if torrc := filepath.Join(t.dir, "torrc"); fileExists(torrc) {
+		args = append([]string{"-f", torrc}, args...)
+	}
+	cmd := exec.Command(torBinary(), args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	t.boot, t.changed = BootstrapStatus{}, make(chan struct{})
+	go func() {
+		t.readLog(stdout)
+		cmd.Wait()
+		t.mu.Lock()
+		if t.cmd == cmd {
+			t.cmd = nil
+			if t.ctrl != nil {
+				t.ctrl.Close()
+				t.ctrl = nil
+			}
+		}
+		t.mu.Unlock()
+		close(done)
+	}()
+	t.cmd, t.done = cmd, done
+	return nil
+}
+
+// readLog follows the tor log until tor exits.
+func (t *torProcess) readLog(r io.Reader) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if st, ok := parseBootstrap(sc.Text()); ok {
+			t.mu.Lock()
+			t.boot = st
+			close(t.changed)
+			t.changed = make(chan struct{})
+			t.mu.Unlock()
+		}
+	}
+}
+
+// Bootstrap reports the bootstrap status of the running tor to fn until it
+// reaches 100%.
+func (t *torProcess) Bootstrap(ctx context.Context, fn func(BootstrapStatus)) error {
+	var last BootstrapStatus
+	for {
+		t.mu.Lock()
+		st, changed, done := t.boot, t.changed, t.done
+		t.mu.Unlock()
+		if done == nil {
+			return errTorNotRunning
+		}
+		if st != last {
+			fn(st)
+			last = st
+		}
+		if st.Percent >= 100 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-done:
+			return errors.New("tor exited during bootstrap")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// CircuitPath asks the control port for the relays of the newest circuit.
+func (t *torProcess) CircuitPath(ctx context.Context) ([]Relay, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cmd == nil {
+		return nil, errTorNotRunning
+	}
+	if t.ctrl == nil {
+		c, err := dialControl(ctx, filepath.Join(t.dir, "tor"))
+		if err != nil {
+			return nil, err
+		}
+		t.ctrl = c
+	}
+	path, err := t.ctrl.circuitPath(ctx)
+	if err != nil && !errors.Is(err, errNoCircuit) {
+		// redial on the next call
+		t.ctrl.Close()
+		t.ctrl = nil
+	}
+	return path, err
+}
+
+// Events follows the control port events on a connection of its own, so
+// they do not interleave with command replies.
+func (t *torProcess) Events(ctx context.Context, types []string, fn func(TorEvent)) error {
+	t.mu.Lock()
+	running, done := t.cmd != nil, t.done
+	t.mu.Unlock()
+	if !running {
+		return errTorNotRunning
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	// tor writes the port file once the control port listens
+	var c *controlConn
+	for {
+		var err error
+		if c, err = dialControl(ctx, filepath.Join(t.dir, "tor")); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+	err := c.subscribe(ctx, types, fn)
+	if ctx.Err() != nil {
+		// closed with tor
+		return nil
+	}
+	return err
+}
+
+// Stop asks tor to exit and kills it when ctx expires first.
+func (t *torProcess) Stop(ctx context.Context) error {
+	t.mu.Lock()
+	cmd, done := t.cmd, t.done
+	t.mu.Unlock()
+	if cmd == nil {
+		return nil
+	}
+	if runtime.GOOS == "windows" {
+		cmd.Process.Kill()
+	} else if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		cmd.Process.Kill()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-done
+		return errors.New("tor did not exit in time")
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
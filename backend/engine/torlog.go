@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// torEvents are the control port events followed: log and status events
+// are copied into the logs, circuit events counted for the metrics and
+// bandwidth and stream events kept for the bandwidth statistics.
+var torEvents = []string{"NOTICE", "WARN", "ERR", "STATUS_CLIENT", "STATUS_GENERAL", "CIRC", "BW", "STREAM", "STREAM_BW"}
+
+// torRepeatWindow is how long a repeated tor message stays suppressed.
+const torRepeatWindow = time.Minute
+
+// followTor copies the log and status events of tor into the logs, counts
+// its circuits and records its bandwidth until tor exits or ctx is done.
+func (e *Engine) followTor(ctx context.Context) {
+	src, ok := e.tor.(EventSource)
+	if !ok {
+		return
+	}
+	rl := newRepeatLimiter(torRepeatWindow)
+	err := src.Events(ctx, torEvents, func(ev TorEvent) {
+		switch ev.Type {
+		case "CIRC":
+			e.metrics.countCircuit(ev)
+		case "BW", "STREAM", "STREAM_BW":
+			e.bandwidth.torEvent(ev)
+		default:
+			e.logTorEvent(ev, rl)
+		}
+	})
+	if err != nil {
+		e.genLog.warn(compTor, "tor events unavailable", "error", err.Error())
+	}
+}
+
+// logTorEvent writes ev to the connection log, and to the general log when
+// it is a warning, an error or a general status event. Messages repeated
+// within the window are dropped and counted on the next one let through.
+func (e *Engine) logTorEvent(ev TorEvent, rl *repeatLimiter) {
+	level, msg, kv, ok := parseTorEvent(ev)
+	if !ok {
+		return
+	}
+	allow, suppressed := rl.allow(ev.Type + " " + ev.Text)
+	if !allow {
+		return
+	}
+	kv = append([]interface{}{"event", ev.Type}, kv...)
+	if suppressed > 0 {
+		kv = append(kv, "suppressed", suppressed)
+	}
+	e.connLog.log(level, compTor, msg, kv...)
+	if level >= LevelWarn || ev.Type == "STATUS_GENERAL" {
+		e.genLog.log(level, compTor, msg, kv...)
+	}
+}
+
+// parseTorEvent maps a tor event to a log record. Status events become
+// their lower-cased action with the arguments as fields. Bootstrap notices
+// are skipped, Connect already logs them as progress.
+func parseTorEvent(ev TorEvent) (level Level, msg string, kv []interface{}, ok bool) {
+	switch ev.Type {
+	case "NOTICE", "WARN", "ERR":
+		if ev.Type == "NOTICE" && bootstrapRE.MatchString(ev.Text) {
+			return 0, "", nil, false
+		}
+		return torSeverity(ev.Type), ev.Text, nil, true
+	case "STATUS_CLIENT", "STATUS_GENERAL":
+		f := strings.SplitN(ev.Text, " ", 3)
+		if len(f) < 2 {
+			return 0, "", nil, false
+		}
+		severity, action := f[0], f[1]
+		if action == "BOOTSTRAP" && severity == "NOTICE" {
+			return 0, "", nil, false
+		}
+		if len(f) == 3 {
+			for k, v := range parseKeywords(f[2]) {
+				kv = append(kv, strings.ToLower(k), v)
+			}
+		}
+		msg = strings.ToLower(strings.ReplaceAll(action, "_", " "))
+		return torSeverity(severity), msg, kv, true
+	}
+	return 0, "", nil, false
+}
+
+// torSeverity maps a tor severity to a level.
+func torSeverity(s string) Level {
+	switch s {
+	case "DEBUG":
+		return LevelDebug
+	case "WARN":
+		return LevelWarn
+	case "ERR":
+		return LevelError
+	}
+	return LevelInfo
+}
+
+// parseKeywords parses the KEY=VALUE arguments of a status event. Values
+// may be quoted with backslash escapes.
+func parseKeywords(s string) map[string]string {
+	m := map[string]string{}
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		key, rest, found := strings.Cut(s, "=")
+		if !found || strings.Contains(key, " ") {
+			// a bare word; skip it
+			_, s, _ = strings.Cut(s, " ")
+			continue
+		}
+		if !strings.HasPrefix(rest, `"`) {
+			m[key], s, _ = strings.Cut(rest, " ")
+			continue
+		}
+		var b strings.Builder
+		i := 1
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] == '\\' && i+1 < len(rest) {
+				i++
+			}
+			b.WriteByte(rest[i])
+		}
+		m[key] = b.String()
+		if i < len(rest) {
+			i++
+		}
+		s = rest[i:]
+	}
+	return m
+}
+
+// repeatLimiter lets a message through once per window and counts the
+// repeats it holds back.
+type repeatLimiter struct {
+	mu     sync.Mutex
+	window time.Duration
+	now    func() time.Time
+	seen   map[string]*repeat
+}
+
+type repeat struct {
+	since      time.Time
+	suppressed int
+}
+
+func newRepeatLimiter(window time.Duration) *repeatLimiter {
+	return &repeatLimiter{window: window, now: time.Now, seen: map[string]*repeat{}}
+}
+
+// allow reports whether msg may be logged and, if so, how many repeats of
+// it were held back before.
+func (l *repeatLimiter) allow(msg string) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	r, ok := l.seen[msg]
+	if ok && now.Sub(r.since) < l.window {
+		r.suppressed++
+		return false, 0
+	}
+	if len(l.seen) >= 1000 {
+		for k, old := range l.seen {
+			if now.Sub(old.since) >= l.window {
+				delete(l.seen, k)
+			}
+		}
+	}
+	n := 0
+	if ok {
+		n = r.suppressed
+	}
+	l.seen[msg] = &repeat{since: now}
+	return true, n
+}
@@ -0,0 +1,382 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracing exports spans of the connect and proxy flows to an
+// OpenTelemetry collector over OTLP/HTTP with JSON encoding.
+const (
+	tracesPath      = "/v1/traces"
+	traceQueueSize  = 2048
+	traceBatchSize  = 256
+	traceInterval   = 2 * time.Second
+	traceTimeout    = 5 * time.Second
+	requestIDHeader = "X-Request-ID"
+)
+
+// TracingConfig sets where spans are exported.
+type TracingConfig struct {
+	// Endpoint is the base URL of a collector on this machine, such as
+	// http://127.0.0.1:4318; empty disables the export.
+	Endpoint string `json:"endpoint"`
+}
+
+// validate accepts empty endpoints and http(s) URLs of loopback hosts:
+// spans name the workers and hosts in use and stay on the machine.
+func (c TracingConfig) validate() error {
+	if c.Endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &RequestError{http.StatusBadRequest, codeBadRequest, "tracing endpoint must be an http(s) url"}
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return &RequestError{http.StatusBadRequest, codeBadRequest, "tracing endpoint must be a local collector"}
+	}
+	return nil
+}
+
+// Span kinds and status codes of OTLP.
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+
+	statusOK    = 1
+	statusError = 2
+)
+
+type (
+	traceID [16]byte
+	spanID  [8]byte
+)
+
+func (t traceID) String() string { return hex.EncodeToString(t[:]) }
+func (s spanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// spanContext identifies a span; a zero span is a remote or missing parent.
+type spanContext struct {
+	trace traceID
+	span  spanID
+}
+
+type spanKey struct{}
+
+func spanFrom(ctx context.Context) (spanContext, bool) {
+	sc, ok := ctx.Value(spanKey{}).(spanContext)
+	return sc, ok
+}
+
+// requestID returns the request ID of ctx, the hex trace ID, or "".
+func requestID(ctx context.Context) string {
+	if sc, ok := spanFrom(ctx); ok {
+		return sc.trace.String()
+	}
+	return ""
+}
+
+// withTraceParent starts the trace of an API request from a W3C
+// traceparent header, or a new trace.
+func withTraceParent(ctx context.Context, header string) context.Context {
+	var sc spanContext
+	f := strings.Split(header, "-")
+	if len(f) == 4 && f[0] == "00" && len(f[1]) == 32 && len(f[2]) == 16 {
+		t, terr := hex.DecodeString(f[1])
+		s, serr := hex.DecodeString(f[2])
+		if terr == nil && serr == nil {
+			copy(sc.trace[:], t)
+			copy(sc.span[:], s)
+		}
+	}
+	if sc.trace == (traceID{}) {
+		sc = spanContext{}
+		rand.Read(sc.trace[:])
+	}
+	return context.WithValue(ctx, spanKey{}, sc)
+}
+
+// span is one timed operation. Methods on a nil span do nothing.
+type span struct {
+	t      *tracer
+	sc     spanContext
+	parent spanID
+	name   string
+	kind   int
+	start  time.Time
+	finish time.Time
+	attrs  []interface{}
+	err    string
+	once   sync.Once
+}
+
+// set adds attributes as alternating keys and values.
+func (s *span) set(kv ...interface{}) {
+	if s != nil {
+		s.attrs = append(s.attrs, kv...)
+	}
+}
+
+// end finishes the span, marking it failed if err is not nil, and queues
+// it for export. Attributes are scrubbed by the exporter, as spans may end
+// under the worker lock the scrubber takes.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		s.finish = time.Now()
+		if err != nil {
+			s.err = err.Error()
+		}
+		s.t.export(s)
+	})
+}
+
+// tracer creates spans and exports them in batches. The zero endpoint
+// still hands out trace IDs for the request IDs of the logs.
+type tracer struct {
+	endpoint func() string
+	// scrub applies the log privacy level to attribute values.
+	scrub   func(key, value string) string
+	onError func(error)
+	client  *http.Client
+
+	queue   chan *span
+	dropped atomic.Uint64
+	failing atomic.Bool
+	done    chan struct{}
+}
+
+func newTracer(endpoint func() string) *tracer {
+	return &tracer{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: traceTimeout},
+		queue:    make(chan *span, traceQueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// start begins a span as a child of the span in ctx, or of a new trace.
+func (t *tracer) start(ctx context.Context, name string, kind int, kv ...interface{}) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	parent, ok := spanFrom(ctx)
+	s := &span{t: t, name: name, kind: kind, start: time.Now(), attrs: kv}
+	if ok {
+		s.sc.trace = parent.trace
+		s.parent = parent.span
+	} else {
+		rand.Read(s.sc.trace[:])
+	}
+	rand.Read(s.sc.span[:])
+	return context.WithValue(ctx, spanKey{}, s.sc), s
+}
+
+// export queues a finished span, dropping it when the queue is full or
+// no collector is set.
+func (t *tracer) export(s *span) {
+	if t.endpoint() == "" {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// run sends the queued spans until ctx is done, then flushes the rest.
+func (t *tracer) run(ctx context.Context) {
+	defer close(t.done)
+	ticker := time.NewTicker(traceInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.queue:
+			if batch = append(batch, s); len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			t.send(batch)
+			return
+		}
+		t.send(batch)
+		batch = nil
+	}
+}
+
+// send posts a batch, reporting the first failure after a success.
+func (t *tracer) send(batch []*span) {
+	endpoint := t.endpoint()
+	if len(batch) == 0 || endpoint == "" {
+		return
+	}
+	err := t.post(endpoint, batch)
+	if err == nil {
+		t.failing.Store(false)
+		return
+	}
+	t.dropped.Add(uint64(len(batch)))
+	if !t.failing.Swap(true) && t.onError != nil {
+		t.onError(err)
+	}
+}
+
+func (t *tracer) post(endpoint string, batch []*span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = s.record()
+	}
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(endpoint, "/")+tracesPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// wait blocks until run has flushed, or ctx is done.
+func (t *tracer) wait(ctx context.Context) {
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+	}
+}
+
+// The OTLP/HTTP JSON encoding: IDs in hex, 64-bit integers as strings.
+type (
+	otlpSpan struct {
+		TraceID      string      `json:"traceId"`
+		SpanID       string      `json:"spanId"`
+		ParentSpanID string      `json:"parentSpanId,omitempty"`
+		Name         string      `json:"name"`
+		Kind         int         `json:"kind"`
+		Start        string      `json:"startTimeUnixNano"`
+		End          string      `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr  `json:"attributes,omitempty"`
+		Status       *otlpStatus `json:"status,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		String *string  `json:"stringValue,omitempty"`
+		Int    *string  `json:"intValue,omitempty"`
+		Bool   *bool    `json:"boolValue,omitempty"`
+		Double *float64 `json:"doubleValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// record converts the span to its OTLP form, scrubbing string values.
+func (s *span) record() otlpSpan {
+	o := otlpSpan{
+		TraceID: s.sc.trace.String(),
+		SpanID:  s.sc.span.String(),
+		Name:    s.name,
+		Kind:    s.kind,
+		Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+		End:     strconv.FormatInt(s.finish.UnixNano(), 10),
+		Status:  &otlpStatus{Code: statusOK},
+	}
+	if s.parent != (spanID{}) {
+		o.ParentSpanID = s.parent.String()
+	}
+	if s.err != "" {
+		o.Status = &otlpStatus{Code: statusError, Message: s.scrubbed("error", s.err)}
+	}
+	for i := 0; i+1 < len(s.attrs); i += 2 {
+		k := fmt.Sprint(s.attrs[i])
+		var v otlpValue
+		switch x := s.attrs[i+1].(type) {
+		case bool:
+			v.Bool = &x
+		case int:
+			n := strconv.Itoa(x)
+			v.Int = &n
+		case int64:
+			n := strconv.FormatInt(x, 10)
+			v.Int = &n
+		case float64:
+			v.Double = &x
+		case time.Duration:
+			f := x.Seconds()
+			v.Double = &f
+		default:
+			str := s.scrubbed(k, fmt.Sprint(x))
+			v.String = &str
+		}
+		o.Attributes = append(o.Attributes, otlpAttr{k, v})
+	}
+	return o
+}
+
+func (s *span) scrubbed(k, v string) string {
+	if s.t.scrub == nil {
+		return v
+	}
+	return s.t.scrub(k, v)
+}
+
+func otlpRequest(spans []otlpSpan) interface{} {
+	str := func(s string) otlpValue { return otlpValue{String: &s} }
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttr{{"service.name", str("torwell84")}, {"service.version", str(Version)}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "torwell84/backend/engine", "version": Version},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+// withRequestID gives every API request a trace, continued from its
+// traceparent header if any, and returns its ID as the request ID.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := withTraceParent(r.Context(), r.Header.Get("traceparent"))
+		w.Header().Set(requestIDHeader, requestID(ctx))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
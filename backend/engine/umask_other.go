@@ -0,0 +1,6 @@
+//go:build !unix
+
+package engine
+
+// withUmask runs fn; the platform has no umask.
+func withUmask(mask int, fn func() error) error { return fn() }
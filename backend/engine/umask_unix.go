@@ -0,0 +1,20 @@
+//go:build unix
+
+package engine
+
+import (
+	"sync"
+	"syscall"
+)
+
+var umaskMu sync.Mutex
+
+// withUmask runs fn with the process umask set to mask, so the files fn
+// creates never have wider permissions.
+func withUmask(mask int, fn func() error) error {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return fn()
+}
@@ -0,0 +1,151 @@
+package engine
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultSoftLimit is the share of the daily quota after which a worker is
+// no longer selected.
+const defaultSoftLimit = 0.9
+
+// WorkerUsage counts the traffic sent through a worker on one UTC day,
+// matching the daily reset of Cloudflare's request limits.
+type WorkerUsage struct {
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// usageTracker keeps per worker usage and persists it across restarts.
+type usageTracker struct {
+	mu       sync.Mutex
+	file     string
+	day      string
+	workers  map[string]*WorkerUsage
+	dirty    bool
+	lastSave time.Time
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{workers: make(map[string]*WorkerUsage)}
+}
+
+func usageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// rollover resets all counters when the UTC day changed. Counters of
+// removed workers are kept until then, so removing and adding a worker
+// again does not reset its quota.
+func (u *usageTracker) rollover() {
+	today := usageDay(time.Now())
+	if u.day == today {
+		return
+	}
+	u.day = today
+	u.workers = make(map[string]*WorkerUsage)
+	u.dirty = true
+}
+
+// Record adds requests and bytes to the usage of a worker.
+func (u *usageTracker) Record(url string, requests, bytes int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	w, ok := u.workers[url]
+	if !ok {
+		w = &WorkerUsage{Day: u.day}
+		u.workers[url] = w
+	}
+	w.Requests += requests
+	w.Bytes += bytes
+	u.dirty = true
+	if time.Since(u.lastSave) > 10*time.Second {
+		_ = u.save()
+	}
+}
+
+// Get returns the usage of a worker for the current day.
+func (u *usageTracker) Get(url string) WorkerUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	if w, ok := u.workers[url]; ok {
+		return *w
+	}
+	return WorkerUsage{Day: u.day}
+}
+
+// Load reads persisted usage, discarding counters of previous days.
+func (u *usageTracker) Load(file string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.file = file
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var stored map[string]*WorkerUsage
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return err
+	}
+	u.rollover()
+	for url, w := range stored {
+		if w != nil && w.Day == u.day {
+			u.workers[url] = w
+		}
+	}
+	return nil
+}
+
+// Flush writes pending usage to disk.
+func (u *usageTracker) Flush() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.save()
+}
+
+func (u *usageTracker) save() error {
+	if u.file == "" || !u.dirty {
+		return nil
+	}
+	b, err := json.MarshalIndent(u.workers, "", "  ")
+	if err != nil {
+		return err
+	}
+	u.lastSave = time.Now()
+	if err := os.WriteFile(u.file, b, 0600); err != nil {
+		return err
+	}
+	u.dirty = false
+	return nil
+}
+
+// countingBody reports the bytes read from a response body once closed.
+type countingBody struct {
+	body interface {
+		Read([]byte) (int, error)
+		Close() error
+	}
+	n    int64
+	done func(int64)
+	once sync.Once
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingBody) Close() error {
+	err := c.body.Close()
+	c.once.Do(func() { c.done(c.n) })
+	return err
+}
@@ -0,0 +1,716 @@
+package engine
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Worker represents a single Cloudflare Worker HTTPS endpoint.
+type Worker struct {
+	URL    string
+	Active bool
+	TLS    *TLSPolicy `json:",omitempty"`
+	Error  string     `json:",omitempty"`
+	// HealthPath overrides the default /.well-known/healthz path.
+	HealthPath string `json:",omitempty"`
+	// Expect lists healthz fields that must be present for the worker
+	// to be considered healthy.
+	Expect []string    `json:",omitempty"`
+	Health *HealthInfo `json:",omitempty"`
+	// Group names the pool the worker belongs to. Within a pool, workers
+	// with a lower Priority value are preferred.
+	Group    string `json:",omitempty"`
+	Priority int    `json:",omitempty"`
+	// Token authenticates the backend to the worker. It is not reported
+	// by List.
+	Token string `json:",omitempty"`
+	// Quota is the daily request budget. When zero, the requestsPerDay
+	// limit advertised in healthz applies. Workers are skipped once the
+	// SoftLimit share of it (0.9 by default) is used.
+	Quota     int64   `json:",omitempty"`
+	SoftLimit float64 `json:",omitempty"`
+	// Usage is filled in by List and not persisted with the worker.
+	Usage *WorkerUsage `json:",omitempty"`
+}
+
+// quota returns the effective daily request budget, zero for unlimited.
+func (w Worker) quota() int64 {
+	if w.Quota > 0 {
+		return w.Quota
+	}
+	if w.Health != nil {
+		return w.Health.Limits.RequestsPerDay
+	}
+	return 0
+}
+
+// nearQuota reports whether the worker used its soft share of the quota.
+func (w Worker) nearQuota(u WorkerUsage) bool {
+	q := w.quota()
+	if q <= 0 {
+		return false
+	}
+	soft := w.SoftLimit
+	if soft <= 0 || soft > 1 {
+		soft = defaultSoftLimit
+	}
+	return float64(u.Requests) >= soft*float64(q)
+}
+
+// WorkerUpdate changes the settings of a configured worker. Nil fields are
+// left untouched.
+type WorkerUpdate struct {
+	Group     *string
+	Priority  *int
+	Quota     *int64
+	SoftLimit *float64
+}
+
+// Pool limits worker selection to an explicit URL list or a named group.
+// The zero Pool contains every worker.
+type Pool struct {
+	URLs  []string `json:"urls,omitempty"`
+	Group string   `json:"group,omitempty"`
+}
+
+func (p Pool) contains(w Worker) bool {
+	if p.Group != "" && w.Group != p.Group {
+		return false
+	}
+	if len(p.URLs) == 0 {
+		return true
+	}
+	for _, u := range p.URLs {
+		if u == w.URL {
+			return true
+		}
+	}
+	return false
+}
+
+// WorkerManager stores and validates worker endpoints.
+type WorkerManager struct {
+	mu      sync.RWMutex
+	workers []Worker
+	client  *http.Client
+	index   int
+	file    string
+
+	cmu     sync.Mutex
+	clients map[string]*http.Client
+
+	watchers []func()
+	usage    *usageTracker
+
+	smu   sync.Mutex
+	stats map[string]*workerStats
+	trace *tracer
+
+	// dial connects the worker clients, resolving through the DNS cache
+	// of the engine; nil uses the default dialer.
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// workerStats are the health check and selection counters of a worker,
+// kept for the metrics.
+type workerStats struct {
+	latency  time.Duration
+	checks   uint64
+	failures uint64
+	selected uint64
+}
+
+func NewWorkerManager() *WorkerManager {
+	return &WorkerManager{
+		client:  &http.Client{Timeout: 5 * time.Second},
+		clients: make(map[string]*http.Client),
+		usage:   newUsageTracker(),
+		stats:   make(map[string]*workerStats),
+	}
+}
+
+// RunHealthChecker periodically checks worker health until ctx is done.
+func (m *WorkerManager) RunHealthChecker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.CheckAll()
+		_ = m.usage.Flush()
+		m.mu.RLock()
+		watchers := m.watchers
+		m.mu.RUnlock()
+		for _, fn := range watchers {
+			fn()
+		}
+	}
+}
+
+// Watch registers fn to run after every periodic health check.
+func (m *WorkerManager) Watch(fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watchers = append(m.watchers, fn)
+}
+
+// List returns a copy of the configured workers.
+func (m *WorkerManager) List() []Worker {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cp := make([]Worker, len(m.workers))
+	copy(cp, m.workers)
+	for i := range cp {
+		cp[i].Token = ""
+		u := m.usage.Get(cp[i].URL)
+		cp[i].Usage = &u
+	}
+	return cp
+}
+
+// urls returns the worker URLs.
+func (m *WorkerManager) urls() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	us := make([]string, len(m.workers))
+	for i, w := range m.workers {
+		us[i] = w.URL
+	}
+	return us
+}
+
+// tokens returns the worker tokens, for redaction.
+func (m *WorkerManager) tokens() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var ts []string
+	for _, w := range m.workers {
+		if w.Token != "" {
+			ts = append(ts, w.Token)
+		}
+	}
+	return ts
+}
+
+// stat updates the counters of the worker at url.
+func (m *WorkerManager) stat(url string, fn func(*workerStats)) {
+	m.smu.Lock()
+	defer m.smu.Unlock()
+	st := m.stats[url]
+	if st == nil {
+		st = &workerStats{}
+		m.stats[url] = st
+	}
+	fn(st)
+}
+
+// workerStat returns a copy of the counters of the worker at url.
+func (m *WorkerManager) workerStat(url string) workerStats {
+	m.smu.Lock()
+	defer m.smu.Unlock()
+	if st := m.stats[url]; st != nil {
+		return *st
+	}
+	return workerStats{}
+}
+
+// Next returns the next active worker URL using round robin.
+// The bool indicates whether a worker was found.
+func (m *WorkerManager) Next() (string, bool) {
+	return m.NextFor("")
+}
+
+// NextFor returns the next active worker supporting the given feature
+// using round robin.
+func (m *WorkerManager) NextFor(feature string) (string, bool) {
+	return m.NextIn(Pool{}, feature)
+}
+
+// NextIn returns the next active worker of the pool supporting the given
+// feature. Only workers of the best priority present are considered and
+// rotated in round robin order.
+func (m *WorkerManager) NextIn(pool Pool, feature string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.workers)
+	usable := func(w Worker) bool {
+		return w.Active && w.Health.Supports(feature) && pool.contains(w) && !w.nearQuota(m.usage.Get(w.URL))
+	}
+	best, found := 0, false
+	for _, w := range m.workers {
+		if usable(w) && (!found || w.Priority < best) {
+			best, found = w.Priority, true
+		}
+	}
+	if !found {
+		return "", false
+	}
+	for i := 0; i < n; i++ {
+		pos := (m.index + i) % n
+		w := m.workers[pos]
+		if usable(w) && w.Priority == best {
+			m.index = (pos + 1) % n
+			m.stat(w.URL, func(st *workerStats) { st.selected++ })
+			return w.URL, true
+		}
+	}
+	return "", false
+}
+
+// Has reports whether the pool contains at least one configured worker.
+func (m *WorkerManager) Has(pool Pool) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, w := range m.workers {
+		if pool.contains(w) {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether the worker is configured and healthy.
+func (m *WorkerManager) Active(url string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, w := range m.workers {
+		if w.URL == url {
+			return w.Active
+		}
+	}
+	return false
+}
+
+// Update applies u to the worker with the given URL.
+func (m *WorkerManager) Update(url string, u WorkerUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.workers {
+		w := &m.workers[i]
+		if w.URL != url {
+			continue
+		}
+		if u.Group != nil {
+			w.Group = *u.Group
+		}
+		if u.Priority != nil {
+			w.Priority = *u.Priority
+		}
+		if u.Quota != nil {
+			w.Quota = *u.Quota
+		}
+		if u.SoftLimit != nil {
+			w.SoftLimit = *u.SoftLimit
+		}
+		return m.save()
+	}
+	return errors.New("unknown worker")
+}
+
+// Add validates and adds a new endpoint using the default TLS policy.
+func (m *WorkerManager) Add(url string) error {
+	return m.AddWorker(Worker{URL: url})
+}
+
+// AddWorker validates and adds a new endpoint with its own TLS policy.
+// Unless disabled, the key presented by an HTTPS worker is pinned.
+func (m *WorkerManager) AddWorker(w Worker) error {
+	if w.URL == "" {
+		return errors.New("empty url")
+	}
+	if w.TLS != nil {
+		p := *w.TLS
+		w.TLS = &p
+	}
+	m.mu.RLock()
+	for _, existing := range m.workers {
+		if existing.URL == w.URL {
+			m.mu.RUnlock()
+			return errors.New("duplicate url")
+		}
+	}
+	m.mu.RUnlock()
+	m.dropClient(w.URL)
+	if err := m.checkHealth(&w, !w.TLS.noTOFU()); err != nil {
+		m.dropClient(w.URL)
+		return err
+	}
+	w.Active = true
+	w.Error = ""
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.workers {
+		if existing.URL == w.URL {
+			return errors.New("duplicate url")
+		}
+	}
+	m.workers = append(m.workers, w)
+	return m.save()
+}
+
+// Test runs a health check without adding the worker. Settings of a
+// configured worker with the same URL are used.
+func (m *WorkerManager) Test(w Worker) (*HealthInfo, error) {
+	if w.URL == "" {
+		return nil, errors.New("empty url")
+	}
+	m.mu.RLock()
+	for _, existing := range m.workers {
+		if existing.URL == w.URL {
+			w = existing
+			break
+		}
+	}
+	m.mu.RUnlock()
+	if w.TLS != nil {
+		p := *w.TLS
+		w.TLS = &p
+	}
+	if err := m.checkHealth(&w, false); err != nil {
+		return nil, err
+	}
+	return w.Health, nil
+}
+
+// Repin replaces the pins of a worker with the key it currently presents
+// and reactivates it. It is used after a legitimate key rotation. The check
+// runs without the lock; settings changed meanwhile are kept.
+func (m *WorkerManager) Repin(url string) error {
+	cand, ok := m.worker(url)
+	if !ok {
+		return errors.New("unknown worker")
+	}
+	pol := TLSPolicy{}
+	if cand.TLS != nil {
+		pol = *cand.TLS
+	}
+	pol.Pins = nil
+	cand.TLS = &pol
+	m.dropClient(url)
+	if err := m.checkHealth(&cand, true); err != nil {
+		m.dropClient(url)
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.workers {
+		w := &m.workers[i]
+		if w.URL != url {
+			continue
+		}
+		w.TLS, w.Health = cand.TLS, cand.Health
+		w.Active, w.Error = true, ""
+		// a client built from the old pins meanwhile
+		m.dropClient(url)
+		return m.save()
+	}
+	return errors.New("unknown worker")
+}
+
+// worker returns a copy of the worker at url.
+func (m *WorkerManager) worker(url string) (Worker, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, w := range m.workers {
+		if w.URL == url {
+			return w, true
+		}
+	}
+	return Worker{}, false
+}
+
+// Remove deletes a worker endpoint if present.
+func (m *WorkerManager) Remove(url string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, w := range m.workers {
+		if w.URL == url {
+			m.workers = append(m.workers[:i], m.workers[i+1:]...)
+			m.dropClient(url)
+			m.smu.Lock()
+			delete(m.stats, url)
+			m.smu.Unlock()
+			break
+		}
+	}
+	_ = m.save()
+}
+
+// CheckAll updates the Active status of all workers. The checks run on a
+// snapshot without the lock, so selection and the API are not held up by
+// slow workers.
+func (m *WorkerManager) CheckAll() {
+	m.mu.RLock()
+	snap := make([]Worker, len(m.workers))
+	copy(snap, m.workers)
+	m.mu.RUnlock()
+	for i := range snap {
+		m.check(&snap[i])
+	}
+	m.apply(snap)
+}
+
+// Recheck runs a health check of the worker with the given URL now and
+// records the result like CheckAll.
+func (m *WorkerManager) Recheck(url string) error {
+	w, ok := m.worker(url)
+	if !ok {
+		return errors.New("unknown worker")
+	}
+	err := m.check(&w)
+	m.apply([]Worker{w})
+	return err
+}
+
+// check runs a health check of w without the lock and sets its state.
+func (m *WorkerManager) check(w *Worker) error {
+	err := m.checkHealth(w, false)
+	switch {
+	case err == nil:
+		w.Active = true
+		w.Error = ""
+	case errors.Is(err, ErrPinMismatch):
+		w.Active = false
+		w.Error = ErrPinMismatch.Error()
+	default:
+		w.Active = false
+		w.Error = err.Error()
+	}
+	return err
+}
+
+// apply writes the check results in checked back and saves the workers
+// when that changed any of them.
+func (m *WorkerManager) apply(checked []Worker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := false
+	for _, c := range checked {
+		for i := range m.workers {
+			w := &m.workers[i]
+			// removed workers are skipped, and so are repinned ones,
+			// which got a new policy and a fresh check
+			if w.URL != c.URL || w.TLS != c.TLS {
+				continue
+			}
+			if w.Active == c.Active && w.Error == c.Error && reflect.DeepEqual(w.Health, c.Health) {
+				continue
+			}
+			w.Active, w.Error, w.Health = c.Active, c.Error, c.Health
+			changed = true
+		}
+	}
+	if changed {
+		_ = m.save()
+	}
+}
+
+// checkHealth fetches the worker healthz document and records it. When pin
+// is set and the worker has no pins yet, the leaf key of an HTTPS worker is
+// recorded in its policy.
+func (m *WorkerManager) checkHealth(w *Worker, pin bool) error {
+	client, err := m.clientFor(w)
+	if err != nil {
+		return err
+	}
+	path := w.HealthPath
+	if path == "" {
+		path = defaultHealthPath
+	}
+	req, err := http.NewRequest(http.MethodGet, w.URL+path, nil)
+	if err != nil {
+		return err
+	}
+	if w.Token != "" {
+		req.Header.Set(workerTokenHeader, w.Token)
+	}
+	_, sp := m.trace.start(context.Background(), "worker.health_check", spanClient, "worker", w.URL, "path", path)
+	start := time.Now()
+	resp, err := client.Do(req)
+	defer func() {
+		sp.end(err)
+		m.stat(w.URL, func(st *workerStats) {
+			st.checks++
+			if err != nil {
+				st.failures++
+			} else {
+				st.latency = time.Since(start)
+			}
+		})
+	}()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	sp.set("status", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New("health check failed")
+		return err
+	}
+	h, err := parseHealth(resp.Body, w.Expect)
+	if err != nil {
+		return err
+	}
+	w.Health = h
+	if pin && resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 && (w.TLS == nil || len(w.TLS.Pins) == 0) {
+		if w.TLS == nil {
+			w.TLS = &TLSPolicy{}
+		}
+		w.TLS.Pins = []string{spkiPin(resp.TLS.PeerCertificates[0])}
+		m.dropClient(w.URL)
+	}
+	return nil
+}
+
+// Forward sends req to the worker at url, adding its credentials. Unlike
+// health checks, forwarded requests are not bound by the check timeout.
+func (m *WorkerManager) Forward(url string, req *http.Request) (*http.Response, error) {
+	m.mu.RLock()
+	var w *Worker
+	for i := range m.workers {
+		if m.workers[i].URL == url {
+			cp := m.workers[i]
+			w = &cp
+			break
+		}
+	}
+	m.mu.RUnlock()
+	if w == nil {
+		return nil, errors.New("unknown worker")
+	}
+	c, err := m.clientFor(w)
+	if err != nil {
+		return nil, err
+	}
+	if w.Token != "" {
+		req.Header.Set(workerTokenHeader, w.Token)
+	}
+	sent := req.ContentLength
+	if sent < 0 {
+		sent = 0
+	}
+	resp, err := (&http.Client{Transport: c.Transport}).Do(req)
+	if err != nil {
+		m.usage.Record(url, 1, sent)
+		return nil, err
+	}
+	resp.Body = &countingBody{body: resp.Body, done: func(n int64) {
+		m.usage.Record(url, 1, sent+n)
+	}}
+	return resp, nil
+}
+
+// LoadUsage restores persisted usage counters from file.
+func (m *WorkerManager) LoadUsage(file string) error {
+	return m.usage.Load(file)
+}
+
+// FlushUsage writes pending usage counters to disk.
+func (m *WorkerManager) FlushUsage() error {
+	return m.usage.Flush()
+}
+
+// clientFor returns the HTTP client enforcing the worker TLS policy.
+func (m *WorkerManager) clientFor(w *Worker) (*http.Client, error) {
+	m.cmu.Lock()
+	defer m.cmu.Unlock()
+	if c, ok := m.clients[w.URL]; ok {
+		return c, nil
+	}
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return m.client, nil
+	}
+	tc, err := w.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+	c := &http.Client{Timeout: m.client.Timeout, Transport: m.transport(tc)}
+	m.clients[w.URL] = c
+	return c, nil
+}
+
+// transport returns a transport for the worker clients using tc.
+func (m *WorkerManager) transport(tc *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		DialContext:       m.dial,
+		TLSClientConfig:   tc,
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+	}
+}
+
+// setDialer makes the worker clients connect through dial. It is called
+// before the workers are used.
+func (m *WorkerManager) setDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	m.dial = dial
+	m.client = &http.Client{Timeout: m.client.Timeout, Transport: m.transport(nil)}
+}
+
+// dropClient forgets the cached client so a changed policy takes effect.
+func (m *WorkerManager) dropClient(url string) {
+	m.cmu.Lock()
+	defer m.cmu.Unlock()
+	if c, ok := m.clients[url]; ok {
+		c.CloseIdleConnections()
+		delete(m.clients, url)
+	}
+}
+
+// Save persists the current workers.
+func (m *WorkerManager) Save() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.save()
+}
+
+// Load reads workers from the given file if it exists.
+func (m *WorkerManager) Load(file string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.file = file
+	m.cmu.Lock()
+	m.clients = make(map[string]*http.Client)
+	m.cmu.Unlock()
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(b, &m.workers)
+}
+
+// save persists current workers to the configured file.
+func (m *WorkerManager) save() error {
+	if m.file == "" {
+		return nil
+	}
+	stored := make([]Worker, len(m.workers))
+	copy(stored, m.workers)
+	for i := range stored {
+		stored[i].Usage = nil
+	}
+	b, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(m.file, b, 0600)
+}
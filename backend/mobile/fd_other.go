@@ -0,0 +1,5 @@
+//go:build !unix
+
+package mobile
+
+func setNonblock(fd int) error { return nil }
@@ -0,0 +1,9 @@
+//go:build unix
+
+package mobile
+
+import "syscall"
+
+// setNonblock lets the runtime poller serve fd, so closing its file ends a
+// pending read.
+func setNonblock(fd int) error { return syscall.SetNonblock(fd, true) }
@@ -0,0 +1,223 @@
+// Package mobile binds the engine for Android and iOS with gomobile:
+//
+//	gomobile bind -target=android ./mobile
+//	gomobile bind -target=ios ./mobile
+//
+// The API only uses types gomobile can bind: strings, ints, errors and
+// interfaces made of those. Requests and results are passed as JSON.
+//
+// Mobile apps cannot exec a tor binary, so they run tor themselves and hand
+// it to the engine with SetTorRunner. The TUN device of an Android
+// VpnService or iOS NetworkExtension is passed with SetTunFd; its TCP
+// connections and DNS queries are relayed through tor's SOCKS port.
+package mobile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"torwell84/backend/engine"
+)
+
+// EventHandler receives engine events. Kind is the event type, such as
+// "connected", and payload the JSON encoded event.
+type EventHandler interface {
+	OnEvent(kind, payload string)
+}
+
+var (
+	errNotStarted = errors.New("engine not started")
+	errStarted    = errors.New("engine already started")
+	errNoTor      = errors.New("no tor runner set")
+)
+
+// TorRunner runs tor inside the app, such as Tor.framework on iOS or a tor
+// library on Android. Start runs tor with its data in dataDir and returns
+// once it has bootstrapped; Stop shuts it down and is also called when tor
+// is not running. SocksAddr returns the host:port of tor's SOCKS port, such
+// as "127.0.0.1:9050".
+type TorRunner interface {
+	Start(dataDir string) error
+	Stop() error
+	SocksAddr() string
+}
+
+var (
+	mu      sync.Mutex
+	eng     *engine.Engine
+	cancel  context.CancelFunc
+	done    chan error
+	handler EventHandler
+	runner  TorRunner
+	tunFd   = -1
+	tun     *tunBridge
+
+	// proxyAddr is where the worker proxy listens.
+	proxyAddr = engine.DefaultProxyAddr
+)
+
+// SetEventHandler registers h for engine events. Pass nil to stop
+// receiving them.
+func SetEventHandler(h EventHandler) {
+	mu.Lock()
+	handler = h
+	mu.Unlock()
+}
+
+// SetTorRunner sets the tor of the next Start; Start fails without one.
+func SetTorRunner(r TorRunner) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if eng != nil {
+		return errStarted
+	}
+	runner = r
+	return nil
+}
+
+// SetTunFd passes the file descriptor of a VPN TUN device to the next
+// Start, which takes ownership of it: the packets read from it are relayed
+// through tor until Stop closes it. Only IPv4 TCP and DNS over port 53 are
+// relayed; pass -1 to run without a TUN device.
+func SetTunFd(fd int) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if eng != nil {
+		return errStarted
+	}
+	tunFd = fd
+	return nil
+}
+
+// torEngine adapts a TorRunner to the engine.
+type torEngine struct {
+	r   TorRunner
+	dir string
+}
+
+func (t torEngine) Start(ctx context.Context) error { return t.r.Start(t.dir) }
+func (t torEngine) Stop(ctx context.Context) error  { return t.r.Stop() }
+
+// Start runs an engine keeping its state in configDir. The REST API is not
+// served; the app controls the engine through this package. The worker
+// proxy takes the token written to api.token in configDir as password.
+func Start(configDir string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if eng != nil {
+		return errStarted
+	}
+	if runner == nil {
+		return errNoTor
+	}
+	e, err := engine.New(
+		engine.WithConfigDir(configDir),
+		engine.WithAPIAddr(""),
+		engine.WithProxyAddr(proxyAddr),
+		engine.WithTor(torEngine{runner, filepath.Join(configDir, "tor")}),
+	)
+	if err != nil {
+		return err
+	}
+	if tunFd >= 0 {
+		if err := setNonblock(tunFd); err != nil {
+			return err
+		}
+		tun = newTunBridge(os.NewFile(uintptr(tunFd), "tun"), runner.SocksAddr)
+		tunFd = -1
+	}
+	events, unsubscribe := e.Subscribe()
+	go forward(events)
+	ctx, stop := context.WithCancel(context.Background())
+	finished := make(chan error, 1)
+	go func() {
+		err := e.Run(ctx)
+		unsubscribe()
+		finished <- err
+	}()
+	eng, cancel, done = e, stop, finished
+	return nil
+}
+
+// forward hands events to the registered handler.
+func forward(events <-chan engine.Event) {
+	for ev := range events {
+		mu.Lock()
+		h := handler
+		mu.Unlock()
+		if h == nil {
+			continue
+		}
+		b, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		h.OnEvent(ev.Type, string(b))
+	}
+}
+
+// Stop closes the TUN device, shuts the engine down and waits until its
+// state is saved.
+func Stop() error {
+	mu.Lock()
+	if eng == nil {
+		mu.Unlock()
+		return nil
+	}
+	stop, finished, bridge := cancel, done, tun
+	eng, cancel, done, tun = nil, nil, nil, nil
+	mu.Unlock()
+	if bridge != nil {
+		_ = bridge.Close()
+	}
+	stop()
+	return <-finished
+}
+
+func current() (*engine.Engine, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if eng == nil {
+		return nil, errNotStarted
+	}
+	return eng, nil
+}
+
+// Connect connects with a JSON request such as
+// {"entry":"DE","exit":"US","group":"eu"}. An empty string uses defaults.
+func Connect(requestJSON string) error {
+	e, err := current()
+	if err != nil {
+		return err
+	}
+	var req engine.ConnectRequest
+	if requestJSON != "" {
+		if err := json.Unmarshal([]byte(requestJSON), &req); err != nil {
+			return err
+		}
+	}
+	return e.Connect(context.Background(), req)
+}
+
+// Disconnect ends the session.
+func Disconnect() error {
+	e, err := current()
+	if err != nil {
+		return err
+	}
+	return e.Disconnect(context.Background())
+}
+
+// Status returns the JSON status document also served by GET /status.
+func Status() (string, error) {
+	e, err := current()
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(e.Status())
+	return string(b), err
+}
@@ -0,0 +1,269 @@
+//go:build unix
+
+package mobile
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mu    sync.Mutex
+	kinds []string
+}
+
+func (r *recorder) OnEvent(kind, payload string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !json.Valid([]byte(payload)) {
+		kind = "invalid " + kind
+	}
+	r.kinds = append(r.kinds, kind)
+}
+
+func (r *recorder) wait(t *testing.T, kind string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		r.mu.Lock()
+		got := strings.Join(r.kinds, ",")
+		r.mu.Unlock()
+		if strings.Contains(got, kind) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %s event", kind)
+}
+
+// fakeTor records the calls of the engine.
+type fakeTor struct {
+	mu      sync.Mutex
+	dir     string
+	running bool
+	socks   string
+}
+
+func (f *fakeTor) SocksAddr() string { return f.socks }
+
+func (f *fakeTor) Start(dataDir string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dir, f.running = dataDir, true
+	return nil
+}
+
+func (f *fakeTor) Stop() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.running = false
+	return nil
+}
+
+// socksEcho serves SOCKS5 connects by echoing the data back and sends the
+// requested targets to targets.
+func socksEcho(t *testing.T, targets chan<- string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req := make([]byte, 3+10)
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				dst := netip.AddrPortFrom(netip.AddrFrom4([4]byte(req[7:11])), uint16(req[11])<<8|uint16(req[12]))
+				targets <- dst.String()
+				conn.Write([]byte{5, 0, 5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// tunPair returns the fd handed to SetTunFd and the app end of a datagram
+// socket pair, which keeps packets apart like a TUN device.
+func tunPair(t *testing.T) (int, net.Conn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	f := os.NewFile(uintptr(fds[1]), "app")
+	app, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("app end: %v", err)
+	}
+	t.Cleanup(func() { app.Close() })
+	return fds[0], app
+}
+
+func TestBinding(t *testing.T) {
+	dir := t.TempDir()
+	proxyAddr = "127.0.0.1:0"
+
+	if _, err := Status(); err != errNotStarted {
+		t.Fatalf("expected not started, got %v", err)
+	}
+	rec := &recorder{}
+	SetEventHandler(rec)
+	defer SetEventHandler(nil)
+	if err := Start(dir); err != errNoTor {
+		t.Fatalf("expected start without tor to fail, got %v", err)
+	}
+	targets := make(chan string, 1)
+	tor := &fakeTor{socks: socksEcho(t, targets)}
+	if err := SetTorRunner(tor); err != nil {
+		t.Fatalf("tor: %v", err)
+	}
+	defer SetTorRunner(nil)
+	fd, app := tunPair(t)
+	if err := SetTunFd(fd); err != nil {
+		t.Fatalf("tun: %v", err)
+	}
+
+	if err := Start(filepath.Join(dir, "config")); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if err := Start(dir); err != errStarted {
+		t.Fatalf("expected second start to fail, got %v", err)
+	}
+	if err := SetTorRunner(nil); err != errStarted {
+		t.Fatalf("expected tor to be refused while running, got %v", err)
+	}
+	if err := SetTunFd(-1); err != errStarted {
+		t.Fatalf("expected tun to be refused while running, got %v", err)
+	}
+
+	if err := Connect(`{"group":"nope"}`); err == nil || !strings.Contains(err.Error(), "unknown group") {
+		t.Fatalf("expected unknown group, got %v", err)
+	}
+	if err := Connect("{"); err == nil {
+		t.Fatal("expected invalid json to fail")
+	}
+	if err := Connect(`{"exit":"US"}`); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	rec.wait(t, "progress")
+	rec.wait(t, "connected")
+	st, err := Status()
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	var status struct {
+		Connected bool
+		Circuit   *struct{ ID int }
+	}
+	if err := json.Unmarshal([]byte(st), &status); err != nil || !status.Connected || status.Circuit == nil {
+		t.Fatalf("unexpected status %s", st)
+	}
+	tor.mu.Lock()
+	running, torDir := tor.running, tor.dir
+	tor.mu.Unlock()
+	if !running || torDir != filepath.Join(dir, "config", "tor") {
+		t.Fatalf("tor not started in the config dir: %v %s", running, torDir)
+	}
+	relayTCP(t, app, targets)
+	if err := Disconnect(); err != nil {
+		t.Fatalf("disconnect: %v", err)
+	}
+	rec.wait(t, "disconnected")
+
+	if err := Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	tor.mu.Lock()
+	running = tor.running
+	tor.mu.Unlock()
+	if running {
+		t.Fatal("tor still running after stop")
+	}
+	if _, err := syscall.Dup(fd); err != syscall.EBADF {
+		t.Fatalf("tun fd not closed on stop: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "config", "config.json")); err != nil {
+		t.Fatalf("state not saved: %v", err)
+	}
+	if err := Connect(""); err != errNotStarted {
+		t.Fatalf("expected not started after stop, got %v", err)
+	}
+	if err := Stop(); err != nil {
+		t.Fatalf("second stop: %v", err)
+	}
+}
+
+// relayTCP opens a connection through the TUN device, has the SOCKS server
+// echo a message and closes it from both ends.
+func relayTCP(t *testing.T, app net.Conn, targets <-chan string) {
+	t.Helper()
+	local := netip.MustParseAddrPort("10.0.0.2:40000")
+	remote := netip.MustParseAddrPort("93.184.216.34:80")
+	send := func(seq, ack uint32, flags byte, data []byte) {
+		if _, err := app.Write(tcpPacket(local, remote, seq, ack, flags, data)); err != nil {
+			t.Fatalf("write packet: %v", err)
+		}
+	}
+	buf := make([]byte, 65535)
+	recv := func(want byte) tcpSegment {
+		t.Helper()
+		for {
+			app.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := app.Read(buf)
+			if err != nil {
+				t.Fatalf("no packet with flags %#x: %v", want, err)
+			}
+			ip, ok := parseIPv4(buf[:n])
+			if !ok || ip.src != remote.Addr() || ip.dst != local.Addr() || ip.proto != protoTCP {
+				t.Fatalf("unexpected packet %x", buf[:n])
+			}
+			if checksum(ip.payload, pseudoSum(ip.src, ip.dst, protoTCP, len(ip.payload))) != 0 {
+				t.Fatalf("bad checksum in %x", buf[:n])
+			}
+			seg, _ := parseTCP(ip.payload)
+			if seg.flags&want == want && (want != tcpPSH || len(seg.payload) > 0) {
+				return seg
+			}
+		}
+	}
+
+	send(1000, 0, tcpSYN, nil)
+	synAck := recv(tcpSYN | tcpACK)
+	if synAck.ack != 1001 {
+		t.Fatalf("syn acknowledged as %d", synAck.ack)
+	}
+	if got := <-targets; got != remote.String() {
+		t.Fatalf("socks connect to %s", got)
+	}
+	iss := synAck.seq
+	send(1001, iss+1, tcpACK|tcpPSH, []byte("ping"))
+	data := recv(tcpPSH)
+	if !bytes.Equal(data.payload, []byte("ping")) || data.seq != iss+1 || data.ack != 1005 {
+		t.Fatalf("unexpected echo %q seq %d ack %d", data.payload, data.seq, data.ack)
+	}
+	send(1005, iss+5, tcpFIN|tcpACK, nil)
+	fin := recv(tcpFIN)
+	if fin.seq != iss+5 || fin.ack != 1006 {
+		t.Fatalf("unexpected fin seq %d ack %d", fin.seq, fin.ack)
+	}
+	send(1006, iss+6, tcpACK, nil)
+}
@@ -0,0 +1,650 @@
+package mobile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// The TUN bridge is a small tun2socks: it terminates the TCP connections
+// of the IPv4 packets read from the device and relays each through tor's
+// SOCKS port. DNS queries to port 53 are sent over TCP to dnsResolver
+// through tor. Other UDP, ICMP and IPv6 packets are dropped.
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	// tunMSS is the largest segment sent to the app, small enough for
+	// the 1500 byte MTU VPN services use.
+	tunMSS = 1360
+	// tunWindow is the receive window announced to the app. Window
+	// scaling is not offered.
+	tunWindow = 65535
+	// tunSendBuffer limits the data read from tor that the app has not
+	// acknowledged yet.
+	tunSendBuffer = 256 << 10
+	// tunRetransmit is how long unacknowledged data waits before it is
+	// sent again.
+	tunRetransmit = 500 * time.Millisecond
+
+	dnsResolver = "1.1.1.1:53"
+)
+
+var errSocks = errors.New("socks: unexpected reply")
+
+// tunBridge relays the traffic of a TUN device through tor.
+type tunBridge struct {
+	dev   io.ReadWriteCloser
+	socks func() string
+
+	wmu sync.Mutex // serializes packets written to dev
+
+	mu     sync.Mutex
+	conns  map[flow]*tunConn
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// flow identifies a TCP connection by its app and remote end.
+type flow struct {
+	local, remote netip.AddrPort
+}
+
+// newTunBridge starts relaying the packets of dev through the SOCKS
+// address returned by socks, which is asked again for every connection.
+func newTunBridge(dev io.ReadWriteCloser, socks func() string) *tunBridge {
+	b := &tunBridge{dev: dev, socks: socks, conns: map[flow]*tunConn{}}
+	b.wg.Add(1)
+	go b.run()
+	return b
+}
+
+// Close closes the device and resets the open connections.
+func (b *tunBridge) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	conns := make([]*tunConn, 0, len(b.conns))
+	for _, c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.mu.Unlock()
+	err := b.dev.Close()
+	for _, c := range conns {
+		c.close()
+	}
+	b.wg.Wait()
+	return err
+}
+
+func (b *tunBridge) run() {
+	defer b.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, err := b.dev.Read(buf)
+		if err != nil {
+			return
+		}
+		b.packet(append([]byte(nil), buf[:n]...))
+	}
+}
+
+func (b *tunBridge) write(p []byte) {
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	_, _ = b.dev.Write(p)
+}
+
+func (b *tunBridge) packet(p []byte) {
+	ip, ok := parseIPv4(p)
+	if !ok {
+		return
+	}
+	switch ip.proto {
+	case protoTCP:
+		if seg, ok := parseTCP(ip.payload); ok {
+			b.tcp(ip, seg)
+		}
+	case protoUDP:
+		if len(ip.payload) < 8 || binary.BigEndian.Uint16(ip.payload[2:4]) != 53 {
+			return
+		}
+		from := netip.AddrPortFrom(ip.src, binary.BigEndian.Uint16(ip.payload[0:2]))
+		to := netip.AddrPortFrom(ip.dst, 53)
+		go b.dns(from, to, ip.payload[8:])
+	}
+}
+
+func (b *tunBridge) tcp(ip ipv4Packet, seg tcpSegment) {
+	f := flow{
+		local:  netip.AddrPortFrom(ip.src, seg.srcPort),
+		remote: netip.AddrPortFrom(ip.dst, seg.dstPort),
+	}
+	b.mu.Lock()
+	c := b.conns[f]
+	if c == nil && !b.closed && seg.flags&(tcpSYN|tcpACK|tcpRST) == tcpSYN {
+		c = &tunConn{
+			b:      b,
+			f:      f,
+			in:     make(chan []byte, 64),
+			done:   make(chan struct{}),
+			iss:    rand.Uint32(),
+			rcvNxt: seg.seq + 1,
+			wnd:    uint32(seg.window),
+		}
+		c.cond = sync.NewCond(&c.mu)
+		b.conns[f] = c
+		b.mu.Unlock()
+		go c.dial()
+		return
+	}
+	b.mu.Unlock()
+	if c == nil {
+		if seg.flags&tcpRST == 0 {
+			b.reset(f, seg)
+		}
+		return
+	}
+	c.segment(seg)
+}
+
+// reset answers a segment of an unknown connection.
+func (b *tunBridge) reset(f flow, seg tcpSegment) {
+	if seg.flags&tcpACK != 0 {
+		b.write(tcpPacket(f.remote, f.local, seg.ack, 0, tcpRST, nil))
+		return
+	}
+	n := uint32(len(seg.payload))
+	if seg.flags&(tcpSYN|tcpFIN) != 0 {
+		n++
+	}
+	b.write(tcpPacket(f.remote, f.local, 0, seg.seq+n, tcpRST|tcpACK, nil))
+}
+
+func (b *tunBridge) remove(f flow) {
+	b.mu.Lock()
+	delete(b.conns, f)
+	b.mu.Unlock()
+}
+
+// dns sends a query over TCP through tor and returns the answer as if to
+// came from its original destination.
+func (b *tunBridge) dns(from, to netip.AddrPort, query []byte) {
+	conn, err := socksConnect(b.socks(), netip.MustParseAddrPort(dnsResolver))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return
+	}
+	b.write(udpPacket(to, from, answer))
+}
+
+// tunConn is a TCP connection of the app relayed to a SOCKS connection.
+// Data from the app is only accepted in order; data to the app is sent
+// again from the oldest unacknowledged byte when no acknowledgement
+// arrives for tunRetransmit.
+type tunConn struct {
+	b    *tunBridge
+	f    flow
+	up   net.Conn
+	in   chan []byte // data from the app, written to up by upload
+	done chan struct{}
+
+	mu          sync.Mutex
+	cond        *sync.Cond // signals room in out
+	established bool
+	iss         uint32
+	rcvNxt      uint32 // next byte expected from the app
+	sndUna      uint32 // oldest byte the app has not acknowledged
+	sndNxt      uint32 // next byte to send
+	out         []byte // data from sndUna on
+	wnd         uint32 // receive window of the app
+	progress    bool   // acknowledgements arrived since the last tick
+	eof         bool   // up is finished; a FIN follows the data
+	finSent     bool
+	finAcked    bool
+	finRcvd     bool
+	closed      bool
+}
+
+func (c *tunConn) dial() {
+	up, err := socksConnect(c.b.socks(), c.f.remote)
+	c.mu.Lock()
+	if err != nil || c.closed {
+		c.mu.Unlock()
+		if up != nil {
+			up.Close()
+		}
+		if err != nil {
+			c.b.write(tcpPacket(c.f.remote, c.f.local, 0, c.rcvNxt, tcpRST|tcpACK, nil))
+		}
+		c.close()
+		return
+	}
+	c.up, c.established = up, true
+	c.sndUna, c.sndNxt = c.iss+1, c.iss+1
+	c.mu.Unlock()
+	c.synAck()
+	go c.upload()
+	go c.download()
+	go c.retransmit()
+}
+
+func (c *tunConn) synAck() {
+	c.mu.Lock()
+	p := tcpPacket(c.f.remote, c.f.local, c.iss, c.rcvNxt, tcpSYN|tcpACK, nil)
+	c.mu.Unlock()
+	c.b.write(p)
+}
+
+// ack acknowledges the data received from the app.
+func (c *tunConn) ack() {
+	c.mu.Lock()
+	seq := c.sndNxt
+	if c.finSent {
+		seq++
+	}
+	p := tcpPacket(c.f.remote, c.f.local, seq, c.rcvNxt, tcpACK, nil)
+	c.mu.Unlock()
+	c.b.write(p)
+}
+
+func (c *tunConn) segment(seg tcpSegment) {
+	if seg.flags&tcpRST != 0 {
+		c.close()
+		return
+	}
+	c.mu.Lock()
+	if !c.established {
+		c.mu.Unlock()
+		return
+	}
+	if seg.flags&tcpSYN != 0 {
+		c.mu.Unlock()
+		c.synAck()
+		return
+	}
+	if seg.flags&tcpACK != 0 {
+		c.acked(seg.ack, seg.window)
+	}
+	reply := false
+	if len(seg.payload) > 0 {
+		if seg.seq == c.rcvNxt && !c.finRcvd {
+			select {
+			case c.in <- seg.payload:
+				c.rcvNxt += uint32(len(seg.payload))
+			default:
+				// The app sends it again once upload catches up.
+			}
+		}
+		reply = true
+	}
+	if seg.flags&tcpFIN != 0 {
+		end := seg.seq + uint32(len(seg.payload))
+		if !c.finRcvd && end == c.rcvNxt {
+			c.finRcvd = true
+			c.rcvNxt++
+			close(c.in)
+		}
+		reply = true
+	}
+	finished := c.finRcvd && c.finAcked
+	c.mu.Unlock()
+	if reply {
+		c.ack()
+	}
+	if finished {
+		c.close()
+	}
+}
+
+// acked takes an acknowledgement and window from the app. c.mu is held.
+func (c *tunConn) acked(ack uint32, wnd uint16) {
+	c.wnd = uint32(wnd)
+	if d := int32(ack - c.sndUna); d > 0 {
+		n := int(d)
+		if n > len(c.out) {
+			if c.finSent && n == len(c.out)+1 {
+				c.finAcked = true
+			}
+			n = len(c.out)
+		}
+		c.out = c.out[n:]
+		c.sndUna += uint32(n)
+		if int32(c.sndNxt-c.sndUna) < 0 {
+			c.sndNxt = c.sndUna
+		}
+		c.progress = true
+		c.cond.Broadcast()
+	}
+	c.push()
+}
+
+// push sends the data the window of the app allows, then the FIN once up
+// is finished and all data is sent. c.mu is held.
+func (c *tunConn) push() {
+	for {
+		off := int(c.sndNxt - c.sndUna)
+		room := int(c.wnd) - off
+		if off >= len(c.out) || room <= 0 {
+			break
+		}
+		n := min(len(c.out)-off, tunMSS, room)
+		c.b.write(tcpPacket(c.f.remote, c.f.local, c.sndNxt, c.rcvNxt, tcpACK|tcpPSH, c.out[off:off+n]))
+		c.sndNxt += uint32(n)
+	}
+	if c.eof && !c.finSent && int(c.sndNxt-c.sndUna) == len(c.out) {
+		c.b.write(tcpPacket(c.f.remote, c.f.local, c.sndNxt, c.rcvNxt, tcpFIN|tcpACK, nil))
+		c.finSent = true
+	}
+}
+
+// upload writes the data of the app to up and half-closes up after the
+// app's FIN.
+func (c *tunConn) upload() {
+	for {
+		select {
+		case p, ok := <-c.in:
+			if !ok {
+				if cw, ok := c.up.(interface{ CloseWrite() error }); ok {
+					_ = cw.CloseWrite()
+				}
+				return
+			}
+			if _, err := c.up.Write(p); err != nil {
+				c.abort()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// download queues the data of up for the app.
+func (c *tunConn) download() {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := c.up.Read(buf)
+		c.mu.Lock()
+		for n > 0 && len(c.out)+n > tunSendBuffer && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		c.out = append(c.out, buf[:n]...)
+		if err != nil {
+			c.eof = true
+		}
+		c.push()
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *tunConn) retransmit() {
+	t := time.NewTicker(tunRetransmit)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		if !c.progress && (c.sndNxt != c.sndUna || c.finSent && !c.finAcked) {
+			c.sndNxt = c.sndUna
+			if !c.finAcked {
+				c.finSent = false
+			}
+			c.push()
+		}
+		c.progress = false
+		c.mu.Unlock()
+	}
+}
+
+// abort resets the connection of the app after up failed.
+func (c *tunConn) abort() {
+	c.mu.Lock()
+	p := tcpPacket(c.f.remote, c.f.local, c.sndNxt, c.rcvNxt, tcpRST|tcpACK, nil)
+	c.mu.Unlock()
+	c.b.write(p)
+	c.close()
+}
+
+func (c *tunConn) close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.done)
+	c.cond.Broadcast()
+	up := c.up
+	c.mu.Unlock()
+	if up != nil {
+		up.Close()
+	}
+	c.b.remove(c.f)
+}
+
+// socksConnect opens a connection to dst through the SOCKS5 proxy at
+// proxy without authentication, as tor's SOCKS port accepts.
+func socksConnect(proxy string, dst netip.AddrPort) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxy, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	// Building a circuit to dst can take a while.
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	addr := dst.Addr().As4()
+	req := []byte{5, 1, 0, 5, 1, 0, 1, addr[0], addr[1], addr[2], addr[3], byte(dst.Port() >> 8), byte(dst.Port())}
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var reply [12]byte
+	if _, err := io.ReadFull(conn, reply[:6]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply[0] != 5 || reply[1] != 0 || reply[2] != 5 {
+		conn.Close()
+		return nil, errSocks
+	}
+	if reply[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("socks: connect to %s failed (%d)", dst, reply[3])
+	}
+	// The bound address: IPv4, a name or IPv6, then the port.
+	var rest int
+	switch reply[5] {
+	case 1:
+		rest = 4 + 2
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		rest = int(n[0]) + 2
+	case 4:
+		rest = 16 + 2
+	default:
+		conn.Close()
+		return nil, errSocks
+	}
+	if _, err := io.CopyN(io.Discard, conn, int64(rest)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+type ipv4Packet struct {
+	src, dst netip.Addr
+	proto    byte
+	payload  []byte
+}
+
+// parseIPv4 parses an unfragmented IPv4 packet.
+func parseIPv4(b []byte) (ipv4Packet, bool) {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return ipv4Packet{}, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:4]))
+	if ihl < 20 || total < ihl || total > len(b) {
+		return ipv4Packet{}, false
+	}
+	if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+		return ipv4Packet{}, false
+	}
+	return ipv4Packet{
+		src:     netip.AddrFrom4([4]byte(b[12:16])),
+		dst:     netip.AddrFrom4([4]byte(b[16:20])),
+		proto:   b[9],
+		payload: b[ihl:total],
+	}, true
+}
+
+type tcpSegment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            byte
+	window           uint16
+	payload          []byte
+}
+
+func parseTCP(b []byte) (tcpSegment, bool) {
+	if len(b) < 20 {
+		return tcpSegment{}, false
+	}
+	off := int(b[12]>>4) * 4
+	if off < 20 || off > len(b) {
+		return tcpSegment{}, false
+	}
+	return tcpSegment{
+		srcPort: binary.BigEndian.Uint16(b[0:2]),
+		dstPort: binary.BigEndian.Uint16(b[2:4]),
+		seq:     binary.BigEndian.Uint32(b[4:8]),
+		ack:     binary.BigEndian.Uint32(b[8:12]),
+		flags:   b[13],
+		window:  binary.BigEndian.Uint16(b[14:16]),
+		payload: b[off:],
+	}, true
+}
+
+// tcpPacket builds a segment from one end to the other. A SYN carries the
+// maximum segment size the bridge accepts.
+func tcpPacket(from, to netip.AddrPort, seq, ack uint32, flags byte, payload []byte) []byte {
+	hdr := 20
+	if flags&tcpSYN != 0 {
+		hdr += 4
+	}
+	t := make([]byte, hdr+len(payload))
+	binary.BigEndian.PutUint16(t[0:2], from.Port())
+	binary.BigEndian.PutUint16(t[2:4], to.Port())
+	binary.BigEndian.PutUint32(t[4:8], seq)
+	binary.BigEndian.PutUint32(t[8:12], ack)
+	t[12] = byte(hdr/4) << 4
+	t[13] = flags
+	binary.BigEndian.PutUint16(t[14:16], tunWindow)
+	if flags&tcpSYN != 0 {
+		t[20], t[21] = 2, 4
+		binary.BigEndian.PutUint16(t[22:24], tunMSS)
+	}
+	copy(t[hdr:], payload)
+	sum := checksum(t, pseudoSum(from.Addr(), to.Addr(), protoTCP, len(t)))
+	binary.BigEndian.PutUint16(t[16:18], sum)
+	return ipv4(from.Addr(), to.Addr(), protoTCP, t)
+}
+
+func udpPacket(from, to netip.AddrPort, payload []byte) []byte {
+	u := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(u[0:2], from.Port())
+	binary.BigEndian.PutUint16(u[2:4], to.Port())
+	binary.BigEndian.PutUint16(u[4:6], uint16(len(u)))
+	copy(u[8:], payload)
+	sum := checksum(u, pseudoSum(from.Addr(), to.Addr(), protoUDP, len(u)))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(u[6:8], sum)
+	return ipv4(from.Addr(), to.Addr(), protoUDP, u)
+}
+
+func ipv4(src, dst netip.Addr, proto byte, payload []byte) []byte {
+	b := make([]byte, 20+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 64
+	b[9] = proto
+	s, d := src.As4(), dst.As4()
+	copy(b[12:16], s[:])
+	copy(b[16:20], d[:])
+	binary.BigEndian.PutUint16(b[10:12], checksum(b[:20], 0))
+	copy(b[20:], payload)
+	return b
+}
+
+// checksum is the internet checksum of b added to sum.
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// pseudoSum sums the IPv4 pseudo header of a TCP or UDP checksum.
+func pseudoSum(src, dst netip.Addr, proto byte, length int) uint32 {
+	s, d := src.As4(), dst.As4()
+	var sum uint32
+	for i := 0; i < 4; i += 2 {
+		sum += uint32(s[i])<<8 | uint32(s[i+1])
+		sum += uint32(d[i])<<8 | uint32(d[i+1])
+	}
+	return sum + uint32(proto) + uint32(length)
+}
@@ -1,155 +1,73 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"net/http"
-	"os"
-	"sync"
-	"time"
-)
-
-// Worker represents a single Cloudflare Worker HTTPS endpoint.
-type Worker struct {
-	URL    string
-	Active bool
-}
-
-// WorkerManager stores and validates worker endpoints.
-type WorkerManager struct {
-	mu      sync.RWMutex
-	workers []Worker
-	client  *http.Client
-	index   int
-	file    string
-}
 
-func NewWorkerManager() *WorkerManager {
-	return &WorkerManager{
-		client: &http.Client{Timeout: 5 * time.Second},
-	}
-}
-
-// StartHealthChecker runs a loop that periodically checks worker health.
-func (m *WorkerManager) StartHealthChecker(interval time.Duration) {
-	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
-		for range ticker.C {
-			m.CheckAll()
-		}
-	}()
-}
-
-// List returns a copy of the configured workers.
-func (m *WorkerManager) List() []Worker {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	cp := make([]Worker, len(m.workers))
-	copy(cp, m.workers)
-	return cp
-}
-
-// Next returns the next active worker URL using round robin.
-// The bool indicates whether a worker was found.
-func (m *WorkerManager) Next() (string, bool) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if len(m.workers) == 0 {
-		return "", false
-	}
-	for i := 0; i < len(m.workers); i++ {
-		w := m.workers[m.index%len(m.workers)]
-		m.index = (m.index + 1) % len(m.workers)
-		if w.Active {
-			return w.URL, true
-		}
-	}
-	return "", false
-}
+	"torwell84/backend/engine"
+)
 
-// Add validates and adds a new endpoint.
-func (m *WorkerManager) Add(url string) error {
-	if url == "" {
-		return errors.New("empty url")
-	}
-	if err := m.checkHealth(url); err != nil {
-		return err
+// runWorkerCommand implements the `worker` subcommands.
+func runWorkerCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "usage: torwell84 worker scaffold|emulate [flags]")
+		return 2
 	}
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	for _, w := range m.workers {
-		if w.URL == url {
-			return errors.New("duplicate url")
-		}
+	switch args[0] {
+	case "scaffold":
+		return runScaffold(args[1:], stdout, stderr)
+	case "emulate":
+		return runEmulate(args[1:], stdout, stderr)
 	}
-	m.workers = append(m.workers, Worker{URL: url, Active: true})
-	return m.save()
+	fmt.Fprintf(stderr, "unknown worker command %q\n", args[0])
+	return 2
 }
 
-// Remove deletes a worker endpoint if present.
-func (m *WorkerManager) Remove(url string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	for i, w := range m.workers {
-		if w.URL == url {
-			m.workers = append(m.workers[:i], m.workers[i+1:]...)
-			break
-		}
+func runScaffold(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("worker scaffold", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dir := fs.String("dir", "torwell84-worker", "output directory")
+	name := fs.String("name", "torwell84", "worker name")
+	force := fs.Bool("force", false, "overwrite existing files")
+	if err := fs.Parse(args); err != nil {
+		return 2
 	}
-	_ = m.save()
-}
-
-// CheckAll updates the Active status of all workers.
-func (m *WorkerManager) CheckAll() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	for i, w := range m.workers {
-		if err := m.checkHealth(w.URL); err != nil {
-			m.workers[i].Active = false
-		} else {
-			m.workers[i].Active = true
-		}
-	}
-	_ = m.save()
-}
-
-// checkHealth performs a simple GET on /.well-known/healthz.
-func (m *WorkerManager) checkHealth(url string) error {
-	resp, err := m.client.Get(url + "/.well-known/healthz")
+	token, err := engine.ScaffoldWorker(*dir, *name, *force)
 	if err != nil {
-		return err
-	}
-	resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("health check failed")
+		fmt.Fprintf(stderr, "scaffold: %v\n", err)
+		return 1
 	}
-	return nil
+	fmt.Fprintf(stdout, "wrote worker to %s\n\n", *dir)
+	fmt.Fprintf(stdout, "deploy:\n  cd %s\n  wrangler secret put TORWELL_TOKEN   # paste the token below\n  wrangler deploy\n\n", *dir)
+	fmt.Fprintf(stdout, "token: %s\n\n", token)
+	fmt.Fprintf(stdout, "register with the backend:\n  POST /workers {\"URL\":\"https://%s.<account>.workers.dev\",\"Token\":\"%s\"}\n", *name, token)
+	return 0
 }
 
-// Load reads workers from the given file if it exists.
-func (m *WorkerManager) Load(file string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.file = file
-	b, err := os.ReadFile(file)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
+func runEmulate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("worker emulate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	addr := fs.String("listen", "127.0.0.1:8787", "listen address")
+	token := fs.String("token", "", "worker token (generated when empty)")
+	colo := fs.String("colo", "EMU", "colo reported by healthz")
+	doh := fs.String("doh", "https://cloudflare-dns.com/dns-query", "DoH upstream")
+	if err := fs.Parse(args); err != nil {
+		return 2
 	}
-	return json.Unmarshal(b, &m.workers)
-}
-
-// save persists current workers to the configured file.
-func (m *WorkerManager) save() error {
-	if m.file == "" {
-		return nil
+	if *token == "" {
+		t, err := engine.NewToken()
+		if err != nil {
+			fmt.Fprintf(stderr, "emulate: %v\n", err)
+			return 1
+		}
+		*token = t
 	}
-	b, err := json.MarshalIndent(m.workers, "", "  ")
-	if err != nil {
-		return err
+	fmt.Fprintf(stdout, "emulating worker on http://%s\ntoken: %s\n", *addr, *token)
+	if err := http.ListenAndServe(*addr, engine.NewWorkerEmulator(*token, *colo, *doh)); err != nil {
+		fmt.Fprintf(stderr, "emulate: %v\n", err)
+		return 1
 	}
-	return os.WriteFile(m.file, b, 0600)
+	return 0
 }